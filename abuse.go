@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// AbuseGuard watches the access rate of each share link. A link that is hit
+// more than threshold times within window, from at least minIPs distinct
+// addresses, has most likely leaked and is reported as abused.
+type AbuseGuard struct {
+	threshold int
+	window    time.Duration
+	minIPs    int
+
+	mu      sync.Mutex
+	windows map[string]*accessWindow
+	records int
+}
+
+// accessWindow is a bounded ring of the most recent accesses to one link
+type accessWindow struct {
+	times []time.Time
+	ips   []string
+	next  int
+	last  time.Time
+}
+
+// NewAbuseGuard creates a guard from cfg, or returns nil when automatic
+// revocation is disabled. A nil guard never reports abuse.
+func NewAbuseGuard(cfg *Config) *AbuseGuard {
+	if !cfg.AutoRevokeOnAbuse || cfg.AbuseThreshold <= 0 || cfg.AbuseWindow <= 0 {
+		return nil
+	}
+	return &AbuseGuard{
+		threshold: cfg.AbuseThreshold,
+		window:    cfg.AbuseWindow,
+		minIPs:    cfg.AbuseMinIPs,
+		windows:   make(map[string]*accessWindow),
+	}
+}
+
+// Record notes an access to token from ip and reports whether the link's
+// recent access pattern crosses the abuse threshold
+func (g *AbuseGuard) Record(token, ip string) bool {
+	if g == nil {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	g.records++
+	if g.records%sweepEvery == 0 {
+		g.sweep(now)
+	}
+
+	w, ok := g.windows[token]
+	if !ok {
+		// Keeping threshold+1 entries is enough to tell whether the
+		// threshold was exceeded within the window
+		w = &accessWindow{
+			times: make([]time.Time, 0, g.threshold+1),
+			ips:   make([]string, 0, g.threshold+1),
+		}
+		g.windows[token] = w
+	}
+	w.add(now, ip, g.threshold+1)
+
+	cutoff := now.Add(-g.window)
+	hits := 0
+	ips := make(map[string]struct{})
+	for i, t := range w.times {
+		if t.After(cutoff) {
+			hits++
+			ips[w.ips[i]] = struct{}{}
+		}
+	}
+	return hits > g.threshold && len(ips) >= g.minIPs
+}
+
+// Forget drops the access history of token, e.g. once it has been revoked
+func (g *AbuseGuard) Forget(token string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.windows, token)
+}
+
+// sweep drops windows that have seen no access for a full window
+func (g *AbuseGuard) sweep(now time.Time) {
+	for token, w := range g.windows {
+		if now.Sub(w.last) > g.window {
+			delete(g.windows, token)
+		}
+	}
+}
+
+func (w *accessWindow) add(t time.Time, ip string, size int) {
+	w.last = t
+	if len(w.times) < size {
+		w.times = append(w.times, t)
+		w.ips = append(w.ips, ip)
+		return
+	}
+	w.times[w.next] = t
+	w.ips[w.next] = ip
+	w.next = (w.next + 1) % size
+}
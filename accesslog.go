@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of share link use recorded in the access log
+const (
+	AccessKindView     = "view"
+	AccessKindDownload = "download"
+)
+
+// maxAccessLogEntries bounds the log kept per share link; older entries are
+// dropped first
+const maxAccessLogEntries = 10000
+
+// maxAnalyticsBuckets bounds the size of an analytics response
+const maxAnalyticsBuckets = 24 * 366
+
+// AccessLogEntry records one use of a share link
+type AccessLogEntry struct {
+	Token    string    `json:"token"`
+	Kind     string    `json:"kind"`
+	ClientIP string    `json:"clientIp"`
+	At       time.Time `json:"at"`
+}
+
+// AppendAccessLog records a use of a share link
+func (r *FileRepository) AppendAccessLog(entry AccessLogEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := append(r.accessLog[entry.Token], entry)
+	if len(entries) > maxAccessLogEntries {
+		entries = entries[len(entries)-maxAccessLogEntries:]
+	}
+	r.accessLog[entry.Token] = entries
+}
+
+// AccessLogForToken returns the recorded uses of token in [from, to), oldest
+// first. Zero times leave that end of the range open.
+func (r *FileRepository) AccessLogForToken(token string, from, to time.Time) []AccessLogEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var entries []AccessLogEntry
+	for _, e := range r.accessLog[token] {
+		if (!from.IsZero() && e.At.Before(from)) || (!to.IsZero() && !e.At.Before(to)) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// AnalyticsBucket counts the uses of a share link in one time interval
+type AnalyticsBucket struct {
+	Start     time.Time `json:"start"`
+	Views     int       `json:"views"`
+	Downloads int       `json:"downloads"`
+}
+
+// ShareLinkAnalytics returns a share link's views and downloads bucketed by
+// hour or day (?granularity=hour|day), optionally within ?from= and ?to=.
+// Empty intervals inside the range are included so the result can be
+// plotted directly.
+func (h *Handler) ShareLinkAnalytics(c *gin.Context) {
+	token := c.Param("token")
+	if _, exists := h.resolveShareLink(token); !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Share link not found")
+		return
+	}
+
+	granularity := c.DefaultQuery("granularity", "day")
+	var step time.Duration
+	switch granularity {
+	case "hour":
+		step = time.Hour
+	case "day":
+		step = 24 * time.Hour
+	default:
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Unsupported granularity, expected hour or day")
+		return
+	}
+
+	from, err := parseDateParam(c.Query("from"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid from date: "+err.Error())
+		return
+	}
+	to, err := parseDateParam(c.Query("to"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid to date: "+err.Error())
+		return
+	}
+
+	entries := h.fileRepo.AccessLogForToken(token, from, to)
+	buckets, err := bucketAccessLog(entries, step, from, to)
+	if err != nil {
+		respondAPIError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":       token,
+		"granularity": granularity,
+		"buckets":     buckets,
+	})
+}
+
+// bucketAccessLog counts entries per UTC interval of length step. The range
+// defaults to the span of the entries themselves.
+func bucketAccessLog(entries []AccessLogEntry, step time.Duration, from, to time.Time) ([]AnalyticsBucket, error) {
+	if from.IsZero() && len(entries) > 0 {
+		from = entries[0].At
+	}
+	if to.IsZero() {
+		if len(entries) == 0 {
+			return []AnalyticsBucket{}, nil
+		}
+		to = entries[len(entries)-1].At.Add(time.Nanosecond)
+	}
+	if !from.Before(to) {
+		return []AnalyticsBucket{}, nil
+	}
+
+	start := from.UTC().Truncate(step)
+	count := int(to.Sub(start)/step) + 1
+	if count > maxAnalyticsBuckets {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadRequest,
+			"Range too large: at most %d buckets, narrow the range or use a coarser granularity", maxAnalyticsBuckets)
+	}
+
+	buckets := make([]AnalyticsBucket, 0, count)
+	for t := start; t.Before(to); t = t.Add(step) {
+		buckets = append(buckets, AnalyticsBucket{Start: t})
+	}
+
+	for _, e := range entries {
+		i := sort.Search(len(buckets), func(i int) bool { return buckets[i].Start.After(e.At) }) - 1
+		if i < 0 {
+			continue
+		}
+		switch e.Kind {
+		case AccessKindView:
+			buckets[i].Views++
+		case AccessKindDownload:
+			buckets[i].Downloads++
+		}
+	}
+	return buckets, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits on user-supplied descriptions and metadata, which are stored and
+// returned with every listing
+const (
+	maxDescriptionLength = 2000
+	maxMetadataEntries   = 32
+	maxMetadataKeyLength = 64
+	maxMetadataValueSize = 1024
+)
+
+// validateAnnotations checks a description and metadata map against the
+// size limits, returning an apiError describing the first violation
+func validateAnnotations(description string, metadata map[string]string) error {
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "Description exceeds %d characters", maxDescriptionLength)
+	}
+	if len(metadata) > maxMetadataEntries {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "Metadata may have at most %d entries", maxMetadataEntries)
+	}
+	for k, v := range metadata {
+		if strings.TrimSpace(k) == "" || len(k) > maxMetadataKeyLength {
+			return newAPIError(http.StatusBadRequest, CodeBadRequest, "Metadata keys must be 1-%d bytes", maxMetadataKeyLength)
+		}
+		if len(v) > maxMetadataValueSize {
+			return newAPIError(http.StatusBadRequest, CodeBadRequest, "Metadata value for %q exceeds %d bytes", k, maxMetadataValueSize)
+		}
+	}
+	return nil
+}
+
+// parseMetadataField decodes the JSON object sent in a multipart "metadata"
+// form field. An empty field yields no metadata.
+func parseMetadataField(field string) (map[string]string, error) {
+	if strings.TrimSpace(field) == "" {
+		return nil, nil
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal([]byte(field), &metadata); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, "Metadata must be a JSON object of strings: %v", err)
+	}
+	return metadata, nil
+}
+
+// matchesQuery reports whether a file's name or description contains query,
+// ignoring case
+func matchesQuery(f *FileMetadata, query string) bool {
+	query = strings.ToLower(query)
+	return strings.Contains(strings.ToLower(f.Name), query) ||
+		strings.Contains(strings.ToLower(f.Description), query)
+}
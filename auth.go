@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyHeader is the header clients use to present an API key
+const apiKeyHeader = "X-API-Key"
+
+// apiKeyContextKey is where the authenticated API key is stored on the
+// gin context
+const apiKeyContextKey = "apiKey"
+
+// APIKey is a key accepted by the API and what it may do
+type APIKey struct {
+	Key  string `json:"key"`
+	Name string `json:"name,omitempty"` // Recorded on uploads; defaults to a key fingerprint
+
+	// Trusted keys may upload any content type, not just AllowedFileTypes
+	Trusted bool `json:"trusted,omitempty"`
+
+	// Total bytes of files uploaded with this key (0 = unlimited)
+	MaxStorage int64 `json:"maxStorage,omitempty"`
+}
+
+// ID names the key in file metadata and logs without revealing it
+func (k *APIKey) ID() string {
+	if k.Name != "" {
+		return k.Name
+	}
+	sum := sha256.Sum256([]byte(k.Key))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
+
+// loadAPIKeys reads API keys from API_KEYS_FILE or API_KEYS_JSON (a JSON
+// array of APIKey) and adds the plain keys of API_KEYS as untrusted keys
+func loadAPIKeys() ([]APIKey, error) {
+	var keys []APIKey
+	data := []byte(getEnv("API_KEYS_JSON", ""))
+	if path := getEnv("API_KEYS_FILE", ""); path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read API_KEYS_FILE: %w", err)
+		}
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("invalid API key configuration: %w", err)
+		}
+	}
+	for _, key := range getEnvList("API_KEYS", nil) {
+		keys = append(keys, APIKey{Key: key})
+	}
+	for i, k := range keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("API key %d has no key", i)
+		}
+	}
+	return keys, nil
+}
+
+// requireAPIKey rejects requests that don't present one of the configured
+// API keys, either in X-API-Key or as an "Authorization: Bearer" token.
+// With no keys configured the guarded endpoints are unavailable.
+func requireAPIKey(keys []APIKey) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := findAPIKey(presentedAPIKey(c), keys)
+		if key == nil {
+			respondError(c, http.StatusUnauthorized, CodeUnauthorized, "A valid API key is required")
+			return
+		}
+		c.Set(apiKeyContextKey, key)
+		c.Next()
+	}
+}
+
+// identifyAPIKey records the API key of requests that present one, for
+// endpoints that also serve anonymous clients. An invalid key is rejected
+// rather than silently treated as anonymous.
+func identifyAPIKey(keys []APIKey) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		presented := presentedAPIKey(c)
+		if presented == "" {
+			c.Next()
+			return
+		}
+		key := findAPIKey(presented, keys)
+		if key == nil {
+			respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Invalid API key")
+			return
+		}
+		c.Set(apiKeyContextKey, key)
+		c.Next()
+	}
+}
+
+// requestAPIKey returns the API key the request was authenticated with, or
+// nil for anonymous requests
+func requestAPIKey(c *gin.Context) *APIKey {
+	key, _ := c.Get(apiKeyContextKey)
+	k, _ := key.(*APIKey)
+	return k
+}
+
+// adminUserContextKey is where the authenticated admin user is stored on
+// the gin context
+const adminUserContextKey = "adminUser"
+
+// requireAdmin guards operational endpoints with HTTP Basic Auth using
+// ADMIN_USER and ADMIN_PASS. Without those credentials only requests from
+// the loopback interface are let through, so the endpoints stay off the
+// public surface. Behind a reverse proxy on the same machine every request
+// looks local, so set the credentials there.
+func requireAdmin(user, pass string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if user == "" {
+			ip := net.ParseIP(c.RemoteIP())
+			if ip == nil || !ip.IsLoopback() {
+				respondError(c, http.StatusForbidden, CodeForbidden, "Admin endpoints are only available locally unless ADMIN_USER is set")
+				return
+			}
+			c.Set(adminUserContextKey, "localhost")
+			c.Next()
+			return
+		}
+
+		gotUser, gotPass, ok := c.Request.BasicAuth()
+		// Compare both in full so timing doesn't reveal which one was wrong
+		userOK := subtle.ConstantTimeCompare([]byte(gotUser), []byte(user))
+		passOK := subtle.ConstantTimeCompare([]byte(gotPass), []byte(pass))
+		if !ok || userOK&passOK != 1 {
+			c.Header("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+			respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Admin credentials are required")
+			return
+		}
+		c.Set(adminUserContextKey, gotUser)
+		c.Next()
+	}
+}
+
+// presentedAPIKey returns the API key sent with the request, if any
+func presentedAPIKey(c *gin.Context) string {
+	if key := c.GetHeader(apiKeyHeader); key != "" {
+		return key
+	}
+	auth := c.GetHeader("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// findAPIKey compares key against every configured key in constant time
+// and returns the matching one
+func findAPIKey(key string, keys []APIKey) *APIKey {
+	if key == "" {
+		return nil
+	}
+	var found *APIKey
+	for i := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(keys[i].Key)) == 1 {
+			found = &keys[i]
+		}
+	}
+	return found
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// AvailabilityChecker periodically verifies that stored CIDs are still
+// served by the gateway, updating FileMetadata.Available. Each round checks
+// the least recently verified files, spacing requests out so the gateway
+// isn't hammered.
+type AvailabilityChecker struct {
+	storage  Storage
+	fileRepo *FileRepository
+	interval time.Duration
+	batch    int
+	delay    time.Duration
+}
+
+// NewAvailabilityChecker creates a checker configured from cfg
+func NewAvailabilityChecker(storage Storage, fileRepo *FileRepository, cfg *Config) *AvailabilityChecker {
+	return &AvailabilityChecker{
+		storage:  storage,
+		fileRepo: fileRepo,
+		interval: cfg.AvailabilityCheckInterval,
+		batch:    cfg.AvailabilityCheckBatch,
+		delay:    cfg.AvailabilityCheckDelay,
+	}
+}
+
+// Run checks a batch every interval until ctx is cancelled
+func (a *AvailabilityChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.checkBatch(ctx)
+		}
+	}
+}
+
+// checkBatch verifies one batch of files
+func (a *AvailabilityChecker) checkBatch(ctx context.Context) {
+	files := a.fileRepo.FilesForVerification(a.batch)
+	unavailable := 0
+
+	for i, file := range files {
+		if i > 0 {
+			// Rate-limit requests to the gateway
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(a.delay):
+			}
+		}
+
+		available, err := a.storage.CheckAvailability(ctx, file.CID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Availability check failed for file %s (%s): %v", file.ID, file.CID, err)
+			continue
+		}
+
+		now := time.Now()
+		a.fileRepo.UpdateFile(file.ID, func(f *FileMetadata) {
+			f.Available = available
+			f.LastVerifiedAt = &now
+		})
+		if !available {
+			unavailable++
+			log.Printf("File %s (%s) is no longer available on the gateway", file.ID, file.CID)
+		}
+	}
+
+	if len(files) > 0 {
+		log.Printf("Availability check: verified %d file(s), %d unavailable", len(files), unavailable)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Computing the CID that `storacha up --no-wrap` assigns to content lets us
+// ask whether the space already has it before uploading. The Storacha
+// client builds UnixFS files with 1MiB fixed-size chunks stored as raw
+// leaves, linked by a balanced tree of dag-pb nodes with up to 1024
+// children, and names the root with a base32 CIDv1.
+//
+// If the client's layout ever differs from what is reproduced here, the
+// computed CID simply won't be found and the content is uploaded as
+// before; a different file can't produce a matching CID.
+const (
+	unixfsChunkSize   = 1024 * 1024
+	unixfsMaxChildren = 1024
+
+	codecRaw        = 0x55
+	codecDagPB      = 0x70
+	multihashSHA256 = 0x12
+
+	unixfsTypeFile = 2
+)
+
+var cidBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// dagNode is a block of the UnixFS DAG as seen by its parent
+type dagNode struct {
+	cid         []byte
+	dagSize     uint64 // Bytes of this block and all blocks below it
+	contentSize uint64 // File bytes under this node
+}
+
+// computeUnixFSCID returns the CIDv1 (base32) of content laid out as a
+// UnixFS file the way the Storacha client does
+func computeUnixFSCID(content []byte) string {
+	var level []dagNode
+	for offset := 0; ; offset += unixfsChunkSize {
+		end := offset + unixfsChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		chunk := content[offset:end]
+		level = append(level, dagNode{
+			cid:         encodeCID(codecRaw, chunk),
+			dagSize:     uint64(len(chunk)),
+			contentSize: uint64(len(chunk)),
+		})
+		if end == len(content) {
+			break
+		}
+	}
+
+	for len(level) > 1 {
+		var parents []dagNode
+		for start := 0; start < len(level); start += unixfsMaxChildren {
+			end := start + unixfsMaxChildren
+			if end > len(level) {
+				end = len(level)
+			}
+			parents = append(parents, fileNode(level[start:end]))
+		}
+		level = parents
+	}
+	return "b" + strings.ToLower(cidBase32.EncodeToString(level[0].cid))
+}
+
+// fileNode encodes a dag-pb UnixFS file node linking children
+func fileNode(children []dagNode) dagNode {
+	var data []byte
+	var total, dagSize uint64
+	data = appendVarintField(data, 1, unixfsTypeFile)
+	for _, child := range children {
+		total += child.contentSize
+	}
+	data = appendVarintField(data, 3, total)
+	for _, child := range children {
+		data = appendVarintField(data, 4, child.contentSize)
+	}
+
+	// dag-pb puts links before data
+	var block []byte
+	for _, child := range children {
+		var link []byte
+		link = appendBytesField(link, 1, child.cid)
+		link = appendBytesField(link, 2, nil) // Empty name
+		link = appendVarintField(link, 3, child.dagSize)
+		block = appendBytesField(block, 2, link)
+		dagSize += child.dagSize
+	}
+	block = appendBytesField(block, 1, data)
+
+	return dagNode{
+		cid:         encodeCID(codecDagPB, block),
+		dagSize:     dagSize + uint64(len(block)),
+		contentSize: total,
+	}
+}
+
+// encodeCID returns the binary CIDv1 of a block with a sha2-256 multihash
+func encodeCID(codec uint64, block []byte) []byte {
+	digest := sha256.Sum256(block)
+	cid := binary.AppendUvarint([]byte{0x01}, codec)
+	cid = binary.AppendUvarint(cid, multihashSHA256)
+	cid = binary.AppendUvarint(cid, uint64(len(digest)))
+	return append(cid, digest[:]...)
+}
+
+// appendVarintField appends a protobuf varint field
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// appendBytesField appends a protobuf length-delimited field
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// codecCAR is the multicodec of CAR files, which name the shards of an
+// upload rather than its content
+const codecCAR = 0x0202
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// ValidateCID checks that s is a well-formed CID: a base58btc CIDv0
+// ("Qm..."), or a CIDv1 in base32 ("b...") or base58btc ("z..."), whose
+// multihash digest has the declared length
+func ValidateCID(s string) error {
+	_, err := decodeCID(s)
+	return err
+}
+
+// decodeCID validates a CID and returns its codec (dag-pb for CIDv0)
+func decodeCID(s string) (codec uint64, err error) {
+	if len(s) == 46 && strings.HasPrefix(s, "Qm") {
+		b, err := decodeBase58(s)
+		if err != nil {
+			return 0, err
+		}
+		if len(b) != 34 || b[0] != multihashSHA256 || b[1] != 32 {
+			return 0, fmt.Errorf("invalid CIDv0 %q", s)
+		}
+		return codecDagPB, nil
+	}
+	if s == "" {
+		return 0, fmt.Errorf("empty CID")
+	}
+
+	var b []byte
+	switch s[0] {
+	case 'b':
+		b, err = cidBase32.DecodeString(strings.ToUpper(s[1:]))
+	case 'z':
+		b, err = decodeBase58(s[1:])
+	default:
+		return 0, fmt.Errorf("unsupported CID encoding in %q", s)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid CID %q: %w", s, err)
+	}
+
+	// <version><codec><multihash code><digest length><digest>
+	var fields [4]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, fmt.Errorf("invalid CID %q: truncated", s)
+		}
+		fields[i], b = v, b[n:]
+	}
+	if fields[0] != 1 {
+		return 0, fmt.Errorf("invalid CID %q: unsupported version %d", s, fields[0])
+	}
+	if fields[3] == 0 || fields[3] != uint64(len(b)) {
+		return 0, fmt.Errorf("invalid CID %q: digest length mismatch", s)
+	}
+	return fields[1], nil
+}
+
+// decodeBase58 decodes base58btc, the encoding of CIDv0
+func decodeBase58(s string) ([]byte, error) {
+	var out []byte // Big-endian
+	for i := 0; i < len(s); i++ {
+		carry := strings.IndexByte(base58Alphabet, s[i])
+		if carry < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", s[i])
+		}
+		for j := len(out) - 1; j >= 0; j-- {
+			carry += int(out[j]) * 58
+			out[j] = byte(carry)
+			carry >>= 8
+		}
+		for ; carry > 0; carry >>= 8 {
+			out = append([]byte{byte(carry)}, out...)
+		}
+	}
+	// Leading '1's are leading zero bytes
+	for i := 0; i < len(s) && s[i] == '1'; i++ {
+		out = append([]byte{0}, out...)
+	}
+	return out, nil
+}
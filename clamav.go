@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ScanResult is the outcome of a virus scan
+type ScanResult struct {
+	Infected  bool
+	Signature string // Name of the matched signature when infected
+}
+
+// VirusScanner scans content for malware before it is stored
+type VirusScanner interface {
+	Scan(content io.Reader) (*ScanResult, error)
+}
+
+// ClamdScanner scans content with a clamd daemon using the INSTREAM protocol
+type ClamdScanner struct {
+	address   string
+	timeout   time.Duration
+	chunkSize int
+}
+
+// NewClamdScanner creates a scanner for the clamd daemon at address (host:port)
+func NewClamdScanner(address string) *ClamdScanner {
+	return &ClamdScanner{
+		address:   address,
+		timeout:   2 * time.Minute,
+		chunkSize: 64 * 1024,
+	}
+}
+
+// Scan streams content to clamd and reports whether it matched a signature
+func (s *ClamdScanner) Scan(content io.Reader) (*ScanResult, error) {
+	conn, err := net.DialTimeout("tcp", s.address, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return nil, fmt.Errorf("failed to set clamd deadline: %w", err)
+	}
+
+	// The null-terminated form of the command makes clamd reply null-terminated too
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, fmt.Errorf("failed to send INSTREAM command: %w", err)
+	}
+
+	// Each chunk is prefixed with its length as a 4-byte big-endian integer
+	buf := make([]byte, s.chunkSize)
+	size := make([]byte, 4)
+	for {
+		n, readErr := content.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return nil, fmt.Errorf("failed to stream to clamd: %w", err)
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return nil, fmt.Errorf("failed to stream to clamd: %w", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read content for scanning: %w", readErr)
+		}
+	}
+
+	// A zero-length chunk marks the end of the stream
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return nil, fmt.Errorf("failed to finish clamd stream: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply interprets a clamd reply such as "stream: OK" or
+// "stream: Eicar-Test-Signature FOUND"
+func parseClamdReply(reply string) (*ScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return &ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &ScanResult{
+			Infected:  true,
+			Signature: strings.TrimSuffix(reply, " FOUND"),
+		}, nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return nil, fmt.Errorf("clamd error: %s", strings.TrimSuffix(reply, " ERROR"))
+	}
+	return nil, fmt.Errorf("unexpected clamd reply: %q", reply)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fakeClamd is a clamd speaking just enough INSTREAM to answer each scan
+// with reply
+type fakeClamd struct {
+	listener net.Listener
+	reply    string
+	streamed chan []byte // Content received by each scan
+}
+
+func newFakeClamd(t *testing.T, reply string) *fakeClamd {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	f := &fakeClamd{listener: l, reply: reply, streamed: make(chan []byte, 16)}
+	t.Cleanup(func() { l.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeClamd) addr() string { return f.listener.Addr().String() }
+
+func (f *fakeClamd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if cmd, err := r.ReadString('\x00'); err != nil || cmd != "zINSTREAM\x00" {
+		return
+	}
+	var content bytes.Buffer
+	size := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, size); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size)
+		if n == 0 {
+			break
+		}
+		if _, err := io.CopyN(&content, r, int64(n)); err != nil {
+			return
+		}
+	}
+	f.streamed <- content.Bytes()
+	conn.Write([]byte("stream: " + f.reply + "\x00"))
+}
+
+// closedAddress returns an address nothing listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestClamdScanner(t *testing.T) {
+	content := bytes.Repeat([]byte("scan me "), 20000) // Several chunks
+
+	clean := newFakeClamd(t, "OK")
+	result, err := NewClamdScanner(clean.addr()).Scan(bytes.NewReader(content))
+	if err != nil || result.Infected {
+		t.Fatalf("clean scan = %+v, %v", result, err)
+	}
+	if got := <-clean.streamed; !bytes.Equal(got, content) {
+		t.Errorf("clamd received %d bytes, want %d", len(got), len(content))
+	}
+
+	infected := newFakeClamd(t, "Eicar-Test-Signature FOUND")
+	result, err = NewClamdScanner(infected.addr()).Scan(strings.NewReader("X5O!P%@AP"))
+	if err != nil || !result.Infected || result.Signature != "Eicar-Test-Signature" {
+		t.Errorf("infected scan = %+v, %v", result, err)
+	}
+
+	if _, err := NewClamdScanner(closedAddress(t)).Scan(strings.NewReader("x")); err == nil {
+		t.Error("scan without clamd succeeded")
+	}
+}
+
+func TestUploadVirusScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		address func(t *testing.T) string
+		status  int
+		code    string
+	}{
+		{
+			name:    "clean",
+			address: func(t *testing.T) string { return newFakeClamd(t, "OK").addr() },
+			status:  http.StatusOK,
+		},
+		{
+			name:    "infected",
+			address: func(t *testing.T) string { return newFakeClamd(t, "Eicar-Test-Signature FOUND").addr() },
+			status:  http.StatusUnprocessableEntity,
+			code:    CodeInfected,
+		},
+		{
+			// Scanning fails closed: nothing is stored unscanned
+			name:    "scanner unreachable",
+			address: closedAddress,
+			status:  http.StatusServiceUnavailable,
+			code:    CodeScannerUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := tt.address(t)
+			s := newTestServer(t, func(cfg *Config) { cfg.ClamAVAddress = address })
+			w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", nil,
+				multipartFile{Name: "a.txt", Content: []byte("content")}))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusOK {
+				return
+			}
+			var resp errorResponse
+			decodeJSON(t, w, &resp)
+			if resp.Code != tt.code {
+				t.Errorf("code = %s, want %s", resp.Code, tt.code)
+			}
+			if s.storage.uploads != 0 {
+				t.Errorf("%d files were uploaded", s.storage.uploads)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import "time"
+
+// Clock tells the time. Expiration and revocation logic reads the time
+// through a Clock so tests can control it instead of sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	gzipWriters  = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(io.Discard, flate.DefaultCompression)
+		return w
+	}}
+)
+
+// compressResponses compresses response bodies of at least minSize bytes
+// with gzip or deflate, whichever the client accepts. Only textual content
+// types are compressed; images, video, archives and other already
+// compressed formats pass through untouched.
+func compressResponses(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodHead || c.GetHeader("Range") != "" {
+			c.Next()
+			return
+		}
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		w := &compressWriter{
+			ResponseWriter: c.Writer,
+			encoding:       encoding,
+			minSize:        minSize,
+			status:         http.StatusOK,
+		}
+		c.Writer = w
+		defer w.finish()
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		c.Next()
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip, or returns "" when neither is acceptable
+func negotiateEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q > 0
+	}
+	switch {
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+// isCompressibleType reports whether a content type is worth compressing
+func isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		// Streams must reach the client as soon as they are flushed
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/javascript",
+		"application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter buffers the start of a response until it knows whether
+// the body is large and textual enough to compress
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser // Set once compression has started
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+// WriteHeaderNow is used for bodiless responses, which are never compressed
+func (w *compressWriter) WriteHeaderNow() {
+	if !w.decided {
+		w.decide(false)
+	}
+}
+
+func (w *compressWriter) Status() int {
+	return w.status
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to extend
+// its deadlines
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		if w.enc != nil {
+			return w.enc.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends buffered data immediately, compressed if it qualifies
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(len(w.buf) >= w.minSize)
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// decide commits to compressing (when allowed and the response qualifies)
+// or passing through, then writes the header and any buffered data
+func (w *compressWriter) decide(allowCompression bool) error {
+	w.decided = true
+	header := w.Header()
+	if allowCompression &&
+		header.Get("Content-Encoding") == "" &&
+		w.status != http.StatusNoContent &&
+		w.status != http.StatusNotModified &&
+		isCompressibleType(header.Get("Content-Type")) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", w.encoding)
+		w.enc = w.newEncoder()
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (w *compressWriter) newEncoder() io.WriteCloser {
+	if w.encoding == "gzip" {
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(w.ResponseWriter)
+		return gz
+	}
+	fl := flateWriters.Get().(*flate.Writer)
+	fl.Reset(w.ResponseWriter)
+	return fl
+}
+
+// finish writes out responses smaller than minSize uncompressed and closes
+// the encoder of compressed ones
+func (w *compressWriter) finish() {
+	if !w.decided {
+		w.decide(false)
+		return
+	}
+	if w.enc == nil {
+		return
+	}
+	w.enc.Close()
+	switch enc := w.enc.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(enc)
+	case *flate.Writer:
+		flateWriters.Put(enc)
+	}
+}
@@ -1,45 +1,665 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Supported values for the ENVIRONMENT variable
+const (
+	EnvDev  = "dev"
+	EnvProd = "prod"
+)
+
 // Config holds application configuration
 type Config struct {
+	// Deployment environment ("dev" or "prod")
+	Environment string
+
+	// Minimum level logged: "debug", "info", "warn" or "error"
+	LogLevel string
+
+	// Request paths left out of the request log, such as health checks
+	// probed every few seconds. An entry ending in "/*" matches every path
+	// below it.
+	LogSkipPaths []string
+
+	// OTLP/HTTP collector receiving traces (tracing disabled when empty)
+	OTLPEndpoint string
+
+	// Origins allowed by CORS. Required in prod; dev allows any origin.
+	AllowedOrigins []string
+
+	// Response headers browser code may read, and how long browsers may
+	// cache preflight results
+	CORSExposeHeaders []string
+	CORSMaxAge        time.Duration
+
+	// Methods allowed by CORS. Empty allows the methods the API's routes
+	// actually use.
+	CORSAllowMethods []string
+
 	// Storacha/UCAN configuration - values directly from env vars
 	PrivateKey string
 	Proof      string
 	SpaceDID   string
 
+	// Base URL share links are built on, e.g. "https://files.example.com"
+	// or "https://example.com/files" behind a path prefix. When empty it is
+	// derived from the request (and a trusted proxy's X-Forwarded-* headers).
+	PublicBaseURL string
+
+	// Reverse proxies whose X-Forwarded-For header is trusted for the
+	// client IP. Empty trusts none and uses the connection address.
+	TrustedProxies []string
+
+	// API keys for operator endpoints (repin, export, ...). Uploads made
+	// with a key are attributed to it and subject to its limits.
+	APIKeys []APIKey
+
+	// HTTP Basic Auth credentials for the admin and stats endpoints,
+	// separate from the API keys. Without them those endpoints only answer
+	// requests from the local machine.
+	AdminUser string
+	AdminPass string
+
 	// Application settings
-	DefaultExpiration time.Duration
-	MaxFileSize       int64 // in bytes
-	AllowedFileTypes  []string
+	DefaultExpiration  time.Duration // Share link lifetime when the request omits expiresIn
+	DefaultMaxAccesses int           // Share link access limit when the request omits maxAccesses (0 = unlimited)
+	MaxShareTTL        time.Duration // Longest a sliding-expiry link can live after creation
+	MaxFileSize        int64         // in bytes (0 = limited only by MaxRequestBytes)
+	MaxFilesPerUpload  int
+	MaxRequestBytes    int64 // Upload request body limit, multipart overhead included
+
+	// Files accepted in one directory upload
+	MaxDirectoryFiles int
+
+	// How long upload responses are kept for replay to retries with the
+	// same Idempotency-Key
+	IdempotencyKeyTTL time.Duration
+
+	// How long clients may reuse a files listing before revalidating it
+	// with its ETag (0 = always revalidate)
+	FilesCacheMaxAge time.Duration
+
+	// Oldest files are evicted from the in-memory store beyond this many
+	// (0 = unlimited)
+	MaxStoredFiles int
+
+	// Content types anonymous and untrusted-key uploads are limited to, when
+	// EnforceFileTypes is on
+	AllowedFileTypes []string
+	EnforceFileTypes bool
+
+	// Size limits by content type prefix (e.g. "image/" or
+	// "application/pdf"), applied to the detected type. The longest matching
+	// prefix wins; they can lower MaxFileSize but not raise it.
+	MaxFileSizeByType map[string]int64
+
+	// Extra extension to MIME type mappings (e.g. ".md" -> "text/markdown")
+	// for files whose type can't be sniffed from their content
+	ContentTypesByExtension map[string]string
+
+	// Where content is stored: "storacha", or "local" to keep it in
+	// StorageDir on this server and serve it without any gateway
+	StorageBackend string
+	StorageDir     string
+
+	// IPFS Gateway the server fetches content from, and the gateway shown
+	// to users in gateway URLs (IPFSGateway when empty)
+	IPFSGateway   string
+	PublicGateway string
+
+	// Gateways tried in order when a fetch from the primary gateway fails
+	FallbackGateways []string
+
+	// Gateways by client region (e.g. "DE" or "EU"), chosen from the
+	// CF-IPCountry or X-Geo request header. Regions without an entry, or
+	// all of them when empty, use the gateways above.
+	GatewaysByRegion map[string]string
+
+	// Headers sent with every request to the host of IPFSGateway, such as
+	// the API token of a paid gateway. Other gateways never receive them,
+	// and their values are redacted from the logs.
+	GatewayHeaders map[string]string
+
+	// Upload files unwrapped (their CID is the content's own) and skip
+	// uploading content the space already has
+	SkipExistingUploads bool
+
+	// Extra JSON paths (e.g. "data.root./") where the storacha CLI reports
+	// the CID of an upload, tried before the known output formats
+	UploadCIDPaths []string
+
+	// For files of at least ShardedUploadThreshold bytes (0 disables),
+	// storacha up is told to use CAR shards of UploadShardSize bytes and up
+	// to UploadShardConcurrency requests at once. This only tunes the CLI;
+	// shards aren't uploaded or retried individually.
+	ShardedUploadThreshold int64
+	UploadShardSize        int64
+	UploadShardConcurrency int
+
+	// Remove content from the Storacha space when the last file using it
+	// is deleted
+	DeleteFromStorage bool
+
+	// Keep encrypted copies of uploaded content in LocalStoreDir so content
+	// the gateway loses can be re-uploaded by repin. The oldest copies are
+	// deleted beyond LocalStoreMaxBytes (0 = unlimited).
+	RetainLocalCopy    bool
+	LocalStoreDir      string
+	LocalStoreMaxBytes int64
+	LocalStoreKey      string
+
+	// HTTP server timeouts. Routes streaming large bodies (uploads,
+	// downloads, event streams) get StreamTimeout instead of the read and
+	// write timeouts; 0 lets them run indefinitely.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	StreamTimeout     time.Duration
+
+	// Compression of textual responses of at least CompressMinBytes bytes
+	CompressResponses bool
+	CompressMinBytes  int
+
+	// Bytes of a text file returned by the share preview endpoint
+	PreviewMaxBytes int64
+
+	// Video posters: the ffmpeg binary and how much of the start of a
+	// video is fetched to find the first frame
+	FFmpegPath       string
+	PosterFetchBytes int64
+
+	// Allow publishing file CIDs under IPNS names through the ipfs CLI of
+	// a local IPFS (Kubo) node
+	IPNSPublish bool
+	IPFSCLI     string
+
+	// Share token size in random bytes and its encoding ("hex" or "base64url")
+	ShareTokenBytes    int
+	ShareTokenEncoding string
+
+	// How long expired share links are kept before maintenance purges them
+	ShareLinkRetention time.Duration
+
+	// Whether downloads of links with AllowedReferers succeed when the
+	// request carries neither a Referer nor an Origin header
+	AllowMissingReferer bool
+
+	// Stateless share links: tokens are HMAC-signed with ShareSecret and
+	// verified without a repository lookup
+	StatelessShareLinks bool
+	ShareSecret         string
+
+	// Whether share links may be created with a password, encrypting a copy
+	// of the content under it (see shareencryption.go)
+	EncryptShares bool
+
+	// Wrong passwords allowed per encrypted share link within
+	// SharePasswordWindow (0 = unlimited), and password checks run at once
+	SharePasswordMaxFailures    int
+	SharePasswordWindow         time.Duration
+	MaxConcurrentPasswordChecks int
+
+	// Keep the CID and gateway URL out of share link responses so shared
+	// content is only reachable through the download proxy, where
+	// revocation takes effect at once
+	HideGatewayURL bool
+
+	// Refuse share links for content the gateway can't serve. A file's
+	// availability verified within VerifyBeforeShareTTL is trusted rather
+	// than checked again.
+	VerifyBeforeShare    bool
+	VerifyBeforeShareTTL time.Duration
+
+	// Active share links included in a file's details; the rest are listed
+	// by GET /files/:id/shares
+	FileShareLinksLimit int
+
+	// Automatic revocation of share links accessed more than AbuseThreshold
+	// times within AbuseWindow from at least AbuseMinIPs addresses
+	AutoRevokeOnAbuse bool
+	AbuseThreshold    int
+	AbuseWindow       time.Duration
+	AbuseMinIPs       int
+
+	// Webhook receiving operational alerts, signed with WebhookSecret if set
+	WebhookURL    string
+	WebhookSecret string
+
+	// Also send share_link.accessed events, batching the accesses of each
+	// link over WebhookAccessWindow
+	WebhookAccessEvents bool
+	WebhookAccessWindow time.Duration
+
+	// Handling of a name that already exists in the target folder:
+	// "allow", "rename" or "reject"
+	OnNameCollision string
+
+	// Apply OnNameCollision across all folders instead of within each, with
+	// "allow" rejecting duplicates
+	UniqueFilenames bool
 
-	// IPFS Gateway
-	IPFSGateway string
+	// Files uploaded without a name are named FallbackFilename plus the
+	// upload time and an extension for their content type
+	FallbackFilename string
+
+	// Also send an ASCII transliteration of non-ASCII download filenames in
+	// Content-Disposition's filename= for clients without RFC 5987 support
+	TransliterateFilenames bool
+
+	// Upload concurrency: uploads beyond MaxConcurrentUploads wait in a queue
+	// of at most MaxQueuedUploads; further uploads are rejected with 503
+	MaxConcurrentUploads int
+	MaxQueuedUploads     int
+
+	// Gateway fetch concurrency for downloads, previews and posters, limited
+	// the same way as uploads
+	MaxConcurrentFetches int
+	MaxQueuedFetches     int
+
+	// Concurrent fetches of the same content up to this size share one
+	// upstream request (0 disables)
+	SharedFetchMaxBytes int64
+
+	// How often revocations that failed to publish are retried
+	RevocationRetryInterval time.Duration
+
+	// Background availability checking (disabled when the interval is 0)
+	AvailabilityCheckInterval time.Duration
+	AvailabilityCheckBatch    int
+	AvailabilityCheckDelay    time.Duration // Pause between gateway requests
+
+	// Persisting the in-memory repository to a JSON file (disabled when the
+	// path is empty); the snapshot is loaded on startup if it exists
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	// Outbound fetch safety: private networks that may still be reached
+	// (e.g. a gateway on the local network) and a cap on response sizes
+	FetchAllowedNetworks []string
+	MaxFetchBytes        int64
+
+	// Fetching remote files for upload-from-URL
+	URLFetchTimeout      time.Duration
+	URLFetchAllowedHosts []string // When set, only these hosts may be fetched
+	URLFetchDeniedHosts  []string
+	URLFetchMaxResumes   int // Range requests made to continue an interrupted download
+
+	// Virus scanning (clamd host:port, scanning disabled when empty)
+	ClamAVAddress string
+
+	// Variables LoadConfig couldn't parse, reported by Validate
+	envProblems []string
 }
 
+// multipartOverhead allows for multipart headers and form fields on top of
+// the file contents when deriving the default request size limit
+const multipartOverhead = 1024 * 1024
+
+// unlimitedFileRequestBytes is the default upload request limit when
+// MAX_FILE_SIZE is unlimited
+const unlimitedFileRequestBytes = 1024 * 1024 * 1024
+
 // LoadConfig loads configuration from environment variables
-func LoadConfig() *Config {
+func LoadConfig() (*Config, error) {
+	env := &envParser{}
 	cfg := &Config{
-		PrivateKey:        getEnv("STORACHA_PRIVATE_KEY", ""),
-		Proof:             getEnv("STORACHA_PROOF", ""),
-		SpaceDID:          getEnv("STORACHA_SPACE_DID", ""),
-		DefaultExpiration: 24 * time.Hour,
-		MaxFileSize:       100 * 1024 * 1024, // 100MB default
-		AllowedFileTypes: []string{
+		Environment:        getEnv("ENVIRONMENT", EnvDev),
+		LogLevel:           getEnv("LOG_LEVEL", "info"),
+		LogSkipPaths:       getEnvList("LOG_SKIP_PATHS", []string{"/api/health", "/api/livez", "/metrics"}),
+		OTLPEndpoint:       getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		AllowedOrigins:     getEnvList("ALLOWED_ORIGINS", nil),
+		CORSExposeHeaders:  getEnvList("CORS_EXPOSE_HEADERS", nil),
+		CORSMaxAge:         env.Duration("CORS_MAX_AGE", 12*time.Hour),
+		SpaceDID:           getEnv("STORACHA_SPACE_DID", ""),
+		PublicBaseURL:      strings.TrimRight(getEnv("PUBLIC_BASE_URL", ""), "/"),
+		TrustedProxies:     getEnvList("TRUSTED_PROXIES", nil),
+		DefaultExpiration:  env.Duration("DEFAULT_SHARE_EXPIRATION", 24*time.Hour),
+		DefaultMaxAccesses: env.Int("DEFAULT_MAX_ACCESSES", 0),
+		MaxShareTTL:        env.Duration("MAX_SHARE_TTL", 30*24*time.Hour),
+		MaxFileSize:        env.Int64("MAX_FILE_SIZE", 100*1024*1024), // 100MB default
+		MaxFilesPerUpload:  env.Int("MAX_FILES_PER_UPLOAD", 20),
+		MaxDirectoryFiles:  env.Int("MAX_DIRECTORY_FILES", 1000),
+		IdempotencyKeyTTL:  env.Duration("IDEMPOTENCY_KEY_TTL", 24*time.Hour),
+		FilesCacheMaxAge:   env.Duration("FILES_CACHE_MAX_AGE", 5*time.Second),
+		MaxStoredFiles:     env.Int("MAX_STORED_FILES", 0),
+		AllowedFileTypes: getEnvList("ALLOWED_FILE_TYPES", []string{
 			"image/jpeg", "image/png", "image/gif", "image/webp",
 			"application/pdf",
 			"text/plain",
 			"application/msword",
 			"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
-		},
-		IPFSGateway: getEnv("IPFS_GATEWAY", "https://w3s.link/ipfs"),
+		}),
+		EnforceFileTypes: env.Bool("ENFORCE_FILE_TYPES", false),
+
+		StorageBackend: getEnv("STORAGE_BACKEND", StorageBackendStoracha),
+		StorageDir:     getEnv("STORAGE_DIR", "content"),
+
+		IPFSGateway:   getEnv("IPFS_GATEWAY", "https://w3s.link/ipfs"),
+		PublicGateway: getEnv("PUBLIC_GATEWAY", ""),
+
+		FallbackGateways: getEnvList("FALLBACK_GATEWAYS", nil),
+		GatewaysByRegion: getEnvMap("GATEWAYS_BY_REGION"),
+
+		ContentTypesByExtension: getEnvMap("CONTENT_TYPES_BY_EXTENSION"),
+
+		ClamAVAddress: getEnv("CLAMAV_ADDRESS", ""),
+
+		DeleteFromStorage:   env.Bool("DELETE_FROM_STORAGE", false),
+		SkipExistingUploads: env.Bool("SKIP_EXISTING_UPLOADS", false),
+
+		UploadCIDPaths: getEnvList("UPLOAD_CID_JSON_PATHS", nil),
+
+		ShardedUploadThreshold: env.Int64("SHARDED_UPLOAD_THRESHOLD", 0),
+		UploadShardSize:        env.Int64("UPLOAD_SHARD_SIZE", 50*1024*1024),
+		UploadShardConcurrency: env.Int("UPLOAD_SHARD_CONCURRENCY", 3),
+
+		RetainLocalCopy:    env.Bool("RETAIN_LOCAL_COPY", false),
+		LocalStoreDir:      getEnv("LOCAL_STORE_DIR", "local-store"),
+		LocalStoreMaxBytes: env.Int64("LOCAL_STORE_MAX_BYTES", 10*1024*1024*1024), // 10GB default
+		LocalStoreKey:      getEnv("LOCAL_STORE_KEY", ""),
+
+		ReadHeaderTimeout: env.Duration("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       env.Duration("READ_TIMEOUT", 60*time.Second),
+		WriteTimeout:      env.Duration("WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       env.Duration("IDLE_TIMEOUT", 120*time.Second),
+		StreamTimeout:     env.Duration("STREAM_TIMEOUT", time.Hour),
+
+		CompressResponses: env.Bool("COMPRESS_RESPONSES", false),
+		CompressMinBytes:  env.Int("COMPRESS_MIN_BYTES", 1024),
+
+		PreviewMaxBytes: env.Int64("PREVIEW_MAX_BYTES", 64*1024),
+
+		FFmpegPath:       getEnv("FFMPEG_PATH", "ffmpeg"),
+		PosterFetchBytes: env.Int64("POSTER_FETCH_BYTES", 8*1024*1024),
+
+		IPNSPublish: env.Bool("IPNS_PUBLISH", false),
+		IPFSCLI:     getEnv("IPFS_CLI", "ipfs"),
+
+		ShareTokenBytes:    env.Int("SHARE_TOKEN_BYTES", 32),
+		ShareTokenEncoding: getEnv("SHARE_TOKEN_ENCODING", TokenEncodingHex),
+
+		ShareLinkRetention: env.Duration("SHARE_LINK_RETENTION", 30*24*time.Hour),
+
+		AllowMissingReferer: env.Bool("ALLOW_MISSING_REFERER", true),
+
+		StatelessShareLinks: env.Bool("STATELESS_SHARE_LINKS", false),
+		ShareSecret:         getEnv("SHARE_SECRET", ""),
+
+		EncryptShares: env.Bool("ENCRYPT_SHARES", false),
+
+		SharePasswordMaxFailures:    env.Int("SHARE_PASSWORD_MAX_FAILURES", 5),
+		SharePasswordWindow:         env.Duration("SHARE_PASSWORD_WINDOW", 15*time.Minute),
+		MaxConcurrentPasswordChecks: env.Int("MAX_CONCURRENT_PASSWORD_CHECKS", 4),
+
+		HideGatewayURL: env.Bool("HIDE_GATEWAY_URL", false),
+
+		VerifyBeforeShare:    env.Bool("VERIFY_BEFORE_SHARE", false),
+		VerifyBeforeShareTTL: env.Duration("VERIFY_BEFORE_SHARE_TTL", 5*time.Minute),
+
+		FileShareLinksLimit: env.Int("FILE_SHARE_LINKS_LIMIT", 20),
+
+		AutoRevokeOnAbuse: env.Bool("AUTO_REVOKE_ON_ABUSE", false),
+		AbuseThreshold:    env.Int("ABUSE_THRESHOLD", 300),
+		AbuseWindow:       env.Duration("ABUSE_WINDOW", time.Minute),
+		AbuseMinIPs:       env.Int("ABUSE_MIN_IPS", 10),
+
+		WebhookURL:    getEnv("WEBHOOK_URL", ""),
+		WebhookSecret: getEnv("WEBHOOK_SECRET", ""),
+
+		WebhookAccessEvents: env.Bool("WEBHOOK_ACCESS_EVENTS", false),
+		WebhookAccessWindow: env.Duration("WEBHOOK_ACCESS_WINDOW", 30*time.Second),
+
+		OnNameCollision: getEnv("NAME_COLLISION", CollisionAllow),
+		UniqueFilenames: env.Bool("UNIQUE_FILENAMES", false),
+
+		FallbackFilename: getEnv("FALLBACK_FILENAME", "upload"),
+
+		TransliterateFilenames: env.Bool("TRANSLITERATE_FILENAMES", false),
+
+		MaxConcurrentUploads: env.Int("MAX_CONCURRENT_UPLOADS", 4),
+		MaxQueuedUploads:     env.Int("MAX_QUEUED_UPLOADS", 16),
+		MaxConcurrentFetches: env.Int("MAX_CONCURRENT_FETCHES", 32),
+		MaxQueuedFetches:     env.Int("MAX_QUEUED_FETCHES", 128),
+
+		SharedFetchMaxBytes: env.Int64("SHARED_FETCH_MAX_BYTES", 8*1024*1024),
+
+		RevocationRetryInterval: env.Duration("REVOCATION_RETRY_INTERVAL", 5*time.Minute),
+
+		AvailabilityCheckInterval: env.Duration("AVAILABILITY_CHECK_INTERVAL", 0),
+		AvailabilityCheckBatch:    env.Int("AVAILABILITY_CHECK_BATCH", 20),
+		AvailabilityCheckDelay:    env.Duration("AVAILABILITY_CHECK_DELAY", time.Second),
+
+		SnapshotPath:     getEnv("SNAPSHOT_PATH", ""),
+		SnapshotInterval: env.Duration("SNAPSHOT_INTERVAL", time.Minute),
+
+		FetchAllowedNetworks: getEnvList("FETCH_ALLOWED_NETWORKS", nil),
+		MaxFetchBytes:        env.Int64("FETCH_MAX_BYTES", 1024*1024*1024), // 1GB default
+
+		URLFetchTimeout:      env.Duration("URL_FETCH_TIMEOUT", 60*time.Second),
+		URLFetchAllowedHosts: getEnvList("URL_FETCH_ALLOWED_HOSTS", nil),
+		URLFetchDeniedHosts:  getEnvList("URL_FETCH_DENIED_HOSTS", nil),
+		URLFetchMaxResumes:   env.Int("URL_FETCH_MAX_RESUMES", 3),
+	}
+
+	cfg.CORSAllowMethods = getEnvList("CORS_ALLOW_METHODS", nil)
+	for i, m := range cfg.CORSAllowMethods {
+		cfg.CORSAllowMethods[i] = strings.ToUpper(m)
+	}
+
+	if len(cfg.CORSExposeHeaders) == 0 {
+		cfg.CORSExposeHeaders = defaultCORSExposeHeaders
+	}
+
+	// By default a request may carry a full batch of maximum-size files
+	defaultRequestBytes := int64(unlimitedFileRequestBytes)
+	if cfg.MaxFileSize > 0 {
+		defaultRequestBytes = cfg.MaxFileSize*int64(cfg.MaxFilesPerUpload) + multipartOverhead
 	}
+	cfg.MaxRequestBytes = env.Int64("MAX_REQUEST_BYTES", defaultRequestBytes)
 
-	return cfg
+	cfg.AdminUser = getEnv("ADMIN_USER", "")
+	cfg.AdminPass = getEnv("ADMIN_PASS", "")
+
+	var err error
+	if cfg.MaxFileSizeByType, err = parseSizeLimits("MAX_FILE_SIZE_BY_TYPE"); err != nil {
+		return nil, err
+	}
+	if cfg.APIKeys, err = loadAPIKeys(); err != nil {
+		return nil, err
+	}
+	if cfg.GatewayHeaders, err = loadGatewayHeaders(); err != nil {
+		return nil, err
+	}
+
+	// Base64 variants are easier to pass as secrets on hosted platforms and
+	// take precedence over the plain values
+	if cfg.PrivateKey, err = getEnvSecret("PRIVATE_KEY_BASE64", "STORACHA_PRIVATE_KEY"); err != nil {
+		return nil, err
+	}
+	if cfg.Proof, err = getEnvSecret("PROOF_BASE64", "STORACHA_PROOF"); err != nil {
+		return nil, err
+	}
+
+	cfg.envProblems = env.problems
+	return cfg, nil
+}
+
+// TypeSizeLimit returns the size limit for a content type from
+// MaxFileSizeByType, or 0 when no prefix matches
+func (c *Config) TypeSizeLimit(contentType string) int64 {
+	contentType = strings.ToLower(contentType)
+	var limit int64
+	longest := -1
+	for prefix, l := range c.MaxFileSizeByType {
+		if strings.HasPrefix(contentType, prefix) && len(prefix) > longest {
+			limit, longest = l, len(prefix)
+		}
+	}
+	return limit
+}
+
+// FileSizeLimit returns the largest file accepted. With MaxFileSize unset
+// (0 or less) that's MaxRequestBytes, the most any upload can carry.
+func (c *Config) FileSizeLimit() int64 {
+	if c.MaxFileSize <= 0 {
+		return c.MaxRequestBytes
+	}
+	return c.MaxFileSize
+}
+
+// Validate checks the configuration for problems that would otherwise only
+// surface once requests start failing, reporting all of them at once
+func (c *Config) Validate() error {
+	// Values that didn't parse come first; checks below see their defaults
+	problems := append([]string(nil), c.envProblems...)
+
+	// Production uploads go to the Storacha space and need its credentials;
+	// dev may fall back to the CLI login or placeholder CIDs
+	if c.IsProduction() {
+		if c.SpaceDID == "" {
+			problems = append(problems, "STORACHA_SPACE_DID is required")
+		}
+		if c.PrivateKey == "" {
+			problems = append(problems, "a private key is required (STORACHA_PRIVATE_KEY or PRIVATE_KEY_BASE64)")
+		}
+		if c.Proof == "" {
+			problems = append(problems, "a delegation proof is required (STORACHA_PROOF or PROOF_BASE64)")
+		}
+	}
+
+	if !isHTTPURL(c.IPFSGateway) {
+		problems = append(problems, fmt.Sprintf("IPFS_GATEWAY %q is not an http(s) URL", c.IPFSGateway))
+	}
+	if c.PublicBaseURL != "" && !isHTTPURL(c.PublicBaseURL) {
+		problems = append(problems, fmt.Sprintf("PUBLIC_BASE_URL %q is not an http(s) URL", c.PublicBaseURL))
+	}
+	if c.PublicGateway != "" && !isHTTPURL(c.PublicGateway) {
+		problems = append(problems, fmt.Sprintf("PUBLIC_GATEWAY %q is not an http(s) URL", c.PublicGateway))
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.DefaultExpiration <= 0 {
+		problems = append(problems, "DEFAULT_SHARE_EXPIRATION must be positive")
+	}
+	if c.DefaultMaxAccesses < 0 {
+		problems = append(problems, "DEFAULT_MAX_ACCESSES must not be negative")
+	}
+	if c.WebhookAccessEvents && c.WebhookAccessWindow <= 0 {
+		problems = append(problems, "WEBHOOK_ACCESS_WINDOW must be positive")
+	}
+	if c.MaxShareTTL <= 0 {
+		problems = append(problems, "MAX_SHARE_TTL must be positive")
+	}
+	for _, gateway := range c.FallbackGateways {
+		if !isHTTPURL(gateway) {
+			problems = append(problems, fmt.Sprintf("fallback gateway %q is not an http(s) URL", gateway))
+		}
+	}
+	for region, gateway := range c.GatewaysByRegion {
+		if !isHTTPURL(gateway) {
+			problems = append(problems, fmt.Sprintf("gateway for region %s %q is not an http(s) URL", region, gateway))
+		}
+	}
+	if c.PosterFetchBytes <= 0 {
+		problems = append(problems, "POSTER_FETCH_BYTES must be positive")
+	}
+	if c.SnapshotPath != "" && c.SnapshotInterval <= 0 {
+		problems = append(problems, "SNAPSHOT_INTERVAL must be positive")
+	}
+	if c.ShardedUploadThreshold > 0 && (c.UploadShardSize <= 0 || c.UploadShardConcurrency <= 0) {
+		problems = append(problems, "UPLOAD_SHARD_SIZE and UPLOAD_SHARD_CONCURRENCY must be positive")
+	}
+	if c.SharePasswordMaxFailures > 0 && c.SharePasswordWindow <= 0 {
+		problems = append(problems, "SHARE_PASSWORD_WINDOW must be positive")
+	}
+	if c.MaxConcurrentPasswordChecks <= 0 {
+		problems = append(problems, "MAX_CONCURRENT_PASSWORD_CHECKS must be positive")
+	}
+	if (c.AdminUser == "") != (c.AdminPass == "") {
+		problems = append(problems, "ADMIN_USER and ADMIN_PASS must be set together")
+	}
+	if c.RevocationRetryInterval <= 0 {
+		problems = append(problems, "REVOCATION_RETRY_INTERVAL must be positive")
+	}
+	if c.MaxRequestBytes <= 0 {
+		problems = append(problems, "MAX_REQUEST_BYTES must be positive")
+	}
+	if c.FilesCacheMaxAge < 0 {
+		problems = append(problems, "FILES_CACHE_MAX_AGE must not be negative")
+	}
+	if c.MaxDirectoryFiles <= 0 {
+		problems = append(problems, "MAX_DIRECTORY_FILES must be positive")
+	}
+	if c.FallbackFilename == "" || strings.ContainsAny(c.FallbackFilename, `/\`) {
+		problems = append(problems, "FALLBACK_FILENAME must be a non-empty name without slashes")
+	}
+	switch c.StorageBackend {
+	case StorageBackendStoracha:
+	case StorageBackendLocal:
+		if c.StorageDir == "" {
+			problems = append(problems, "STORAGE_DIR must be set when STORAGE_BACKEND=local")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown STORAGE_BACKEND %q (expected %q or %q)", c.StorageBackend, StorageBackendStoracha, StorageBackendLocal))
+	}
+	switch c.OnNameCollision {
+	case CollisionAllow, CollisionRename, CollisionReject:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown NAME_COLLISION %q", c.OnNameCollision))
+	}
+	if err := c.validateShareTokens(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.StatelessShareLinks && len(c.ShareSecret) < minShareSecretLength {
+		problems = append(problems, fmt.Sprintf("SHARE_SECRET must be at least %d characters when STATELESS_SHARE_LINKS is enabled", minShareSecretLength))
+	}
+	if c.RetainLocalCopy && len(c.LocalStoreKey) < minShareSecretLength {
+		problems = append(problems, fmt.Sprintf("LOCAL_STORE_KEY must be at least %d characters when RETAIN_LOCAL_COPY is enabled", minShareSecretLength))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s):\n  - %s", len(problems), strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// isHTTPURL reports whether s is an absolute http(s) URL with a host
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validateShareTokens rejects share token settings that would make tokens
+// guessable or unusable in URLs
+func (c *Config) validateShareTokens() error {
+	if c.ShareTokenBytes < minShareTokenBytes {
+		return fmt.Errorf("SHARE_TOKEN_BYTES must be at least %d, got %d", minShareTokenBytes, c.ShareTokenBytes)
+	}
+	switch c.ShareTokenEncoding {
+	case TokenEncodingHex, TokenEncodingBase64URL:
+	default:
+		return fmt.Errorf("unknown SHARE_TOKEN_ENCODING %q (expected %q or %q)",
+			c.ShareTokenEncoding, TokenEncodingHex, TokenEncodingBase64URL)
+	}
+	return nil
+}
+
+// IsProduction reports whether the server runs with production defaults
+func (c *Config) IsProduction() bool {
+	return c.Environment == EnvProd
 }
 
 func getEnv(key, defaultValue string) string {
@@ -48,3 +668,149 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvList reads a comma-separated list, ignoring empty entries
+func getEnvList(key string, defaultValue []string) []string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvMap reads comma-separated KEY=value pairs, upper-casing the keys.
+// Malformed pairs are skipped with a warning.
+func getEnvMap(key string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range getEnvList(key, nil) {
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			log.Printf("Ignoring invalid entry %q in %s, expected KEY=value", pair, key)
+			continue
+		}
+		m[strings.ToUpper(k)] = v
+	}
+	return m
+}
+
+// loadGatewayHeaders reads GATEWAY_HEADERS, comma-separated Name=value
+// pairs, and GATEWAY_AUTH, the value of an Authorization header that takes
+// precedence over one in GATEWAY_HEADERS. Values are never echoed in
+// errors.
+func loadGatewayHeaders() (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range getEnvList("GATEWAY_HEADERS", nil) {
+		name, value, ok := strings.Cut(pair, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid entry in GATEWAY_HEADERS, expected Name=value")
+		}
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	if auth := getEnv("GATEWAY_AUTH", ""); auth != "" {
+		headers["Authorization"] = auth
+	}
+	for name, value := range headers {
+		if strings.ContainsAny(name, " \t:\r\n") || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid gateway header %q", name)
+		}
+	}
+	return headers, nil
+}
+
+// parseSizeLimits reads comma-separated type=bytes pairs, lower-casing the
+// types
+func parseSizeLimits(key string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+	for k, v := range getEnvMap(key) {
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid size %q for %s in %s", v, strings.ToLower(k), key)
+		}
+		limits[strings.ToLower(k)] = limit
+	}
+	return limits, nil
+}
+
+// envParser reads typed environment variables. Values that don't parse
+// are replaced by the default and collected in problems, which Validate
+// reports with the other configuration errors.
+type envParser struct {
+	problems []string
+}
+
+// Duration reads a duration such as "30s" or "7d"
+func (p *envParser) Duration(key string, defaultValue time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return defaultValue
+	}
+	d, err := ParseDuration(value)
+	if err != nil {
+		p.problems = append(p.problems, fmt.Sprintf("%s %q is not a valid duration", key, value))
+		return defaultValue
+	}
+	return d
+}
+
+// Int64 reads an integer
+func (p *envParser) Int64(key string, defaultValue int64) int64 {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return defaultValue
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		p.problems = append(p.problems, fmt.Sprintf("%s %q is not a valid integer", key, value))
+		return defaultValue
+	}
+	return n
+}
+
+// Int reads an integer
+func (p *envParser) Int(key string, defaultValue int) int {
+	return int(p.Int64(key, int64(defaultValue)))
+}
+
+// Bool reads a boolean such as "true" or "0"
+func (p *envParser) Bool(key string, defaultValue bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		p.problems = append(p.problems, fmt.Sprintf("%s %q is not a valid boolean", key, value))
+		return defaultValue
+	}
+	return b
+}
+
+// getEnvSecret reads a secret from the base64-encoded variable b64Key if it
+// is set, falling back to the plain variable plainKey. Only the source used
+// is logged, never the value.
+func getEnvSecret(b64Key, plainKey string) (string, error) {
+	if encoded := strings.TrimSpace(os.Getenv(b64Key)); encoded != "" {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", fmt.Errorf("%s is not valid base64: %w", b64Key, err)
+		}
+		if len(bytes.TrimSpace(decoded)) == 0 {
+			return "", fmt.Errorf("%s decodes to an empty value", b64Key)
+		}
+		log.Printf("Using %s from %s", plainKey, b64Key)
+		return string(decoded), nil
+	}
+	if value := getEnv(plainKey, ""); value != "" {
+		log.Printf("Using %s", plainKey)
+		return value, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// defaultConfig returns the configuration loaded without any environment
+func defaultConfig(t *testing.T) *Config {
+	t.Helper()
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return cfg
+}
+
+func TestValidateShareTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		bytes    int
+		encoding string
+		wantErr  string
+	}{
+		{name: "too short", bytes: minShareTokenBytes - 1, encoding: TokenEncodingHex, wantErr: "SHARE_TOKEN_BYTES must be at least 16"},
+		{name: "zero", bytes: 0, encoding: TokenEncodingBase64URL, wantErr: "SHARE_TOKEN_BYTES"},
+		{name: "exactly minimum", bytes: minShareTokenBytes, encoding: TokenEncodingHex},
+		{name: "exactly minimum base64url", bytes: minShareTokenBytes, encoding: TokenEncodingBase64URL},
+		{name: "default", bytes: 32, encoding: TokenEncodingHex},
+		{name: "unknown encoding", bytes: 32, encoding: "base32", wantErr: "unknown SHARE_TOKEN_ENCODING"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig(t)
+			cfg.ShareTokenBytes = tt.bytes
+			cfg.ShareTokenEncoding = tt.encoding
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadPublicBaseURL(t *testing.T) {
+	t.Setenv("PUBLIC_BASE_URL", "https://files.example.com/base/")
+	cfg := defaultConfig(t)
+	if cfg.PublicBaseURL != "https://files.example.com/base" {
+		t.Fatalf("PublicBaseURL = %q", cfg.PublicBaseURL)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+	w := s.do(httptest.NewRequest(http.MethodPost, "/api/files/"+file.ID+"/share", nil))
+	var created ShareLinkResponse
+	decodeJSON(t, w, &created)
+	if want := "https://files.example.com/base/api/share/" + created.ShareLink.Token; created.URL != want {
+		t.Errorf("share URL = %s, want %s", created.URL, want)
+	}
+}
+
+func TestInvalidEnvValuesReported(t *testing.T) {
+	t.Setenv("DEFAULT_SHARE_EXPIRATION", "7days")
+	t.Setenv("MAX_FILE_SIZE", "100MB")
+	t.Setenv("ENCRYPT_SHARES", "yes please")
+	cfg := defaultConfig(t)
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate accepted invalid values")
+	}
+	for _, want := range []string{
+		`DEFAULT_SHARE_EXPIRATION "7days" is not a valid duration`,
+		`MAX_FILE_SIZE "100MB" is not a valid integer`,
+		`ENCRYPT_SHARES "yes please" is not a valid boolean`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate = %v, missing %q", err, want)
+		}
+	}
+}
+
+func TestUnlimitedMaxFileSize(t *testing.T) {
+	for _, value := range []string{"0", "-1"} {
+		t.Run(value, func(t *testing.T) {
+			t.Setenv("MAX_FILE_SIZE", value)
+			cfg := defaultConfig(t)
+			if cfg.MaxRequestBytes != unlimitedFileRequestBytes {
+				t.Errorf("MaxRequestBytes = %d, want %d", cfg.MaxRequestBytes, unlimitedFileRequestBytes)
+			}
+			if limit := cfg.FileSizeLimit(); limit != cfg.MaxRequestBytes {
+				t.Errorf("FileSizeLimit = %d, want MaxRequestBytes %d", limit, cfg.MaxRequestBytes)
+			}
+
+			// Files are only limited by the request size
+			s := newTestServer(t, func(cfg *Config) { cfg.MaxRequestBytes = 4096 })
+			s.uploadTestFile("small.txt", []byte(strings.Repeat("x", 2048)))
+			w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", nil,
+				multipartFile{Name: "large.txt", Content: []byte(strings.Repeat("x", 8192))}))
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("upload beyond MaxRequestBytes: status %d, body %s", w.Code, w.Body)
+			}
+			var resp errorResponse
+			if decodeJSON(t, w, &resp); resp.Code != CodeRequestTooLarge {
+				t.Errorf("code = %s, want %s", resp.Code, CodeRequestTooLarge)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// detectContentType sniffs content and falls back to the filename's
+// extension when sniffing only finds a generic type. Sniffing can't tell
+// CSV, JSON or Markdown from plain text, nor most binary formats from
+// arbitrary bytes, but a specific sniffed type (an image, say) is trusted
+// over whatever the name claims.
+func detectContentType(content []byte, filename string) string {
+	sniffed := http.DetectContentType(content)
+	if !isGenericType(sniffed) {
+		return sniffed
+	}
+	byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
+	if byExt == "" {
+		return sniffed
+	}
+	// Text content keeps being served as text, whatever the extension says
+	if strings.HasPrefix(sniffed, "text/plain") && !isTextLike(byExt) {
+		return sniffed
+	}
+	return byExt
+}
+
+// isGenericType reports whether a sniffed type says little about the content
+func isGenericType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/octet-stream" || mediaType == "text/plain"
+}
+
+// preferredExtensions picks the usual extension for types the mime package
+// knows several for
+var preferredExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/tiff":      ".tif",
+	"text/plain":      ".txt",
+	"text/html":       ".html",
+	"video/mpeg":      ".mpg",
+	"audio/mpeg":      ".mp3",
+	"application/xml": ".xml",
+}
+
+// extensionForType returns an extension for a content type, or "" when
+// none is known
+func extensionForType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	exts, _ := mime.ExtensionsByType(mediaType)
+	if len(exts) == 0 {
+		return ""
+	}
+	return exts[0]
+}
+
+// registerContentTypes adds extension to MIME type mappings used by
+// detectContentType, extending or overriding the system's
+func registerContentTypes(types map[string]string) error {
+	for ext, contentType := range types {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if err := mime.AddExtensionType(ext, contentType); err != nil {
+			return fmt.Errorf("invalid content type %q for %s: %w", contentType, ext, err)
+		}
+	}
+	return nil
+}
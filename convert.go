@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "golang.org/x/image/webp" // Registers the WebP decoder with image.Decode
+)
+
+// maxCachedConversions bounds the converted image cache; the oldest entry
+// goes first
+const maxCachedConversions = 64
+
+// maxConvertPixels bounds the size of images that are converted, so a small
+// file that decodes to a huge bitmap can't exhaust memory
+const maxConvertPixels = 50_000_000
+
+// convertTimeout bounds a single ffmpeg run for WebP encoding
+const convertTimeout = 30 * time.Second
+
+// conversionFormats are the image formats downloads can be converted
+// between, by their ?format= name. WebP is only offered when ffmpeg is
+// found at startup (see availableConversionFormats).
+var conversionFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"jpg":  "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+// conversionExtensions names converted files
+var conversionExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// availableConversionFormats returns the ?format= names this server can
+// convert to, and the path of ffmpeg, which WebP encoding needs, or ""
+// without it
+func availableConversionFormats(cfg *Config) (map[string]string, string) {
+	formats := make(map[string]string, len(conversionFormats))
+	for name, contentType := range conversionFormats {
+		formats[name] = contentType
+	}
+	ffmpeg, err := exec.LookPath(cfg.FFmpegPath)
+	if err != nil {
+		log.Printf("ffmpeg not found (%s), WebP conversion is disabled", cfg.FFmpegPath)
+		delete(formats, "webp")
+		return formats, ""
+	}
+	return formats, ffmpeg
+}
+
+// conversionFormatNames lists format names for error messages, e.g.
+// "jpeg, png or gif"
+func conversionFormatNames(formats map[string]string) string {
+	var names []string
+	for _, name := range []string{"jpeg", "png", "gif", "webp"} {
+		if _, ok := formats[name]; ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// convertibleImage reports whether content of this type can be converted
+func convertibleImage(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	_, ok := conversionExtensions[mediaType]
+	return ok
+}
+
+// convertedFile describes a file as converted to targetType, renamed to
+// the matching extension
+func convertedFile(file *FileMetadata, targetType string, size int) *FileMetadata {
+	converted := *file
+	converted.ContentType = targetType
+	converted.Size = int64(size)
+	converted.Name = strings.TrimSuffix(file.Name, path.Ext(file.Name)) + conversionExtensions[targetType]
+	return &converted
+}
+
+// convertSharedContent returns the content of a share converted to
+// targetType. Conversions of unencrypted shares are cached by CID; those of
+// encrypted shares are redone each time, after the password is checked. On
+// failure it writes the error response and returns false.
+func (h *Handler) convertSharedContent(c *gin.Context, link *ShareLink, file *FileMetadata, targetType string) ([]byte, bool) {
+	key := link.CID + ":" + targetType
+	if link.Encryption == nil {
+		if converted, cached := h.conversion.get(key); cached {
+			return converted, true
+		}
+	}
+
+	var source []byte
+	if link.Encryption != nil {
+		var ok bool
+		if source, ok = h.decryptSharedContent(c, link); !ok {
+			return nil, false
+		}
+	} else {
+		var err error
+		if source, err = h.fetchAll(c, link.CID, file.ContentType); err != nil {
+			respondAPIError(c, err)
+			return nil, false
+		}
+	}
+
+	converted, err := h.convertImage(c.Request.Context(), source, targetType)
+	if err != nil {
+		respondAPIError(c, err)
+		return nil, false
+	}
+	if link.Encryption == nil {
+		h.conversion.put(key, converted)
+	}
+	return converted, true
+}
+
+// convertImage re-encodes a JPEG, PNG, GIF or WebP image as targetType.
+// JPEG, PNG and GIF are encoded with the standard library; WebP needs
+// ffmpeg, without which it isn't among the formats offered.
+func (h *Handler) convertImage(ctx context.Context, content []byte, targetType string) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, newAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "The file is not a supported image")
+	}
+	if config.Width*config.Height > maxConvertPixels {
+		return nil, newAPIError(http.StatusUnprocessableEntity, CodeUnsupportedMediaType,
+			"Images larger than %d pixels can't be converted", maxConvertPixels)
+	}
+
+	if targetType == "image/webp" {
+		return h.encodeWebP(ctx, content)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, newAPIError(http.StatusUnprocessableEntity, CodeUnsupportedMediaType, "Failed to decode the image: %v", err)
+	}
+	var out bytes.Buffer
+	switch targetType {
+	case "image/jpeg":
+		// JPEG has no alpha channel; transparent areas become white
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		err = jpeg.Encode(&out, flat, &jpeg.Options{Quality: 85})
+	case "image/png":
+		err = png.Encode(&out, img)
+	case "image/gif":
+		err = gif.Encode(&out, img, nil)
+	}
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, CodeInternal, "Failed to encode the image: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// encodeWebP has ffmpeg encode an image as WebP
+func (h *Handler) encodeWebP(ctx context.Context, content []byte) ([]byte, error) {
+	if h.ffmpeg == "" {
+		return nil, newAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType,
+			"WebP conversion is not available on this server")
+	}
+
+	tmp, err := os.CreateTemp("", "convert-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, convertTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.ffmpeg, "-v", "error", "-i", tmp.Name(),
+		"-frames:v", "1", "-c:v", "libwebp", "-f", "webp", "pipe:1")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil || stdout.Len() == 0 {
+		log.Printf("WebP conversion failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		return nil, newAPIError(http.StatusUnprocessableEntity, CodeUnsupportedMediaType, "Could not convert this image to WebP")
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebPNotOfferedWithoutFFmpeg(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.FFmpegPath = "/nonexistent/ffmpeg"
+	})
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	file := s.uploadTestFile("pixel.png", img.Bytes())
+	link := s.createShareLink(file.ID, "")
+	download := "/api/share/" + link.Token + "/download?format="
+
+	w := s.do(httptest.NewRequest(http.MethodGet, download+"webp", nil))
+	var resp errorResponse
+	if decodeJSON(t, w, &resp); w.Code != http.StatusUnsupportedMediaType || !strings.HasSuffix(resp.Error, "expected jpeg, png or gif") {
+		t.Errorf("webp: status %d, body %s", w.Code, w.Body)
+	}
+	w = s.do(httptest.NewRequest(http.MethodGet, download+"jpeg", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("jpeg: status %d, content type %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
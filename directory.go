@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// directoryContentType is recorded as the content type of uploaded
+// directories
+const directoryContentType = "inode/directory"
+
+// errDirectoryUploadUnavailable is returned when directories can't be
+// uploaded, e.g. without the storacha CLI
+var errDirectoryUploadUnavailable = errors.New("directory uploads are not available")
+
+// DirectoryFile is a file to upload as part of a directory
+type DirectoryFile struct {
+	Path    string // Cleaned, slash-separated and relative to the directory
+	Content []byte
+}
+
+// UploadDirectory uploads files as one directory with the storacha CLI,
+// returning the CID of the directory. Each file is then found at
+// {gateway}/{cid}/{path}.
+func (s *StorageService) UploadDirectory(ctx context.Context, files []DirectoryFile) (_ *UploadResult, err error) {
+	ctx, span := startSpan(ctx, "StorageService.UploadDirectory")
+	defer func() { endSpan(span, err) }()
+
+	// Placeholder CIDs can't be resolved into paths, so there's no direct
+	// mode for directories
+	if _, err := exec.LookPath("storacha"); err != nil {
+		return nil, fmt.Errorf("%w: storacha CLI not available", errDirectoryUploadUnavailable)
+	}
+
+	release, err := s.acquireUploadSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	dir, err := os.MkdirTemp("", "upload-dir-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := writeDirectoryFiles(dir, files); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "storacha", "up", dir, "--json")
+	cmd.WaitDelay = cliWaitDelay
+	output, err := cmd.CombinedOutput()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, fmt.Errorf("upload cancelled: %w", ctxErr)
+	}
+	slog.Debug("Storacha CLI output", "output", redactSecrets(string(output)))
+	if err != nil {
+		return nil, fmt.Errorf("storacha up failed: %v: %s", err, redactSecrets(strings.TrimSpace(string(output))))
+	}
+
+	cidStr := parseUploadCID(string(output), s.config.UploadCIDPaths)
+	if cidStr == "" {
+		return nil, fmt.Errorf("could not parse CID from output: %s", redactSecrets(string(output)))
+	}
+	span.SetAttributes(attrCID.String(cidStr))
+	slog.Info("Uploaded directory to Storacha", "cid", cidStr, "files", len(files))
+	return &UploadResult{CID: cidStr, GatewayURL: s.GetGatewayURL(cidStr, "")}, nil
+}
+
+// writeDirectoryFiles recreates the tree of files under dir. Paths have
+// been cleaned already; anything resolving outside dir is refused anyway.
+func writeDirectoryFiles(dir string, files []DirectoryFile) error {
+	for _, f := range files {
+		target := filepath.Join(dir, filepath.FromSlash(f.Path))
+		if !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+			return fmt.Errorf("path %q leaves the directory", f.Path)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", f.Path, err)
+		}
+		if err := os.WriteFile(target, f.Content, 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %w", f.Path, err)
+		}
+	}
+	return nil
+}
+
+// directoryContentPath returns the gateway path of a file within a
+// directory CID, "{cid}/{path}" with each path segment escaped
+func directoryContentPath(cid, entryPath string) string {
+	segments := strings.Split(entryPath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return cid + "/" + strings.Join(segments, "/")
+}
+
+// hiddenEntries copies the entries of a directory without their CIDs, for
+// shares that don't give CIDs away
+func hiddenEntries(entries []DirectoryEntry) []DirectoryEntry {
+	if entries == nil {
+		return nil
+	}
+	hidden := make([]DirectoryEntry, len(entries))
+	for i, entry := range entries {
+		entry.CID = ""
+		hidden[i] = entry
+	}
+	return hidden
+}
+
+// cleanEntryPath normalizes the relative path of a file in an uploaded
+// directory, rejecting absolute paths and any that could leave the
+// directory
+func cleanEntryPath(p string) (string, error) {
+	p = strings.TrimSpace(strings.ReplaceAll(p, "\\", "/"))
+	switch {
+	case p == "":
+		return "", fmt.Errorf("empty path")
+	case strings.HasPrefix(p, "/"), len(p) >= 2 && p[1] == ':':
+		return "", fmt.Errorf("path %q is not relative", p)
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("path %q may not contain '..'", p)
+		}
+		if strings.IndexFunc(segment, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+			return "", fmt.Errorf("path %q contains control characters", p)
+		}
+	}
+	p = path.Clean(p)
+	if p == "." {
+		return "", fmt.Errorf("empty path")
+	}
+	return p, nil
+}
+
+// directoryPaths cleans the paths of an uploaded directory's files and
+// checks they form a tree: no duplicates, and no file where another file
+// needs a directory. When every path starts with the same directory, as
+// when a browser uploads a folder, that directory is returned as root and
+// removed from the paths.
+func directoryPaths(raw []string) (paths []string, root string, err error) {
+	paths = make([]string, len(raw))
+	for i, p := range raw {
+		if paths[i], err = cleanEntryPath(p); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if first, _, found := strings.Cut(paths[0], "/"); found {
+		root = first
+		for _, p := range paths {
+			if !strings.HasPrefix(p, root+"/") {
+				root = ""
+				break
+			}
+		}
+	}
+	if root != "" {
+		for i, p := range paths {
+			paths[i] = strings.TrimPrefix(p, root+"/")
+		}
+	}
+
+	files := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		if files[p] {
+			return nil, "", fmt.Errorf("duplicate path %q", p)
+		}
+		files[p] = true
+	}
+	for _, p := range paths {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if files[dir] {
+				return nil, "", fmt.Errorf("%q is both a file and a directory", dir)
+			}
+		}
+	}
+	return paths, root, nil
+}
+
+// UploadDirectory uploads a directory of files as one CID. Files are sent
+// in the "files" fields of a multipart form with their relative paths in
+// matching "paths" fields (browsers drop directories from file names);
+// without paths, files are stored under their names. The directory is
+// named by "name", the folder the files were picked from, or the fallback
+// name, and is stored as a single file with IsDirectory set and its
+// entries listed.
+func (h *Handler) UploadDirectory(c *gin.Context) {
+	form, err := c.MultipartForm()
+	if isBodyTooLarge(err) {
+		respondErrorf(c, http.StatusRequestEntityTooLarge, CodeRequestTooLarge,
+			"Request body exceeds maximum size of %d bytes", h.config.MaxRequestBytes)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Failed to parse form")
+		return
+	}
+
+	headers := form.File["files"]
+	if len(headers) == 0 {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "No files provided")
+		return
+	}
+	if len(headers) > h.config.MaxDirectoryFiles {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "Too many files: a directory may hold at most %d", h.config.MaxDirectoryFiles)
+		return
+	}
+	rawPaths := form.Value["paths"]
+	if len(rawPaths) == 0 {
+		for _, fh := range headers {
+			rawPaths = append(rawPaths, fh.Filename)
+		}
+	} else if len(rawPaths) != len(headers) {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "Got %d paths for %d files", len(rawPaths), len(headers))
+		return
+	}
+	paths, root, err := directoryPaths(rawPaths)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid path: "+err.Error())
+		return
+	}
+
+	folder, err := normalizeFolder(c.PostForm("folder"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid folder: "+err.Error())
+		return
+	}
+	description := strings.TrimSpace(c.PostForm("description"))
+	metadata, err := parseMetadataField(c.PostForm("metadata"))
+	if err == nil {
+		err = validateAnnotations(description, metadata)
+	}
+	if err != nil {
+		respondAPIError(c, err)
+		return
+	}
+
+	name := sanitizeDisplayName(c.PostForm("name"))
+	if name == "" {
+		name = sanitizeDisplayName(root)
+	}
+	if name == "" {
+		name = h.fallbackName("")
+	}
+
+	files := make([]DirectoryFile, len(headers))
+	for i, fh := range headers {
+		if fh.Size > h.config.FileSizeLimit() {
+			respondErrorf(c, http.StatusBadRequest, CodeFileTooLarge, "File %s exceeds maximum size of %d bytes", paths[i], h.config.FileSizeLimit())
+			return
+		}
+		src, err := fh.Open()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to open uploaded file")
+			return
+		}
+		content, err := io.ReadAll(src)
+		src.Close()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to read file content")
+			return
+		}
+		files[i] = DirectoryFile{Path: paths[i], Content: content}
+	}
+
+	stored, err := h.storeDirectory(c.Request.Context(), files, uploadOptions{
+		Name:        name,
+		Folder:      folder,
+		Description: description,
+		Metadata:    metadata,
+		Uploader:    requestAPIKey(c),
+	})
+	if err != nil {
+		respondAPIError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file":    h.presentFile(stored),
+		"message": fmt.Sprintf("Successfully uploaded a directory of %d file(s)", len(files)),
+	})
+}
+
+// storeDirectory runs the files of a directory through the checks of the
+// ingest pipeline, uploads them together and saves the directory's
+// metadata, returning an apiError describing any rejection
+func (h *Handler) storeDirectory(ctx context.Context, files []DirectoryFile, opts uploadOptions) (_ *FileMetadata, err error) {
+	ctx, span := startSpan(ctx, "storeDirectory", attrFileName.String(opts.Name))
+	defer func() { endSpan(span, err) }()
+
+	name, err := h.resolveName(opts.Folder, opts.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]DirectoryEntry, len(files))
+	var total int64
+	for i, f := range files {
+		contentType := detectContentType(f.Content, path.Base(f.Path))
+		if err := h.checkUploadAllowed(opts.Uploader, f.Path, contentType, int64(len(f.Content))); err != nil {
+			return nil, err
+		}
+		if h.scanner != nil {
+			scan, err := h.scanner.Scan(bytes.NewReader(f.Content))
+			if err != nil {
+				log.Printf("Virus scan failed for %s: %v", f.Path, err)
+				return nil, newAPIError(http.StatusServiceUnavailable, CodeScannerUnavailable, "Virus scanner unavailable")
+			}
+			if scan.Infected {
+				apiErr := newAPIError(http.StatusUnprocessableEntity, CodeInfected, "File %s was rejected by the virus scanner", f.Path)
+				apiErr.Details = gin.H{"signature": scan.Signature}
+				return nil, apiErr
+			}
+		}
+		entries[i] = DirectoryEntry{
+			Path:        f.Path,
+			Size:        int64(len(f.Content)),
+			ContentType: contentType,
+			CID:         computeUnixFSCID(f.Content),
+		}
+		total += int64(len(f.Content))
+	}
+	if err := h.checkQuota(opts.Uploader, name, total); err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	result, err := h.storage.UploadDirectory(ctx, files)
+	switch {
+	case errors.Is(err, ErrUploadQueueFull):
+		return nil, newAPIError(http.StatusServiceUnavailable, CodeBusy, "Server is busy, please retry the upload later")
+	case errors.Is(err, errDirectoryUploadUnavailable), errors.Is(err, errLocalUnsupported):
+		return nil, newAPIError(http.StatusNotImplemented, CodeBadRequest, "Directory uploads are not available on this server")
+	case err != nil:
+		return nil, newAPIError(http.StatusInternalServerError, CodeInternal, "Failed to upload: %v", err)
+	}
+
+	metadata := &FileMetadata{
+		Name:        name,
+		Folder:      opts.Folder,
+		Size:        total,
+		ContentType: directoryContentType,
+		CID:         result.CID,
+		UploadedAt:  h.clock.Now(),
+		GatewayURL:  result.GatewayURL,
+		UploadedBy:  uploaderID(opts.Uploader),
+		Description: opts.Description,
+		Metadata:    opts.Metadata,
+		Available:   true,
+		IsDirectory: true,
+		Entries:     entries,
+	}
+	if err := h.saveNewFile(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// directoryEntry finds the entry of a directory named by the request's
+// ?path=. On failure it writes the error response and returns false.
+func directoryEntry(c *gin.Context, dir *FileMetadata) (DirectoryEntry, bool) {
+	raw := c.Query("path")
+	if raw == "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Directories can't be downloaded as a whole, pick a file with ?path=")
+		return DirectoryEntry{}, false
+	}
+	entryPath, err := cleanEntryPath(raw)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid path: "+err.Error())
+		return DirectoryEntry{}, false
+	}
+	for _, entry := range dir.Entries {
+		if entry.Path == entryPath {
+			return entry, true
+		}
+	}
+	respondError(c, http.StatusNotFound, CodeNotFound, "File not found in the directory")
+	return DirectoryEntry{}, false
+}
+
+// entryFile describes a file of a directory as a file of its own, named by
+// the last element of its path
+func entryFile(dir *FileMetadata, entry DirectoryEntry) *FileMetadata {
+	return &FileMetadata{
+		ID:          dir.ID,
+		Name:        path.Base(entry.Path),
+		Folder:      dir.Folder,
+		Size:        entry.Size,
+		ContentType: entry.ContentType,
+		CID:         entry.CID,
+		UploadedAt:  dir.UploadedAt,
+		UploadedBy:  dir.UploadedBy,
+		Available:   dir.Available,
+	}
+}
+
+// listedEntry is a file of a shared directory with where to download it
+type listedEntry struct {
+	DirectoryEntry
+	GatewayURL  string `json:"gatewayUrl,omitempty"`
+	DownloadURL string `json:"downloadUrl"`
+}
+
+// ListSharedDirectory lists the files of a shared directory from the entries
+// recorded at upload, each with a download URL through this server and,
+// unless gateway URLs are hidden, on the gateway under the directory CID.
+// Like GetSharedFile it counts as an access of the link.
+func (h *Handler) ListSharedDirectory(c *gin.Context) {
+	token := c.Param("token")
+
+	shareLink, ok := h.lookupShareLink(c, token)
+	if !ok {
+		return
+	}
+
+	file, exists := h.fileRepo.GetFile(shareLink.FileID)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File no longer exists")
+		return
+	}
+	if !file.IsDirectory {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Only shared directories can be listed")
+		return
+	}
+
+	updated, ok := h.recordAccess(c, shareLink)
+	if !ok {
+		return
+	}
+
+	gateway := h.clientGateway(c)
+	entries := make([]listedEntry, len(file.Entries))
+	for i, entry := range file.Entries {
+		entries[i] = listedEntry{
+			DirectoryEntry: entry,
+			DownloadURL:    h.shareURL(c, token) + "/download?path=" + url.QueryEscape(entry.Path),
+		}
+		if h.config.HideGatewayURL {
+			entries[i].CID = ""
+		} else {
+			entries[i].GatewayURL = h.storage.GetGatewayURL(directoryContentPath(shareLink.CID, entry.Path), gateway)
+		}
+	}
+
+	body := gin.H{
+		"name":              file.Name,
+		"size":              file.Size,
+		"entries":           entries,
+		"expiresAt":         updated.ExpiresAt,
+		"accessCount":       updated.AccessCount,
+		"accessesRemaining": updated.AccessesRemaining(),
+	}
+	if !h.config.HideGatewayURL {
+		body["cid"] = shareLink.CID
+	}
+	c.JSON(http.StatusOK, body)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDirectoryPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []string
+		paths   []string
+		root    string
+		wantErr bool
+	}{
+		{name: "flat", raw: []string{"a.txt", "b.txt"}, paths: []string{"a.txt", "b.txt"}},
+		{name: "shared root", raw: []string{"site/index.html", "site/css/main.css"}, paths: []string{"index.html", "css/main.css"}, root: "site"},
+		{name: "mixed roots", raw: []string{"a/x", "b/y"}, paths: []string{"a/x", "b/y"}},
+		{name: "backslashes", raw: []string{`docs\a.txt`, `docs\b\c.txt`}, paths: []string{"a.txt", "b/c.txt"}, root: "docs"},
+		{name: "cleaned", raw: []string{"./a//b.txt", "c.txt"}, paths: []string{"a/b.txt", "c.txt"}},
+		{name: "parent", raw: []string{"a/../../b"}, wantErr: true},
+		{name: "absolute", raw: []string{"/etc/passwd"}, wantErr: true},
+		{name: "drive letter", raw: []string{`C:\x.txt`}, wantErr: true},
+		{name: "empty", raw: []string{" "}, wantErr: true},
+		{name: "dot", raw: []string{"."}, wantErr: true},
+		{name: "control character", raw: []string{"a\x00b"}, wantErr: true},
+		{name: "duplicate", raw: []string{"a.txt", "./a.txt"}, wantErr: true},
+		{name: "file and directory", raw: []string{"a", "a/b/c"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, root, err := directoryPaths(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("directoryPaths(%q) = %q, want error", tt.raw, paths)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("directoryPaths(%q): %v", tt.raw, err)
+			}
+			if !slices.Equal(paths, tt.paths) || root != tt.root {
+				t.Errorf("directoryPaths(%q) = %q, %q; want %q, %q", tt.raw, paths, root, tt.paths, tt.root)
+			}
+		})
+	}
+}
+
+func TestUploadDirectory(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload/directory", nil,
+		multipartFile{Field: "files", Name: "index.html", Content: []byte("<h1>hi</h1>")},
+		multipartFile{Field: "files", Name: "notes.txt", Content: []byte("notes")}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var resp struct {
+		File *FileMetadata `json:"file"`
+	}
+	decodeJSON(t, w, &resp)
+	dir := resp.File
+	if !dir.IsDirectory || dir.ContentType != directoryContentType || dir.Size != 16 {
+		t.Errorf("directory = %+v", dir)
+	}
+	if len(dir.Entries) != 2 || dir.Entries[0].Path != "index.html" || dir.Entries[1].Path != "notes.txt" {
+		t.Fatalf("entries = %+v", dir.Entries)
+	}
+	if want := computeUnixFSCID([]byte("notes")); dir.Entries[1].CID != want {
+		t.Errorf("entry CID = %s, want %s", dir.Entries[1].CID, want)
+	}
+	if s.storage.uploads != 1 {
+		t.Errorf("%d uploads, want the directory uploaded once", s.storage.uploads)
+	}
+
+	// The directory has no content of its own to download
+	w = s.do(httptest.NewRequest(http.MethodPost, "/api/files/"+dir.ID+"/share", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("creating share link: status %d, body %s", w.Code, w.Body)
+	}
+	var created ShareLinkResponse
+	decodeJSON(t, w, &created)
+	w = s.do(httptest.NewRequest(http.MethodGet, "/api/share/"+created.ShareLink.Token+"/download", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("downloading the directory: status %d, body %s", w.Code, w.Body)
+	}
+}
+
+func TestUploadDirectoryRejections(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		fields    map[string]string
+		files     []multipartFile
+		status    int
+	}{
+		{
+			name:   "no files",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:      "too many files",
+			configure: func(cfg *Config) { cfg.MaxDirectoryFiles = 1 },
+			files: []multipartFile{
+				{Field: "files", Name: "a.txt", Content: []byte("a")},
+				{Field: "files", Name: "b.txt", Content: []byte("b")},
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "paths don't match files",
+			fields: map[string]string{"paths": "a.txt"},
+			files: []multipartFile{
+				{Field: "files", Name: "a.txt", Content: []byte("a")},
+				{Field: "files", Name: "b.txt", Content: []byte("b")},
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "escaping path",
+			fields: map[string]string{"paths": "../a.txt"},
+			files:  []multipartFile{{Field: "files", Name: "a.txt", Content: []byte("a")}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:      "file too large",
+			configure: func(cfg *Config) { cfg.MaxFileSize = 4 },
+			files:     []multipartFile{{Field: "files", Name: "big.txt", Content: []byte("12345")}},
+			status:    http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.configure)
+			w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload/directory", tt.fields, tt.files...))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.status, w.Body)
+			}
+			if s.storage.uploads != 0 {
+				t.Errorf("%d directories were uploaded", s.storage.uploads)
+			}
+		})
+	}
+}
+
+func TestSharedDirectory(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload/directory",
+		map[string]string{"paths": "docs/sub dir/b.txt"},
+		multipartFile{Field: "files", Name: "b.txt", Content: []byte("bee")}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("uploading: status %d, body %s", w.Code, w.Body)
+	}
+	var uploaded struct {
+		File *FileMetadata `json:"file"`
+	}
+	decodeJSON(t, w, &uploaded)
+
+	w = s.do(httptest.NewRequest(http.MethodPost, "/api/files/"+uploaded.File.ID+"/share", nil))
+	var created ShareLinkResponse
+	decodeJSON(t, w, &created)
+	share := "/api/share/" + created.ShareLink.Token
+
+	w = s.do(httptest.NewRequest(http.MethodGet, share+"/ls", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing: status %d, body %s", w.Code, w.Body)
+	}
+	var listing struct {
+		Name    string        `json:"name"`
+		Entries []listedEntry `json:"entries"`
+	}
+	decodeJSON(t, w, &listing)
+	if listing.Name != "docs" || len(listing.Entries) != 1 || listing.Entries[0].Path != "sub dir/b.txt" {
+		t.Fatalf("listing = %+v", listing)
+	}
+	if got := listing.Entries[0].DownloadURL; !strings.HasSuffix(got, "/download?path=sub+dir%2Fb.txt") {
+		t.Errorf("download URL = %s", got)
+	}
+
+	w = s.do(httptest.NewRequest(http.MethodGet, share+"/download?path=sub+dir/b.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "bee" {
+		t.Fatalf("downloading: status %d, body %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Disposition"); !strings.Contains(got, "filename=b.txt") {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	for target, status := range map[string]int{
+		"?path=../../etc/passwd":    http.StatusBadRequest,
+		"?path=sub+dir/../../b.txt": http.StatusBadRequest,
+		"?path=missing.txt":         http.StatusNotFound,
+	} {
+		if w := s.do(httptest.NewRequest(http.MethodGet, share+"/download"+target, nil)); w.Code != status {
+			t.Errorf("download%s: status %d, want %d", target, w.Code, status)
+		}
+	}
+}
+
+func TestListSharedFileNotDirectory(t *testing.T) {
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+
+	w := s.do(httptest.NewRequest(http.MethodPost, "/api/files/"+file.ID+"/share", nil))
+	var created ShareLinkResponse
+	decodeJSON(t, w, &created)
+	share := "/api/share/" + created.ShareLink.Token
+
+	if w := s.do(httptest.NewRequest(http.MethodGet, share+"/ls", nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("listing: status %d, body %s", w.Code, w.Body)
+	}
+	if w := s.do(httptest.NewRequest(http.MethodGet, share+"/download?path=notes.txt", nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("downloading with a path: status %d, body %s", w.Code, w.Body)
+	}
+}
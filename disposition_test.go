@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestDownloadFilename(t *testing.T) {
+	tests := []struct {
+		name  string
+		ascii string
+		utf8  string
+	}{
+		{"report.pdf", "report.pdf", "report.pdf"},
+		{"café.txt", "cafe.txt", "café.txt"},
+		{"Straße.pdf", "Strasse.pdf", "Straße.pdf"},
+		{"日本語.pdf", "download.pdf", "日本語.pdf"},
+		{"日本語", "download", "日本語"},
+		{"résumé 日本.doc", "resume _.doc", "résumé 日本.doc"},
+		{"a\x00b\nc.txt", "a_b_c.txt", "a_b_c.txt"},
+		{"bad\xffname.txt", "bad_name.txt", "bad_name.txt"},
+	}
+	for _, tt := range tests {
+		ascii, utf8 := downloadFilename(tt.name)
+		if ascii != tt.ascii || utf8 != tt.utf8 {
+			t.Errorf("downloadFilename(%q) = %q, %q; want %q, %q", tt.name, ascii, utf8, tt.ascii, tt.utf8)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		requested     string
+		contentType   string
+		filename      string
+		transliterate bool
+		want          string
+	}{
+		{DispositionAttachment, "application/pdf", "report.pdf", true, "attachment; filename=report.pdf"},
+		{DispositionAttachment, "text/plain", "café.txt", true, "attachment; filename=cafe.txt; filename*=UTF-8''caf%C3%A9.txt"},
+		{DispositionAttachment, "text/plain", "café.txt", false, "attachment; filename*=utf-8''caf%C3%A9.txt"},
+		{DispositionAttachment, "application/pdf", "Straße.pdf", true, "attachment; filename=Strasse.pdf; filename*=UTF-8''Stra%C3%9Fe.pdf"},
+		{DispositionAttachment, "application/pdf", "日本語.pdf", true, "attachment; filename=download.pdf; filename*=UTF-8''%E6%97%A5%E6%9C%AC%E8%AA%9E.pdf"},
+		{DispositionAttachment, "text/plain", "a\x00b\nc.txt", true, "attachment; filename=a_b_c.txt"},
+		{DispositionAttachment, "text/plain", `my "file".txt`, true, `attachment; filename="my \"file\".txt"`},
+		{DispositionInline, "image/png", "a.png", false, "inline; filename=a.png"},
+		{DispositionInline, "text/html", "a.html", false, "attachment; filename=a.html"},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition(tt.requested, tt.contentType, tt.filename, tt.transliterate); got != tt.want {
+			t.Errorf("contentDisposition(%s, %s, %q, %t) = %s, want %s",
+				tt.requested, tt.contentType, tt.filename, tt.transliterate, got, tt.want)
+		}
+	}
+}
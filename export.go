@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// catalogExportVersion identifies the layout of exported catalogs
+const catalogExportVersion = 1
+
+// CatalogExport is the JSON layout of an exported catalog
+type CatalogExport struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Files      []*FileMetadata `json:"files"`
+	ShareLinks []*ShareLink    `json:"shareLinks,omitempty"`
+}
+
+// catalogCSVHeader lists the stable CSV export columns
+var catalogCSVHeader = []string{"id", "name", "size", "contentType", "cid", "uploadedAt", "gatewayUrl"}
+
+// ExportCatalog streams all file metadata as a JSON or CSV download.
+// Share links are included in JSON exports when includeShares=true.
+func (h *Handler) ExportCatalog(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	includeShares := c.Query("includeShares") == "true"
+
+	// Exports taken with HideGatewayURL leave CIDs out too, so they can't
+	// restore content on import
+	files := h.presentFiles(h.fileRepo.ListFiles(ListOptions{}))
+	filename := fmt.Sprintf("catalog-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+
+	switch format {
+	case "json":
+		c.Header("Content-Type", "application/json")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		c.Status(http.StatusOK)
+		h.writeJSONExport(c, files, includeShares)
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		c.Status(http.StatusOK)
+		writeCSVExport(c, files)
+	default:
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Unsupported format, expected json or csv")
+	}
+}
+
+// writeJSONExport writes a CatalogExport one record at a time so the whole
+// document never has to be held in memory
+func (h *Handler) writeJSONExport(c *gin.Context, files []*FileMetadata, includeShares bool) {
+	w := c.Writer
+	exportedAt, _ := json.Marshal(time.Now().UTC())
+	fmt.Fprintf(w, `{"version":%d,"exportedAt":%s,"files":[`, catalogExportVersion, exportedAt)
+	for i, f := range files {
+		writeJSONElement(c, i, f)
+	}
+	w.WriteString("]")
+
+	if includeShares {
+		w.WriteString(`,"shareLinks":[`)
+		for i, link := range h.fileRepo.ListShareLinks() {
+			writeJSONElement(c, i, h.presentShareLink(link))
+		}
+		w.WriteString("]")
+	}
+	w.WriteString("}\n")
+}
+
+// writeJSONElement writes one array element, preceded by a comma if needed
+func writeJSONElement(c *gin.Context, index int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		// Headers are already sent; all we can do is log and skip the record
+		c.Error(err)
+		return
+	}
+	if index > 0 {
+		c.Writer.WriteString(",")
+	}
+	c.Writer.Write(data)
+}
+
+// writeCSVExport writes files using the stable catalogCSVHeader columns
+func writeCSVExport(c *gin.Context, files []*FileMetadata) {
+	w := csv.NewWriter(c.Writer)
+	w.Write(catalogCSVHeader)
+	for _, f := range files {
+		w.Write([]string{
+			f.ID,
+			f.Name,
+			strconv.FormatInt(f.Size, 10),
+			f.ContentType,
+			f.CID,
+			f.UploadedAt.UTC().Format(time.RFC3339),
+			f.GatewayURL,
+		})
+	}
+	w.Flush()
+}
+
+// ImportSummary reports the outcome of a catalog import
+type ImportSummary struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors,omitempty"`
+}
+
+// ImportError describes why a single record could not be imported
+type ImportError struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// ImportCatalog restores a JSON catalog produced by ExportCatalog. Records
+// whose ID already exists are skipped or overwritten depending on
+// ?mode=skip|overwrite (default skip). Share links are imported when present
+// and their file exists.
+func (h *Handler) ImportCatalog(c *gin.Context) {
+	mode := c.DefaultQuery("mode", "skip")
+	if mode != "skip" && mode != "overwrite" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Unsupported mode, expected skip or overwrite")
+		return
+	}
+	overwrite := mode == "overwrite"
+
+	var catalog CatalogExport
+	if err := c.ShouldBindJSON(&catalog); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid catalog: "+err.Error())
+		return
+	}
+
+	files := ImportSummary{}
+	for _, f := range catalog.Files {
+		if err := validateImportedFile(f); err != nil {
+			files.fail(recordID(f), err)
+			continue
+		}
+		if overwrite {
+			h.fileRepo.PutFile(f)
+		} else if err := h.fileRepo.SaveFile(f); errors.Is(err, ErrDuplicateKey) {
+			files.Skipped++
+			continue
+		} else if err != nil {
+			files.fail(f.ID, err)
+			continue
+		}
+		files.Imported++
+	}
+
+	links := ImportSummary{}
+	for _, link := range catalog.ShareLinks {
+		if err := h.validateImportedShareLink(link); err != nil {
+			id := ""
+			if link != nil {
+				id = link.Token
+			}
+			links.fail(id, err)
+			continue
+		}
+		if overwrite {
+			h.fileRepo.PutShareLink(link)
+		} else if err := h.fileRepo.SaveShareLink(link); errors.Is(err, ErrDuplicateKey) {
+			links.Skipped++
+			continue
+		} else if err != nil {
+			links.fail(link.Token, err)
+			continue
+		}
+		links.Imported++
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"mode":       mode,
+		"files":      files,
+		"shareLinks": links,
+	})
+}
+
+func (s *ImportSummary) fail(id string, err error) {
+	s.Failed++
+	s.Errors = append(s.Errors, ImportError{ID: id, Error: err.Error()})
+}
+
+func recordID(f *FileMetadata) string {
+	if f == nil {
+		return ""
+	}
+	return f.ID
+}
+
+// validateImportedFile checks that a file record is complete enough to serve
+func validateImportedFile(f *FileMetadata) error {
+	switch {
+	case f == nil:
+		return fmt.Errorf("empty record")
+	case f.ID == "":
+		return fmt.Errorf("missing id")
+	case f.Name == "":
+		return fmt.Errorf("missing name")
+	case !isValidCID(f.CID):
+		return fmt.Errorf("invalid CID %q", f.CID)
+	case f.Size < 0:
+		return fmt.Errorf("invalid size %d", f.Size)
+	}
+	return nil
+}
+
+// validateImportedShareLink checks a share link record and that its file exists
+func (h *Handler) validateImportedShareLink(link *ShareLink) error {
+	switch {
+	case link == nil:
+		return fmt.Errorf("empty record")
+	case link.Token == "":
+		return fmt.Errorf("missing token")
+	case link.ExpiresAt.IsZero():
+		return fmt.Errorf("missing expiresAt")
+	}
+	if _, exists := h.fileRepo.GetFile(link.FileID); !exists {
+		return fmt.Errorf("file %q does not exist", link.FileID)
+	}
+	return nil
+}
@@ -1,36 +1,124 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/errgroup"
 )
 
 // Handler contains HTTP handlers for the API
 type Handler struct {
-	storage  *StorageService
+	storage  Storage
 	fileRepo *FileRepository
 	config   *Config
+	scanner  VirusScanner // nil when virus scanning is disabled
+	fetcher  *RemoteFetcher
+
+	// accessCounter counts uses of stateless share links
+	accessCounter AccessCounter
+
+	trustedProxies []*net.IPNet
+
+	abuseGuard *AbuseGuard       // nil unless AutoRevokeOnAbuse is enabled
+	passwords  *PasswordThrottle // Wrong share passwords and key derivations
+	webhooks   *WebhookNotifier  // nil when no webhook is configured
+	accesses   *AccessNotifier   // nil unless access events are enabled
+	jobs       *JobStore         // Background uploads
+	posters    *derivedCache
+	conversion *derivedCache // Converted images by CID and format
+
+	// Image formats downloads can be converted to, and ffmpeg for WebP
+	// ("" when it wasn't found)
+	conversionFormats map[string]string
+	ffmpeg            string
+
+	// shareRoutes are the fixed sub-routes of /share/:token, registered by
+	// shareRoute, which a filename in a download URL must not shadow
+	shareRoutes map[string]bool
+
+	clock Clock
 }
 
 // NewHandler creates a new handler
-func NewHandler(storage *StorageService, fileRepo *FileRepository, config *Config) *Handler {
-	return &Handler{
+func NewHandler(storage Storage, fileRepo *FileRepository, config *Config) *Handler {
+	h := &Handler{
 		storage:  storage,
 		fileRepo: fileRepo,
 		config:   config,
+		fetcher:  NewRemoteFetcher(config),
+
+		accessCounter:  NewMemoryAccessCounter(),
+		trustedProxies: parseNetworks(config.TrustedProxies),
+		abuseGuard:     NewAbuseGuard(config),
+		webhooks:       NewWebhookNotifier(config),
+		shareRoutes:    make(map[string]bool),
+
+		clock: realClock{},
 	}
+	h.jobs = NewJobStore(h.clock)
+	h.passwords = NewPasswordThrottle(config, h.clock)
+	h.accesses = NewAccessNotifier(config, h.webhooks)
+	h.posters = newDerivedCache(maxCachedPosters)
+	h.conversion = newDerivedCache(maxCachedConversions)
+	h.conversionFormats, h.ffmpeg = availableConversionFormats(config)
+	if config.ClamAVAddress != "" {
+		h.scanner = NewClamdScanner(config.ClamAVAddress)
+	}
+	return h
+}
+
+// SetClock replaces the clock of the handler, its storage service and its
+// repository, letting tests move time forward
+func (h *Handler) SetClock(clock Clock) {
+	h.clock = clock
+	h.jobs.mu.Lock()
+	h.jobs.clock = clock
+	h.jobs.mu.Unlock()
+	switch storage := h.storage.(type) {
+	case *StorageService:
+		storage.clock = clock
+	case *LocalStorage:
+		storage.clock = clock
+	}
+	h.fileRepo.mu.Lock()
+	h.fileRepo.clock = clock
+	h.fileRepo.mu.Unlock()
+	h.passwords.mu.Lock()
+	h.passwords.clock = clock
+	h.passwords.mu.Unlock()
 }
 
 // Upload handles file uploads
 func (h *Handler) Upload(c *gin.Context) {
 	// Parse multipart form
 	form, err := c.MultipartForm()
+	if isBodyTooLarge(err) {
+		respondErrorf(c, http.StatusRequestEntityTooLarge, CodeRequestTooLarge,
+			"Request body exceeds maximum size of %d bytes", h.config.MaxRequestBytes)
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse form"})
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Failed to parse form")
 		return
 	}
 
@@ -39,27 +127,46 @@ func (h *Handler) Upload(c *gin.Context) {
 		// Try single file upload
 		file, err := c.FormFile("file")
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "No files provided"})
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "No files provided")
 			return
 		}
 		files = append(files, file)
 	}
+	if len(files) > h.config.MaxFilesPerUpload {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "Too many files: at most %d may be uploaded per request", h.config.MaxFilesPerUpload)
+		return
+	}
 
-	var uploadedFiles []*FileMetadata
+	folder, err := normalizeFolder(c.PostForm("folder"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid folder: "+err.Error())
+		return
+	}
+
+	// Description and metadata apply to every file of the request
+	description := strings.TrimSpace(c.PostForm("description"))
+	metadata, err := parseMetadataField(c.PostForm("metadata"))
+	if err == nil {
+		err = validateAnnotations(description, metadata)
+	}
+	if err != nil {
+		respondAPIError(c, err)
+		return
+	}
+
+	var pending []pendingUpload
 
 	for _, file := range files {
 		// Check file size
-		if file.Size > h.config.MaxFileSize {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": fmt.Sprintf("File %s exceeds maximum size of %d bytes", file.Filename, h.config.MaxFileSize),
-			})
+		if file.Size > h.config.FileSizeLimit() {
+			respondErrorf(c, http.StatusBadRequest, CodeFileTooLarge, "File %s exceeds maximum size of %d bytes", file.Filename, h.config.FileSizeLimit())
 			return
 		}
 
 		// Open file
 		src, err := file.Open()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open uploaded file"})
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to open uploaded file")
 			return
 		}
 		defer src.Close()
@@ -67,279 +174,1816 @@ func (h *Handler) Upload(c *gin.Context) {
 		// Read file content
 		content, err := io.ReadAll(src)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file content"})
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to read file content")
 			return
 		}
 
-		// Detect content type
-		contentType := http.DetectContentType(content)
+		pending = append(pending, pendingUpload{content: content, opts: uploadOptions{
+			Name:        file.Filename,
+			Folder:      folder,
+			Description: description,
+			Metadata:    metadata,
+			Uploader:    requestAPIKey(c),
+		}})
+	}
 
-		// Upload to storage
-		result, err := h.storage.Upload(content, file.Filename, contentType)
+	// Slow uploads can run in the background, followed via /api/jobs/:id
+	if c.Query("async") == "true" {
+		job, err := h.startUploadJob(c.Request.Context(), pending)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to upload: %v", err)})
+			respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to start upload job")
 			return
 		}
+		c.JSON(http.StatusAccepted, gin.H{
+			"job":       job,
+			"statusUrl": "/api/jobs/" + job.ID,
+			"eventsUrl": "/api/jobs/" + job.ID + "/events",
+		})
+		return
+	}
 
-		// Create file metadata
-		metadata := &FileMetadata{
-			ID:          GenerateID(),
-			Name:        file.Filename,
-			Size:        file.Size,
-			ContentType: contentType,
-			CID:         result.CID,
-			UploadedAt:  time.Now(),
-			GatewayURL:  result.GatewayURL,
-		}
-
-		// Save metadata
-		if err := h.fileRepo.SaveFile(metadata); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+	var uploadedFiles []*FileMetadata
+	for _, f := range pending {
+		stored, err := h.storeContent(c.Request.Context(), f.content, f.opts)
+		if err != nil {
+			respondAPIError(c, err)
 			return
 		}
-
-		uploadedFiles = append(uploadedFiles, metadata)
+		uploadedFiles = append(uploadedFiles, stored)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"files":   uploadedFiles,
+		"files":   h.presentFiles(uploadedFiles),
 		"message": fmt.Sprintf("Successfully uploaded %d file(s)", len(uploadedFiles)),
 	})
 }
 
-// ListFiles returns all uploaded files
-func (h *Handler) ListFiles(c *gin.Context) {
-	files := h.fileRepo.ListFiles()
-	c.JSON(http.StatusOK, gin.H{"files": files})
+// uploadOptions carries the user-supplied attributes of an upload
+type uploadOptions struct {
+	Name        string
+	Folder      string // Normalized folder path, "" for the root
+	Description string
+	Metadata    map[string]string
+	Uploader    *APIKey // nil for anonymous uploads
 }
 
-// GetFile returns a specific file's metadata
-func (h *Handler) GetFile(c *gin.Context) {
-	id := c.Param("id")
+// storeContent runs uploaded content through the shared ingest pipeline
+// (size check, naming, type detection, virus scan, upload, metadata) used by
+// every upload path, returning an apiError describing any rejection
+func (h *Handler) storeContent(ctx context.Context, content []byte, opts uploadOptions) (_ *FileMetadata, err error) {
+	ctx, span := startSpan(ctx, "storeContent", attrFileName.String(opts.Name), attrFileSize.Int(len(content)))
+	defer func() { endSpan(span, err) }()
 
-	file, exists := h.fileRepo.GetFile(id)
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-		return
+	name := opts.Name
+	if strings.TrimSpace(name) == "" {
+		name = h.fallbackName(detectContentType(content, ""))
 	}
 
-	// Get share links for this file
-	shareLinks := h.fileRepo.GetShareLinksForFile(id)
+	// Check file size
+	if int64(len(content)) > h.config.FileSizeLimit() {
+		return nil, newAPIError(http.StatusBadRequest, CodeFileTooLarge,
+			"File %s exceeds maximum size of %d bytes", name, h.config.FileSizeLimit())
+	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"file":       file,
-		"shareLinks": shareLinks,
-	})
+	// Apply the folder's name collision policy before doing any real work
+	name, err = h.resolveName(opts.Folder, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Detect content type
+	contentType := detectContentType(content, name)
+	if err := h.checkUploadAllowed(opts.Uploader, name, contentType, int64(len(content))); err != nil {
+		return nil, err
+	}
+
+	// Scan for viruses before anything reaches Storacha
+	if h.scanner != nil {
+		scan, err := h.scanner.Scan(bytes.NewReader(content))
+		if err != nil {
+			log.Printf("Virus scan failed for %s: %v", name, err)
+			return nil, newAPIError(http.StatusServiceUnavailable, CodeScannerUnavailable, "Virus scanner unavailable")
+		}
+		if scan.Infected {
+			apiErr := newAPIError(http.StatusUnprocessableEntity, CodeInfected, "File %s was rejected by the virus scanner", name)
+			apiErr.Details = gin.H{"signature": scan.Signature}
+			return nil, apiErr
+		}
+	}
+
+	// Upload to storage
+	result, err := h.storage.Upload(ctx, content, name, contentType)
+	if errors.Is(err, ErrUploadQueueFull) {
+		return nil, newAPIError(http.StatusServiceUnavailable, CodeBusy, "Server is busy, please retry the upload later")
+	}
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, CodeInternal, "Failed to upload: %v", err)
+	}
+
+	// Create file metadata
+	metadata := &FileMetadata{
+		Name:        name,
+		Folder:      opts.Folder,
+		Size:        int64(len(content)),
+		ContentType: contentType,
+		CID:         result.CID,
+		Hash:        sha256Hex(content),
+		UploadedAt:  h.clock.Now(),
+		GatewayURL:  result.GatewayURL,
+		UploadedBy:  uploaderID(opts.Uploader),
+		Description: opts.Description,
+		Metadata:    opts.Metadata,
+		Available:   !isPlaceholderCID(result.CID),
+	}
+
+	// Save metadata under a fresh ID
+	if err := h.saveNewFile(metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
 }
 
-// DeleteFile removes a file
-func (h *Handler) DeleteFile(c *gin.Context) {
-	id := c.Param("id")
+// checkUploadAllowed applies the size limit of the content type, the content
+// type allowlist, which trusted API keys bypass, and the uploading key's
+// storage quota
+func (h *Handler) checkUploadAllowed(key *APIKey, name, contentType string, size int64) error {
+	if limit := h.config.TypeSizeLimit(contentType); limit > 0 && size > limit {
+		return newAPIError(http.StatusRequestEntityTooLarge, CodeFileTooLarge,
+			"File %s exceeds the maximum size of %d bytes for %s files", name, limit, contentType)
+	}
+	trusted := key != nil && key.Trusted
+	if h.config.EnforceFileTypes && !trusted && !typeAllowed(contentType, h.config.AllowedFileTypes) {
+		return newAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType,
+			"File %s has a content type that is not allowed: %s", name, contentType)
+	}
+	return h.checkQuota(key, name, size)
+}
 
-	if !h.fileRepo.DeleteFile(id) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-		return
+// checkQuota rejects storing size more bytes as name when it would take the
+// uploading key over its storage quota
+func (h *Handler) checkQuota(key *APIKey, name string, size int64) error {
+	if key != nil && key.MaxStorage > 0 {
+		if used := h.fileRepo.StorageUsedBy(key.ID()); used+size > key.MaxStorage {
+			apiErr := newAPIError(http.StatusForbidden, CodeQuotaExceeded,
+				"File %s would exceed the storage quota of this API key", name)
+			apiErr.Details = gin.H{"used": used, "maxStorage": key.MaxStorage}
+			return apiErr
+		}
 	}
+	return nil
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
+// typeAllowed reports whether a content type's media type is in allowed
+func typeAllowed(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(allowed, mediaType)
 }
 
-// CreateShareLink creates a shareable link for a file with expiration
-func (h *Handler) CreateShareLink(c *gin.Context) {
-	fileID := c.Param("id")
+// uploaderID returns the ID recorded for uploads made with key
+func uploaderID(key *APIKey) string {
+	if key == nil {
+		return ""
+	}
+	return key.ID()
+}
 
-	file, exists := h.fileRepo.GetFile(fileID)
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-		return
+// saveNewFile assigns file a newly generated ID and stores it, retrying with
+// another ID in the unlikely event of a collision. Failures are returned as
+// an apiError.
+func (h *Handler) saveNewFile(file *FileMetadata) error {
+	err := retryOnDuplicate(func() error {
+		id, err := GenerateID()
+		if err != nil {
+			return err
+		}
+		file.ID = id
+		return h.fileRepo.SaveFile(file)
+	})
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrContentRemoving):
+		return newAPIError(http.StatusConflict, CodeContentRemoving,
+			"The same content is being removed from storage after a delete; try again shortly")
+	default:
+		return newAPIError(http.StatusInternalServerError, CodeInternal, "Failed to save file metadata")
 	}
+}
 
-	var req ShareLinkRequest
+// UploadFromURL fetches a file from a remote URL server-side and stores it
+// exactly like a regular upload
+func (h *Handler) UploadFromURL(c *gin.Context) {
+	var req UploadFromURLRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		// Use defaults if no body provided
-		req.ExpiresIn = "24h"
-		req.MaxAccesses = 0
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request: "+err.Error())
+		return
 	}
 
-	// Parse expiration duration
-	duration, err := ParseDuration(req.ExpiresIn)
+	remote, err := h.fetcher.Fetch(c.Request.Context(), req.URL, h.config.FileSizeLimit())
 	if err != nil {
-		duration = h.config.DefaultExpiration
+		respondAPIError(c, err)
+		return
 	}
 
-	// Generate share link
-	token := GenerateToken()
-	now := time.Now()
+	name := sanitizeDisplayName(req.Name)
+	if name == "" {
+		name = remote.Name
+	}
 
-	shareLink := &ShareLink{
-		Token:        token,
-		FileID:       fileID,
-		CID:          file.CID,
-		CreatedAt:    now,
-		ExpiresAt:    now.Add(duration),
-		IsRevoked:    false,
-		DelegationID: GenerateID(), // In production, this would be the actual UCAN delegation ID
-		MaxAccesses:  req.MaxAccesses,
+	folder, err := normalizeFolder(req.Folder)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid folder: "+err.Error())
+		return
 	}
 
-	if err := h.fileRepo.SaveShareLink(shareLink); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+	description := strings.TrimSpace(req.Description)
+	if err := validateAnnotations(description, req.Metadata); err != nil {
+		respondAPIError(c, err)
 		return
 	}
 
-	// Build shareable URL
-	scheme := "http"
-	if c.Request.TLS != nil {
-		scheme = "https"
+	metadata, err := h.storeContent(c.Request.Context(), remote.Content, uploadOptions{
+		Name:        name,
+		Folder:      folder,
+		Description: description,
+		Metadata:    req.Metadata,
+		Uploader:    requestAPIKey(c),
+	})
+	if err != nil {
+		respondAPIError(c, err)
+		return
 	}
-	shareURL := fmt.Sprintf("%s://%s/api/share/%s", scheme, c.Request.Host, token)
 
-	c.JSON(http.StatusOK, ShareLinkResponse{
-		ShareLink: shareLink,
-		URL:       shareURL,
+	c.JSON(http.StatusOK, gin.H{
+		"files":   []*FileMetadata{h.presentFile(metadata)},
+		"message": "Successfully uploaded 1 file(s)",
 	})
 }
 
-// GetSharedFile serves a file via its share token
-func (h *Handler) GetSharedFile(c *gin.Context) {
-	token := c.Param("token")
-
-	shareLink, exists := h.fileRepo.GetShareLink(token)
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+// ListFiles returns all uploaded files. Responses carry a weak ETag of the
+// repository version, so clients revalidating with If-None-Match get a 304
+// until files or share links change.
+func (h *Handler) ListFiles(c *gin.Context) {
+	var opts ListOptions
+	var err error
+	if opts.From, err = parseDateParam(c.Query("from")); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid from date: "+err.Error())
 		return
 	}
+	if opts.To, err = parseDateParam(c.Query("to")); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid to date: "+err.Error())
+		return
+	}
+	opts.Query = strings.TrimSpace(c.Query("q"))
 
-	// Verify access is still valid
-	if !h.storage.VerifyAccess(shareLink) {
-		reason := "Access denied"
-		if shareLink.IsRevoked {
-			reason = "This share link has been revoked"
-		} else if time.Now().After(shareLink.ExpiresAt) {
-			reason = "This share link has expired"
-		} else if shareLink.MaxAccesses > 0 && shareLink.AccessCount >= shareLink.MaxAccesses {
-			reason = "This share link has reached its maximum access count"
+	// Pages are only used when asked for; otherwise every file is listed
+	limit := 0
+	if value, paged := c.GetQuery("limit"); paged || c.Query("cursor") != "" {
+		limit = defaultFilesPage
+		if paged {
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxFilesPage {
+				respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "limit must be between 1 and %d", maxFilesPage)
+				return
+			}
+		}
+		// One more than the page tells whether there is a next page
+		opts.Limit = limit + 1
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		if opts.After, err = decodeFileCursor(cursor); err != nil {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid cursor")
+			return
 		}
-		c.JSON(http.StatusForbidden, gin.H{"error": reason})
+	}
+
+	fields, err := parseFields(c.Query("fields"), FileMetadata{})
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid fields: "+err.Error())
 		return
 	}
 
-	// Get file metadata
-	file, exists := h.fileRepo.GetFile(shareLink.FileID)
+	// The version is read before listing, so a change made in between gives
+	// the next request a new ETag rather than a 304 for stale files
+	etag := fmt.Sprintf(`W/"%x"`, h.fileRepo.Version())
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", h.filesCacheControl())
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	files := h.fileRepo.ListFiles(opts)
+	body := gin.H{}
+	if limit > 0 && len(files) > limit {
+		files = files[:limit]
+		body["nextCursor"] = encodeFileCursor(files[limit-1])
+	}
+	files = h.presentFiles(files)
+	if fields == nil {
+		body["files"] = files
+		c.JSON(http.StatusOK, body)
+		return
+	}
+
+	projected, err := projectFields(files, fields)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to encode files")
+		return
+	}
+	body["files"] = projected
+	c.JSON(http.StatusOK, body)
+}
+
+// filesCacheControl returns the Cache-Control header of files listings
+func (h *Handler) filesCacheControl() string {
+	if h.config.FilesCacheMaxAge <= 0 {
+		return "private, no-cache"
+	}
+	return fmt.Sprintf("private, max-age=%d", int(h.config.FilesCacheMaxAge.Seconds()))
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison If-None-Match calls for
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Page sizes of ListFiles when paging with ?limit= or ?cursor=
+const (
+	defaultFilesPage = 50
+	maxFilesPage     = 1000
+)
+
+// encodeFileCursor returns the opaque cursor of the page after f
+func encodeFileCursor(f *FileMetadata) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(f.UploadedAt.UnixNano(), 10) + ":" + f.ID))
+}
+
+// decodeFileCursor parses a cursor made by encodeFileCursor
+func decodeFileCursor(cursor string) (*FileCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok || id == "" {
+		return nil, errors.New("malformed cursor")
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &FileCursor{UploadedAt: time.Unix(0, n), ID: id}, nil
+}
+
+// parseDateParam parses an RFC3339 timestamp or a YYYY-MM-DD date (midnight
+// UTC). An empty value yields the zero time.
+func parseDateParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC3339 nor YYYY-MM-DD", value)
+	}
+	return t, nil
+}
+
+// Stats reports repository sizes and upload and fetch load for monitoring
+func (h *Handler) Stats(c *gin.Context) {
+	files, shareLinks := h.fileRepo.Counts()
+	available, unavailable := h.fileRepo.AvailabilityCounts()
+	c.JSON(http.StatusOK, gin.H{
+		"files":              files,
+		"shareLinks":         shareLinks,
+		"pendingRevocations": len(h.fileRepo.PendingRevocations()),
+		"uploads":            h.storage.UploadStats(),
+		"fetches":            h.storage.FetchStats(),
+		"localStore":         h.storage.LocalStoreUsage(),
+		"availability": gin.H{
+			"available":   available,
+			"unavailable": unavailable,
+		},
+	})
+}
+
+// GetFile returns a specific file's metadata
+func (h *Handler) GetFile(c *gin.Context) {
+	id := c.Param("id")
+
+	file, exists := h.fileRepo.GetFile(id)
 	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File no longer exists"})
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
 		return
 	}
 
-	// Increment access count
-	h.fileRepo.IncrementAccessCount(token)
+	// The most recent active links; GET /files/:id/shares lists them all
+	shareLinks, activeLinks := h.fileRepo.GetShareLinksForFile(id, ShareLinkListOptions{
+		Filter: h.linkActive,
+		Limit:  h.config.FileShareLinksLimit,
+	})
 
-	// Return file info with gateway URL
 	c.JSON(http.StatusOK, gin.H{
-		"file":       file,
-		"gatewayUrl": h.storage.GetGatewayURL(shareLink.CID),
-		"expiresAt":  shareLink.ExpiresAt,
+		"file":             h.presentFile(file),
+		"shareLinks":       h.presentShareLinks(shareLinks),
+		"activeShareLinks": activeLinks,
+		"cidRefCount":      h.fileRepo.refCountForCID(file.CID), // Files sharing this content
 	})
 }
 
-// RevokeShareLink revokes a share link (UCAN revocation)
-func (h *Handler) RevokeShareLink(c *gin.Context) {
-	token := c.Param("token")
+// UpdateFile changes mutable metadata of a file without touching its content
+func (h *Handler) UpdateFile(c *gin.Context) {
+	id := c.Param("id")
 
-	shareLink, exists := h.fileRepo.GetShareLink(token)
+	var req UpdateFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request: "+err.Error())
+		return
+	}
+
+	current, exists := h.fileRepo.GetFile(id)
 	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
 		return
 	}
 
-	// Revoke the UCAN delegation
-	if err := h.storage.RevokeAccess(shareLink.DelegationID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke access"})
+	name, folder := current.Name, current.Folder
+	if req.Name != nil {
+		name = sanitizeDisplayName(*req.Name)
+		if name == "" {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "Name cannot be empty")
+			return
+		}
+	}
+	if req.Folder != nil {
+		var err error
+		if folder, err = normalizeFolder(*req.Folder); err != nil {
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid folder: "+err.Error())
+			return
+		}
+	}
+
+	description, metadata := current.Description, current.Metadata
+	if req.Description != nil {
+		description = strings.TrimSpace(*req.Description)
+	}
+	if req.Metadata != nil {
+		metadata = *req.Metadata
+	}
+	if err := validateAnnotations(description, metadata); err != nil {
+		respondAPIError(c, err)
 		return
 	}
 
-	// Mark as revoked in our records
-	h.fileRepo.RevokeShareLink(token)
+	// Moving or renaming is subject to the same collision policy as uploads.
+	// With UniqueFilenames a move keeps the file's own name, which is
+	// already unique.
+	moved := folder != current.Folder && !h.config.UniqueFilenames
+	if name != current.Name || moved {
+		var err error
+		if name, err = h.resolveName(folder, name); err != nil {
+			respondAPIError(c, err)
+			return
+		}
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Share link revoked successfully"})
+	// CID and content stay the same, so existing share links keep working
+	updated := h.fileRepo.UpdateFile(id, func(file *FileMetadata) {
+		file.Name = name
+		file.Folder = folder
+		file.Description = description
+		file.Metadata = metadata
+	})
+	if !updated {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+
+	file, _ := h.fileRepo.GetFile(id)
+	c.JSON(http.StatusOK, gin.H{"file": h.presentFile(file)})
 }
 
-// CreateDelegation creates a UCAN delegation for client-side uploads
-func (h *Handler) CreateDelegation(c *gin.Context) {
-	clientDID := c.Param("did")
+// DeleteFile removes a file
+func (h *Handler) DeleteFile(c *gin.Context) {
+	id := c.Param("id")
 
-	if clientDID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Client DID required"})
+	if !h.config.DeleteFromStorage {
+		if !h.fileRepo.DeleteFile(id) {
+			respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
 		return
 	}
 
-	// Validate DID format (should start with did:key:)
-	if len(clientDID) < 8 || clientDID[:8] != "did:key:" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid DID format. Expected did:key:..."})
+	// Deleting the file and learning whether it held the last reference to
+	// its content happen under one lock, so two deletes of files sharing
+	// content can't both decide the other one will remove it
+	file, last, exists := h.fileRepo.DeleteFileReleasingContent(id)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
 		return
 	}
 
-	// Create delegation with 24-hour expiration
-	delegation, err := h.storage.CreateDelegation(clientDID, 24*time.Hour)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create delegation"})
+	// Content shared with other files has to stay
+	if !last {
+		c.JSON(http.StatusOK, gin.H{
+			"message":        "File deleted successfully; its content is still used by other files",
+			"storageRemoved": false,
+		})
 		return
 	}
 
-	c.Data(http.StatusOK, "application/octet-stream", delegation)
-}
+	// Uploads of the same content are refused until the removal is over
+	defer h.fileRepo.ContentRemoved(file.CID)
 
-// RegisterFileRequest is the request body for registering a file uploaded from frontend
-type RegisterFileRequest struct {
-	Name        string `json:"name" binding:"required"`
-	Size        int64  `json:"size" binding:"required"`
-	ContentType string `json:"contentType"`
-	CID         string `json:"cid" binding:"required"`
+	// The metadata is already gone, so a storage failure is reported as a
+	// partial success rather than an error the client might retry
+	if err := h.storage.Remove(file.CID); err != nil {
+		log.Printf("Failed to remove %s from storage after deleting file %s: %v", file.CID, id, err)
+		c.JSON(http.StatusOK, gin.H{
+			"message":        "File deleted, but removing its content from storage failed",
+			"code":           CodeStorageRemovalFailed,
+			"storageRemoved": false,
+			"storageError":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "File and its stored content deleted successfully",
+		"storageRemoved": true,
+	})
 }
 
-// RegisterFile registers a file that was uploaded directly from frontend to Storacha
-func (h *Handler) RegisterFile(c *gin.Context) {
-	var req RegisterFileRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+// RepinFile verifies that a file's content is still served by the gateway
+// and records the result. Content that has disappeared has to be uploaded
+// again since we keep no copy of it.
+func (h *Handler) RepinFile(c *gin.Context) {
+	id := c.Param("id")
+
+	file, exists := h.fileRepo.GetFile(id)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
 		return
 	}
 
-	// Validate CID format
-	if !isValidCID(req.CID) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CID format"})
+	available, err := h.storage.CheckAvailability(c.Request.Context(), file.CID)
+	if err != nil {
+		respondErrorf(c, http.StatusBadGateway, CodeGatewayError, "Failed to check content availability: %v", err)
 		return
 	}
 
-	// Create file metadata
-	metadata := &FileMetadata{
-		ID:          GenerateID(),
-		Name:        req.Name,
-		Size:        req.Size,
-		ContentType: req.ContentType,
-		CID:         req.CID,
-		UploadedAt:  time.Now(),
-		GatewayURL:  h.storage.GetGatewayURL(req.CID),
-	}
+	now := h.clock.Now()
+	h.fileRepo.UpdateFile(id, func(f *FileMetadata) {
+		f.Available = available
+		f.LastVerifiedAt = &now
+	})
+	file, _ = h.fileRepo.GetFile(id)
 
-	// Save metadata
-	if err := h.fileRepo.SaveFile(metadata); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+	if !available {
+		h.reuploadLocalCopy(c, file)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"file":    metadata,
-		"message": "File registered successfully",
+		"file":    h.presentFile(file),
+		"message": "Content is available",
 	})
 }
 
-// isValidCID checks if a string looks like a valid CID
-func isValidCID(cid string) bool {
-	// Basic validation - CIDs typically start with "bafy" or "bafk" for CIDv1
-	// or "Qm" for CIDv0
-	if len(cid) < 10 {
-		return false
+// reuploadLocalCopy uploads the retained copy of unavailable content again,
+// pointing the file at the new CID if it differs (wrapped uploads get a
+// new directory CID)
+func (h *Handler) reuploadLocalCopy(c *gin.Context, file *FileMetadata) {
+	// Only the files of a directory are kept, not the directory itself
+	var content []byte
+	err := errNoLocalCopy
+	if !file.IsDirectory {
+		content, err = h.storage.LocalCopy(file.CID)
+	}
+	if errors.Is(err, errNoLocalCopy) {
+		respondErrorDetails(c, http.StatusGone, CodeContentUnavailable,
+			"Content no longer available, re-upload required", gin.H{"file": h.presentFile(file)})
+		return
 	}
-	return len(cid) > 0 && (cid[:4] == "bafy" || cid[:4] == "bafk" || cid[:2] == "Qm")
+	if err != nil {
+		respondErrorf(c, http.StatusInternalServerError, CodeInternal, "Failed to read local copy: %v", err)
+		return
+	}
+
+	result, err := h.storage.Upload(c.Request.Context(), content, file.Name, file.ContentType)
+	if errors.Is(err, ErrUploadQueueFull) {
+		respondError(c, http.StatusServiceUnavailable, CodeBusy, "Server is busy, please retry later")
+		return
+	}
+	if err != nil {
+		respondErrorf(c, http.StatusInternalServerError, CodeInternal, "Failed to re-upload local copy: %v", err)
+		return
+	}
+
+	h.fileRepo.UpdateFile(file.ID, func(f *FileMetadata) {
+		f.CID = result.CID
+		f.GatewayURL = result.GatewayURL
+		f.Available = true
+	})
+	file, _ = h.fileRepo.GetFile(file.ID)
+	log.Printf("Re-uploaded file %s from its local copy as %s", file.ID, result.CID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"file":    h.presentFile(file),
+		"message": "Content was re-uploaded from the local copy",
+	})
+}
+
+// CreateShareLink creates a shareable link for a file with expiration
+func (h *Handler) CreateShareLink(c *gin.Context) {
+	fileID := c.Param("id")
+
+	file, exists := h.fileRepo.GetFile(fileID)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+
+	// An empty body takes the defaults. Anything else must decode, or the
+	// link would silently be created without the requested restrictions.
+	var req ShareLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request: "+err.Error())
+		return
+	}
+
+	// Parse expiration duration
+	duration, err := ParseDuration(req.ExpiresIn)
+	if err != nil || duration <= 0 {
+		duration = h.config.DefaultExpiration
+	}
+	if req.MaxAccesses == nil {
+		maxAccesses := h.config.DefaultMaxAccesses
+		req.MaxAccesses = &maxAccesses
+	}
+
+	if req.AllowedReferers, err = normalizeReferers(req.AllowedReferers); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid allowedReferers: "+err.Error())
+		return
+	}
+	if req.AllowedIPs, err = normalizeAllowedIPs(req.AllowedIPs); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid allowedIps: "+err.Error())
+		return
+	}
+
+	var extendBy time.Duration
+	if req.SlidingExpiry {
+		extendBy = duration
+		if req.ExtendBy != "" {
+			if extendBy, err = ParseDuration(req.ExtendBy); err != nil || extendBy <= 0 {
+				respondError(c, http.StatusBadRequest, CodeBadRequest, "extendBy must be a positive duration")
+				return
+			}
+		}
+		switch {
+		case h.config.StatelessShareLinks:
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "Sliding expiry is not supported with stateless share links")
+			return
+		case extendBy > h.config.MaxShareTTL:
+			respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "extendBy must be at most %s", h.config.MaxShareTTL)
+			return
+		}
+	}
+
+	if req.Password != "" {
+		switch {
+		case file.IsDirectory:
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "Directories can't be shared with a password")
+			return
+		case !h.config.EncryptShares:
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "Encrypted share links are not enabled")
+			return
+		case h.config.StatelessShareLinks:
+			respondError(c, http.StatusBadRequest, CodeBadRequest, "Encrypted share links are not supported with stateless share links")
+			return
+		case len(req.Password) < minSharePasswordLength:
+			respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "Password must be at least %d characters", minSharePasswordLength)
+			return
+		}
+	}
+
+	if err := h.verifyShareable(c.Request.Context(), file); err != nil {
+		respondAPIError(c, err)
+		return
+	}
+
+	now := h.clock.Now()
+	if h.config.StatelessShareLinks {
+		h.createStatelessShareLink(c, file, now.Add(duration), req)
+		return
+	}
+
+	delegationID, err := GenerateID()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to generate delegation ID")
+		return
+	}
+
+	shareLink := &ShareLink{
+		FileID:       fileID,
+		CID:          file.CID,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(duration),
+		IsRevoked:    false,
+		DelegationID: delegationID, // In production, this would be the actual UCAN delegation ID
+		MaxAccesses:  *req.MaxAccesses,
+		MaxDownloads: req.MaxDownloads,
+
+		AllowedReferers: req.AllowedReferers,
+		AllowedIPs:      req.AllowedIPs,
+
+		SlidingExpiry: req.SlidingExpiry,
+		ExtendBy:      extendBy,
+	}
+
+	if req.Password != "" {
+		cid, enc, err := h.encryptShareContent(c, file, req.Password)
+		if err != nil {
+			respondAPIError(c, err)
+			return
+		}
+		shareLink.CID = cid
+		shareLink.Encryption = enc
+	}
+
+	// Generate a token, retrying with a new one should it already be taken
+	err = retryOnDuplicate(func() error {
+		token, err := GenerateToken(h.config.ShareTokenBytes, h.config.ShareTokenEncoding)
+		if err != nil {
+			return err
+		}
+		shareLink.Token = token
+		return h.fileRepo.SaveShareLink(shareLink)
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to create share link")
+		return
+	}
+
+	c.JSON(http.StatusOK, ShareLinkResponse{
+		ShareLink:   h.presentShareLink(shareLink),
+		URL:         h.shareURL(c, shareLink.Token),
+		DownloadURL: h.downloadURL(c, shareLink.Token, file.Name),
+	})
+}
+
+// createStatelessShareLink issues a signed token carrying the link's terms
+// instead of storing the link in the repository
+func (h *Handler) createStatelessShareLink(c *gin.Context, file *FileMetadata, expiresAt time.Time, req ShareLinkRequest) {
+	nonce, err := GenerateID()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to generate share token")
+		return
+	}
+	// With HideGatewayURL the CID stays out of the token, which is readable
+	// by anyone holding it, and is looked up by file ID instead
+	cid := file.CID
+	if h.config.HideGatewayURL {
+		cid = ""
+	}
+	claims := &shareClaims{
+		FileID:       file.ID,
+		CID:          cid,
+		IssuedAt:     h.clock.Now().Unix(),
+		ExpiresAt:    expiresAt.Unix(),
+		MaxAccesses:  *req.MaxAccesses,
+		MaxDownloads: req.MaxDownloads,
+		Referers:     req.AllowedReferers,
+		IPs:          req.AllowedIPs,
+		Nonce:        nonce,
+	}
+	token, err := signShareToken([]byte(h.config.ShareSecret), claims)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to create share link")
+		return
+	}
+
+	c.JSON(http.StatusOK, ShareLinkResponse{
+		ShareLink:   h.presentShareLink(claims.toShareLink(token)),
+		URL:         h.shareURL(c, token),
+		DownloadURL: h.downloadURL(c, token, file.Name),
+	})
+}
+
+// maxShareLinksPage bounds the page size of ListFileShareLinks
+const maxShareLinksPage = 100
+
+// ListFileShareLinks pages through a file's share links, newest first.
+// ?active=true leaves out revoked, expired and exhausted links.
+func (h *Handler) ListFileShareLinks(c *gin.Context) {
+	if _, exists := h.fileRepo.GetFile(c.Param("id")); !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "offset must be a non-negative integer")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(maxShareLinksPage)))
+	if err != nil || limit < 1 || limit > maxShareLinksPage {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "limit must be between 1 and %d", maxShareLinksPage)
+		return
+	}
+	opts := ShareLinkListOptions{Offset: offset, Limit: limit}
+	if c.Query("active") == "true" {
+		opts.Filter = h.linkActive
+	}
+
+	links, total := h.fileRepo.GetShareLinksForFile(c.Param("id"), opts)
+	c.JSON(http.StatusOK, gin.H{
+		"shareLinks": h.presentShareLinks(links),
+		"total":      total,
+		"offset":     offset,
+		"limit":      limit,
+	})
+}
+
+// linkActive reports whether a share link can still be used
+func (h *Handler) linkActive(link *ShareLink) bool {
+	return h.storage.VerifyAccess(link) == AccessGranted
+}
+
+// LatestShareLink returns the newest share link of a file that can still
+// be used, so clients can reuse it instead of minting another. Stateless
+// links aren't stored and are never returned.
+func (h *Handler) LatestShareLink(c *gin.Context) {
+	file, exists := h.fileRepo.GetFile(c.Param("id"))
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+
+	links, _ := h.fileRepo.GetShareLinksForFile(file.ID, ShareLinkListOptions{Filter: h.linkActive, Limit: 1})
+	if len(links) == 0 {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File has no active share link")
+		return
+	}
+	latest := links[0]
+
+	c.JSON(http.StatusOK, ShareLinkResponse{
+		ShareLink:   h.presentShareLink(&latest),
+		URL:         h.shareURL(c, latest.Token),
+		DownloadURL: h.downloadURL(c, latest.Token, file.Name),
+	})
+}
+
+// verifyShareable refuses, with VerifyBeforeShare, to share a file whose
+// content the gateway can't serve. A recent enough result of an earlier
+// check, including the availability checker's, is reused; otherwise the
+// gateway is asked and the file's availability updated.
+func (h *Handler) verifyShareable(ctx context.Context, file *FileMetadata) error {
+	if !h.config.VerifyBeforeShare {
+		return nil
+	}
+
+	now := h.clock.Now()
+	available := file.Available
+	if file.LastVerifiedAt == nil || now.Sub(*file.LastVerifiedAt) > h.config.VerifyBeforeShareTTL {
+		var err error
+		if available, err = h.storage.CheckAvailability(ctx, file.CID); err != nil {
+			return newAPIError(http.StatusBadGateway, CodeGatewayError, "Could not verify the file's availability: %v", err)
+		}
+		h.fileRepo.UpdateFile(file.ID, func(f *FileMetadata) {
+			f.Available = available
+			f.LastVerifiedAt = &now
+		})
+	}
+	if !available {
+		return newAPIError(http.StatusConflict, CodeContentUnavailable, "The file's content is not available on the gateway")
+	}
+	return nil
+}
+
+// shareURL builds the public URL for a share token
+func (h *Handler) shareURL(c *gin.Context, token string) string {
+	return h.publicBaseURL(c) + "/api/share/" + token
+}
+
+// publicBaseURL returns the scheme, host and any path prefix clients reach
+// the API under: PublicBaseURL when configured, otherwise the request's
+// host and scheme, as reported by a trusted proxy when there is one
+func (h *Handler) publicBaseURL(c *gin.Context) string {
+	if h.config.PublicBaseURL != "" {
+		return h.config.PublicBaseURL
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	host := c.Request.Host
+	if h.fromTrustedProxy(c) {
+		if proto := firstHeaderValue(c, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwdHost := firstHeaderValue(c, "X-Forwarded-Host"); fwdHost != "" {
+			host = fwdHost
+		}
+	}
+	return scheme + "://" + host
+}
+
+// fromTrustedProxy reports whether the request came directly from one of
+// the TrustedProxies, whose forwarding headers can be believed
+func (h *Handler) fromTrustedProxy(c *gin.Context) bool {
+	ip := net.ParseIP(c.RemoteIP())
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstHeaderValue returns the first entry of a comma-separated header
+func firstHeaderValue(c *gin.Context, name string) string {
+	value, _, _ := strings.Cut(c.GetHeader(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// downloadURL builds the download proxy URL for a share token. The trailing
+// filename is ignored for lookup but lets browsers suggest a sensible name.
+func (h *Handler) downloadURL(c *gin.Context, token, filename string) string {
+	name := sanitizeDisplayName(filename)
+	if name == "" || name == "." || name == ".." || h.shareRoutes[name] {
+		// Names that can't be a path segment or would hit another route
+		return h.shareURL(c, token) + "/download"
+	}
+	return h.shareURL(c, token) + "/" + url.PathEscape(name)
+}
+
+// resolveShareLink finds the link for a token, either in the repository or,
+// for stateless links, by verifying the token's signature and reading its
+// counters from the access counter store
+func (h *Handler) resolveShareLink(token string) (*ShareLink, bool) {
+	if !isStatelessToken(token) {
+		return h.fileRepo.GetShareLink(token)
+	}
+	if !h.config.StatelessShareLinks {
+		return nil, false
+	}
+
+	claims, err := verifyShareToken([]byte(h.config.ShareSecret), token)
+	if err != nil {
+		return nil, false
+	}
+	link := claims.toShareLink(token)
+	if link.CID == "" {
+		file, exists := h.fileRepo.GetFile(link.FileID)
+		if !exists {
+			return nil, false
+		}
+		link.CID = file.CID
+	}
+	link.AccessCount, link.DownloadCount = h.accessCounter.Counts(token)
+	return link, true
+}
+
+// recordAccess counts a view of the link and returns its updated state.
+// The link's limits are checked again as the view is counted, so concurrent
+// requests can't use it more often than allowed. On failure it writes the
+// error response and returns false.
+func (h *Handler) recordAccess(c *gin.Context, link *ShareLink) (ShareLink, bool) {
+	var updated ShareLink
+	status, exists := AccessGranted, true
+	if isStatelessToken(link.Token) {
+		updated = *link
+		updated.AccessCount, updated.DownloadCount = h.accessCounter.IncrementAccess(link.Token, link.ExpiresAt)
+		// Every increment returns a count of its own, so only the first
+		// MaxAccesses get through
+		if link.MaxAccesses > 0 && updated.AccessCount > link.MaxAccesses {
+			status = AccessExhausted
+		}
+	} else {
+		updated, status, exists = h.fileRepo.IncrementAccessCount(link.Token, h.config.MaxShareTTL)
+	}
+	if !countedUse(c, status, exists) {
+		return ShareLink{}, false
+	}
+
+	now := h.clock.Now()
+	h.fileRepo.AppendAccessLog(AccessLogEntry{Token: link.Token, Kind: AccessKindView, ClientIP: c.ClientIP(), At: now})
+	h.accesses.Record(updated, AccessKindView, c.ClientIP(), now)
+	return updated, true
+}
+
+// countedUse reports whether a use of a link was counted, writing the error
+// response when the link has gone or may no longer be used
+func countedUse(c *gin.Context, status AccessStatus, exists bool) bool {
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Share link not found")
+		return false
+	}
+	if status != AccessGranted {
+		respondError(c, status.HTTPStatus(), status.Code(), status.Message())
+		return false
+	}
+	return true
+}
+
+// recordDownload counts a content download of the link, checking its
+// limits again as recordAccess does. On failure it writes the error
+// response and returns false.
+func (h *Handler) recordDownload(c *gin.Context, link *ShareLink) (ShareLink, bool) {
+	var updated ShareLink
+	status, exists := AccessGranted, true
+	if isStatelessToken(link.Token) {
+		updated = *link
+		updated.AccessCount, updated.DownloadCount = h.accessCounter.IncrementDownload(link.Token, link.ExpiresAt)
+		if link.MaxDownloads > 0 && updated.DownloadCount > link.MaxDownloads {
+			status = AccessExhausted
+		}
+	} else {
+		updated, status, exists = h.fileRepo.IncrementDownloadCount(link.Token)
+	}
+	if !countedUse(c, status, exists) {
+		return ShareLink{}, false
+	}
+
+	now := h.clock.Now()
+	h.fileRepo.AppendAccessLog(AccessLogEntry{Token: link.Token, Kind: AccessKindDownload, ClientIP: c.ClientIP(), At: now})
+	h.accesses.Record(updated, AccessKindDownload, c.ClientIP(), now)
+	return updated, true
+}
+
+// lookupShareLink resolves a share token and checks that it may be used. On
+// failure it writes the error response and returns false.
+func (h *Handler) lookupShareLink(c *gin.Context, token string) (*ShareLink, bool) {
+	shareLink, exists := h.resolveShareLink(token)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Share link not found")
+		return nil, false
+	}
+
+	// Checked first so clients outside the allowlist learn nothing about
+	// the link's status
+	if !clientIPAllowed(c, shareLink) {
+		respondError(c, http.StatusForbidden, CodeForbidden, "This share link cannot be used from your network")
+		return nil, false
+	}
+
+	// Verify access is still valid
+	if status := h.storage.VerifyAccess(shareLink); status != AccessGranted {
+		respondError(c, status.HTTPStatus(), status.Code(), status.Message())
+		return nil, false
+	}
+
+	if h.abuseGuard.Record(token, c.ClientIP()) && h.autoRevoke(c.Request.Context(), shareLink) {
+		respondError(c, AccessRevoked.HTTPStatus(), AccessRevoked.Code(), AccessRevoked.Message())
+		return nil, false
+	}
+
+	return shareLink, true
+}
+
+// autoRevoke revokes a link whose access rate looks like it has leaked and
+// alerts the operator. Stateless links cannot be revoked, so for them only
+// the alert is sent. It reports whether the link was revoked.
+func (h *Handler) autoRevoke(ctx context.Context, link *ShareLink) bool {
+	h.abuseGuard.Forget(link.Token)
+
+	revoked := false
+	if !isStatelessToken(link.Token) {
+		revoked = h.fileRepo.RevokeShareLink(link.Token)
+		h.revokeDelegation(ctx, link)
+	}
+
+	log.Printf("Suspicious access rate on share link of file %s (revoked: %t)", link.FileID, revoked)
+	h.webhooks.Notify("share_link.abuse_detected", gin.H{
+		"token":     link.Token,
+		"fileId":    link.FileID,
+		"revoked":   revoked,
+		"threshold": h.config.AbuseThreshold,
+		"window":    h.config.AbuseWindow.String(),
+	})
+	return revoked
+}
+
+// GetSharedFile serves a file via its share token
+func (h *Handler) GetSharedFile(c *gin.Context) {
+	token := c.Param("token")
+
+	shareLink, ok := h.lookupShareLink(c, token)
+	if !ok {
+		return
+	}
+
+	// Get file metadata
+	file, exists := h.fileRepo.GetFile(shareLink.FileID)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File no longer exists")
+		return
+	}
+
+	// Increment access count and read the counters back from the same update
+	updated, ok := h.recordAccess(c, shareLink)
+	if !ok {
+		return
+	}
+
+	// Return file info with gateway URL
+	body := gin.H{
+		"file":               file,
+		"gatewayUrl":         h.storage.GetGatewayURL(shareLink.CID, h.clientGateway(c)),
+		"expiresAt":          updated.ExpiresAt,
+		"accessCount":        updated.AccessCount,
+		"accessesRemaining":  updated.AccessesRemaining(),
+		"downloadCount":      updated.DownloadCount,
+		"downloadsRemaining": updated.DownloadsRemaining(),
+	}
+	if file.IPNSName != "" {
+		body["ipnsUrl"] = h.storage.IPNSGatewayURL(file.IPNSName)
+	}
+	if shareLink.Encryption != nil || h.config.HideGatewayURL {
+		// The gateway only has ciphertext of encrypted shares, and the
+		// plaintext CID would give the content away. Anyone holding a CID
+		// can also fetch it from any gateway whether or not the link has
+		// been revoked, so with HideGatewayURL shares are only downloadable
+		// through the proxy.
+		body["file"] = withoutContentAddress(file)
+		if !file.IsDirectory {
+			body["downloadUrl"] = h.downloadURL(c, token, file.Name)
+		}
+		delete(body, "gatewayUrl")
+		delete(body, "ipnsUrl")
+	}
+	if shareLink.Encryption != nil {
+		body["encrypted"] = true
+	}
+	if file.IsDirectory {
+		body["listUrl"] = h.shareURL(c, token) + "/ls"
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// DownloadSharedFile streams a shared file's content through our server.
+// Unlike GetSharedFile, which only returns metadata, this counts as a
+// download against the link's MaxDownloads. Files of a shared directory are
+// picked with ?path=.
+func (h *Handler) DownloadSharedFile(c *gin.Context) {
+	token := c.Param("token")
+
+	disposition := c.DefaultQuery("disposition", DispositionAttachment)
+	if disposition != DispositionAttachment && disposition != DispositionInline {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Unsupported disposition, expected inline or attachment")
+		return
+	}
+
+	shareLink, ok := h.lookupShareLink(c, token)
+	if !ok {
+		return
+	}
+
+	if !h.refererAllowed(c, shareLink) {
+		respondError(c, http.StatusForbidden, CodeForbidden, "Downloads of this share link are not allowed from this site")
+		return
+	}
+
+	file, exists := h.fileRepo.GetFile(shareLink.FileID)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File no longer exists")
+		return
+	}
+
+	// Files of a shared directory are downloaded one at a time by ?path=
+	cid := shareLink.CID
+	if file.IsDirectory {
+		entry, ok := directoryEntry(c, file)
+		if !ok {
+			return
+		}
+		cid = directoryContentPath(shareLink.CID, entry.Path)
+		file = entryFile(file, entry)
+	} else if c.Query("path") != "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Only shared directories have paths")
+		return
+	}
+
+	// ?format= converts images, e.g. to WebP for clients that support it
+	var targetType string
+	if format := c.Query("format"); format != "" {
+		if targetType, ok = h.conversionFormats[strings.ToLower(format)]; !ok {
+			respondErrorf(c, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType,
+				"Unsupported format, expected %s", conversionFormatNames(h.conversionFormats))
+			return
+		}
+		if !convertibleImage(file.ContentType) {
+			respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Only JPEG, PNG, GIF and WebP images can be converted")
+			return
+		}
+	}
+
+	// Encrypted and converted content is handled whole, so ranges don't
+	// apply to it
+	var content *GatewayContent
+	if targetType != "" {
+		source := *shareLink
+		source.CID = cid
+		converted, ok := h.convertSharedContent(c, &source, file, targetType)
+		if !ok {
+			return
+		}
+		content = plaintextContent(converted)
+		file = convertedFile(file, targetType, len(converted))
+	} else if shareLink.Encryption != nil {
+		plaintext, ok := h.decryptSharedContent(c, shareLink)
+		if !ok {
+			return
+		}
+		content = plaintextContent(plaintext)
+	} else if content, ok = h.fetchContent(c, cid, file.ContentType); !ok {
+		return
+	}
+	defer content.Body.Close()
+	if shareLink.Encryption != nil {
+		hidden := *file
+		hidden.CID = ""
+		file = &hidden
+	}
+
+	// Every response with content counts, range requests included: telling
+	// a resumed download from a fresh one fetched piece by piece isn't
+	// possible, so otherwise ranges would get around MaxDownloads
+	if _, ok := h.recordDownload(c, shareLink); !ok {
+		return
+	}
+
+	// A filename in the URL (/share/:token/:filename) overrides the stored one
+	filename := file.Name
+	if name := sanitizeDisplayName(c.Param("filename")); name != "" && name != "." && name != ".." {
+		filename = name
+		if targetType != "" {
+			filename = strings.TrimSuffix(name, path.Ext(name)) + conversionExtensions[targetType]
+		}
+	}
+
+	h.writeContent(c, content, file, disposition, filename)
+}
+
+// FileContent streams a file's content by ID for server-to-server use. It
+// is API key gated and, unlike share links, subject to no access limits.
+// Range requests are supported.
+func (h *Handler) FileContent(c *gin.Context) {
+	disposition := c.DefaultQuery("disposition", DispositionAttachment)
+	if disposition != DispositionAttachment && disposition != DispositionInline {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Unsupported disposition, expected inline or attachment")
+		return
+	}
+
+	file, exists := h.fileRepo.GetFile(c.Param("id"))
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+	if file.IsDirectory {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Directories can't be downloaded as a whole")
+		return
+	}
+
+	content, ok := h.fetchContent(c, file.CID, file.ContentType)
+	if !ok {
+		return
+	}
+	defer content.Body.Close()
+
+	h.writeContent(c, content, file, disposition, file.Name)
+}
+
+// fetchContent fetches a CID from the gateway, forwarding the request's
+// Range header. On failure it writes the error response and returns false.
+func (h *Handler) fetchContent(c *gin.Context, cid, contentType string) (*GatewayContent, bool) {
+	content, err := h.storage.FetchFromGateway(c.Request.Context(), cid, FetchOptions{
+		Range:       c.GetHeader("Range"),
+		Gateway:     h.clientGateway(c),
+		ContentType: contentType,
+	})
+	if errors.Is(err, errRangeNotSatisfiable) {
+		respondError(c, http.StatusRequestedRangeNotSatisfiable, CodeBadRequest, "Requested range not satisfiable")
+		return nil, false
+	}
+	if err != nil {
+		respondAPIError(c, fetchError(err))
+		return nil, false
+	}
+	return content, true
+}
+
+// fetchError describes a failed gateway fetch: 503 when the fetch queue is
+// full and 502 otherwise
+func fetchError(err error) *apiError {
+	if errors.Is(err, ErrFetchQueueFull) {
+		return newAPIError(http.StatusServiceUnavailable, CodeBusy, "Server is busy, please retry later")
+	}
+	return newAPIError(http.StatusBadGateway, CodeGatewayError, "Failed to fetch content: %v", err)
+}
+
+// clientGateway picks the gateway for the client's region from the
+// CF-IPCountry header set by Cloudflare or an X-Geo header set by another
+// proxy, or returns "" for the default gateway. A client sending these
+// headers itself can only choose among the configured gateways.
+func (h *Handler) clientGateway(c *gin.Context) string {
+	region := c.GetHeader("CF-IPCountry")
+	if region == "" {
+		region = c.GetHeader("X-Geo")
+	}
+	return h.storage.GatewayForRegion(region)
+}
+
+// writeContent streams gateway content to the client with the headers every
+// content-serving response needs
+func (h *Handler) writeContent(c *gin.Context, content *GatewayContent, file *FileMetadata, disposition, filename string) {
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = content.ContentType
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	c.Header("Accept-Ranges", "bytes")
+	if content.ContentRange != "" {
+		c.Header("Content-Range", content.ContentRange)
+	}
+
+	// Let clients verify what they received; a digest describes the whole
+	// content, so it is only sent with complete responses
+	if file.CID != "" && !h.config.HideGatewayURL {
+		c.Header("X-File-CID", file.CID)
+	}
+	if digest := contentDigest(file.Hash); digest != "" && content.Status == http.StatusOK {
+		c.Header("Digest", digest)
+	}
+	c.Header("Content-Disposition", contentDisposition(disposition, contentType, filename, h.config.TransliterateFilenames))
+	secureDownloadHeaders(c, contentType)
+	c.DataFromReader(content.Status, content.ContentLength, contentType, content.Body, nil)
+}
+
+// sha256Hex returns the hex SHA-256 of content
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// contentDigest formats a hex SHA-256 as a Digest header value
+// ("sha-256=<base64>"), or returns "" when no valid hash is stored
+func contentDigest(hexHash string) string {
+	sum, err := hex.DecodeString(hexHash)
+	if err != nil || len(sum) != sha256.Size {
+		return ""
+	}
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// HeadSharedFile reports whether a share link is usable without counting
+// an access. The status code matches what GetSharedFile would return and
+// the reason is exposed in the X-Share-Status header.
+func (h *Handler) HeadSharedFile(c *gin.Context) {
+	shareLink, exists := h.resolveShareLink(c.Param("token"))
+	if !exists {
+		c.Header("X-Share-Status", CodeNotFound)
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if !clientIPAllowed(c, shareLink) {
+		c.Header("X-Share-Status", CodeForbidden)
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	status := h.storage.VerifyAccess(shareLink)
+	c.Header("X-Share-Status", status.Code())
+	c.Status(status.HTTPStatus())
+}
+
+// RevokeShareLink revokes a share link (UCAN revocation)
+func (h *Handler) RevokeShareLink(c *gin.Context) {
+	token := c.Param("token")
+
+	if isStatelessToken(token) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest,
+			"Stateless share links cannot be revoked individually; rotate SHARE_SECRET to invalidate them")
+		return
+	}
+
+	shareLink, exists := h.fileRepo.GetShareLink(token)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Share link not found")
+		return
+	}
+
+	// Mark as revoked in our records first; lookups enforce that even while
+	// the delegation revocation is still pending
+	h.fileRepo.RevokeShareLink(token)
+	h.revokeDelegation(c.Request.Context(), shareLink)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share link revoked successfully"})
+}
+
+// revokeDelegation revokes the UCAN delegation of a link that has been
+// revoked locally. If the revocation can't be published, the link is
+// flagged so the RevocationReconciler retries it later. It reports whether
+// the revocation was published.
+func (h *Handler) revokeDelegation(ctx context.Context, link *ShareLink) bool {
+	if err := h.storage.RevokeAccess(ctx, link.DelegationID); err != nil {
+		log.Printf("Failed to revoke delegation %s of file %s, will retry: %v", link.DelegationID, link.FileID, err)
+		h.fileRepo.SetRevocationPending(link.Token, true)
+		return false
+	}
+	return true
+}
+
+// RevokeFileShareLinks revokes every active share link of a file, e.g.
+// when the file has been compromised. Stateless links can't be revoked
+// this way.
+func (h *Handler) RevokeFileShareLinks(c *gin.Context) {
+	id := c.Param("id")
+	if _, exists := h.fileRepo.GetFile(id); !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+
+	revoked := h.fileRepo.RevokeShareLinksForFile(id)
+
+	// The links are already unusable here; a failed delegation revocation
+	// is reported and retried later but doesn't undo that
+	var failed []string
+	for _, link := range revoked {
+		if !h.revokeDelegation(c.Request.Context(), &link) {
+			failed = append(failed, link.DelegationID)
+		}
+	}
+
+	body := gin.H{
+		"revoked": len(revoked),
+		"message": fmt.Sprintf("Revoked %d share link(s)", len(revoked)),
+	}
+	if len(failed) > 0 {
+		body["failedDelegations"] = failed
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// CreateDelegation creates a UCAN delegation for client-side uploads
+func (h *Handler) CreateDelegation(c *gin.Context) {
+	h.delegate(c, DelegationRequest{Audience: c.Param("did")})
+}
+
+// DelegationRequest is the request body for POST /api/delegation
+type DelegationRequest struct {
+	Audience  string   `json:"audience" binding:"required"` // Client DID (did:key:...)
+	Abilities []string `json:"abilities"`                   // Subset of the abilities we hold (default all)
+	ExpiresIn string   `json:"expiresIn"`                   // At most 24h (default 24h)
+}
+
+// CreateScopedDelegation creates a delegation limited to the requested
+// abilities and lifetime, for clients that re-delegate to a third party.
+// Like CreateDelegation it returns the unsigned placeholder from
+// StorageService.CreateDelegation, without a proof chain, so it is API key
+// gated until real UCANs are issued.
+func (h *Handler) CreateScopedDelegation(c *gin.Context) {
+	var req DelegationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request: "+err.Error())
+		return
+	}
+	if req.Abilities != nil && len(req.Abilities) == 0 {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "At least one ability is required")
+		return
+	}
+	h.delegate(c, req)
+}
+
+// delegate validates a delegation request and writes the delegation
+func (h *Handler) delegate(c *gin.Context, req DelegationRequest) {
+	delegation, ok := h.mintDelegation(c, req)
+	if !ok {
+		return
+	}
+	c.Data(http.StatusOK, "application/octet-stream", delegation)
+}
+
+// mintDelegation validates a delegation request and creates the
+// delegation. On failure it writes the error response and returns false.
+func (h *Handler) mintDelegation(c *gin.Context, req DelegationRequest) ([]byte, bool) {
+	if req.Audience == "" {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Client DID required")
+		return nil, false
+	}
+
+	// Validate DID format (should start with did:key:)
+	if !strings.HasPrefix(req.Audience, "did:key:") {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid DID format. Expected did:key:...")
+		return nil, false
+	}
+
+	expiration := maxDelegationExpiration
+	if req.ExpiresIn != "" {
+		d, err := ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxDelegationExpiration {
+			respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "expiresIn must be a positive duration of at most %s", maxDelegationExpiration)
+			return nil, false
+		}
+		expiration = d
+	}
+
+	for _, ability := range req.Abilities {
+		if !slices.Contains(delegableAbilities, ability) {
+			respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "Ability %q can't be delegated; expected a subset of %s",
+				ability, strings.Join(delegableAbilities, ", "))
+			return nil, false
+		}
+	}
+
+	delegation, err := h.storage.CreateDelegation(req.Audience, req.Abilities, expiration)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, CodeInternal, "Failed to create delegation")
+		return nil, false
+	}
+	return delegation, true
+}
+
+// WhoAmIResponse describes the Storacha space the server stores content in
+type WhoAmIResponse struct {
+	SpaceDID       string `json:"spaceDid"`
+	Gateway        string `json:"gateway"`
+	UploadMode     string `json:"uploadMode"`     // "cli", "direct" or "local"
+	HasCredentials bool   `json:"hasCredentials"` // A private key and proof are loaded
+	APIKey         string `json:"apiKey,omitempty"`
+}
+
+// WhoAmI reports the space, gateway and upload mode the server is
+// configured with, to help debug delegations. Secrets are never included;
+// callers presenting an API key also see which key they were identified as.
+func (h *Handler) WhoAmI(c *gin.Context) {
+	resp := WhoAmIResponse{
+		SpaceDID:       h.config.SpaceDID,
+		Gateway:        h.storage.PublicGateway(),
+		UploadMode:     h.storage.UploadMode(),
+		HasCredentials: h.config.PrivateKey != "" && h.config.Proof != "",
+	}
+	if key := requestAPIKey(c); key != nil {
+		resp.APIKey = key.ID()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// UploadParamsResponse is everything a client needs to upload straight to
+// Storacha and register the result with POST /api/register
+type UploadParamsResponse struct {
+	SpaceDID     string   `json:"spaceDid"`
+	Gateway      string   `json:"gateway"`
+	MaxFileSize  int64    `json:"maxFileSize"`
+	AllowedTypes []string `json:"allowedTypes"` // null when any type may be uploaded
+	Delegation   string   `json:"delegation,omitempty"`
+}
+
+// UploadParams returns the parameters for a client-side upload, with a
+// delegation for the DID in the "did" query parameter if one is given
+func (h *Handler) UploadParams(c *gin.Context) {
+	params := UploadParamsResponse{
+		SpaceDID:    h.config.SpaceDID,
+		Gateway:     h.clientGateway(c),
+		MaxFileSize: h.config.FileSizeLimit(),
+	}
+	if params.Gateway == "" {
+		params.Gateway = h.storage.PublicGateway()
+	}
+	if key := requestAPIKey(c); h.config.EnforceFileTypes && (key == nil || !key.Trusted) {
+		params.AllowedTypes = h.config.AllowedFileTypes
+	}
+
+	if did := c.Query("did"); did != "" {
+		delegation, ok := h.mintDelegation(c, DelegationRequest{Audience: did})
+		if !ok {
+			return
+		}
+		params.Delegation = string(delegation)
+	}
+
+	c.JSON(http.StatusOK, params)
+}
+
+// CIDProbeResponse is the gateway's view of a CID
+type CIDProbeResponse struct {
+	CID string `json:"cid"`
+	*CIDProbe
+	Gateway string `json:"gateway"` // Where clients can fetch the CID
+}
+
+// ProbeCID asks the gateway whether it can serve a CID and what it reports
+// about the content, whether or not the CID belongs to a stored file
+func (h *Handler) ProbeCID(c *gin.Context) {
+	cid := strings.TrimSpace(c.Param("cid"))
+	if !isValidCID(cid) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid CID format")
+		return
+	}
+
+	gateway := h.clientGateway(c)
+	probe, err := h.storage.ProbeCID(c.Request.Context(), cid, gateway)
+	if err != nil {
+		respondAPIError(c, fetchError(err))
+		return
+	}
+	c.JSON(http.StatusOK, CIDProbeResponse{
+		CID:      cid,
+		CIDProbe: probe,
+		Gateway:  h.storage.GetGatewayURL(cid, gateway),
+	})
+}
+
+// Bounds of a batch CID check: CIDs per request, and probes of one batch
+// in flight at once (they also wait for gateway fetch slots)
+const (
+	maxCIDCheckBatch    = 100
+	cidCheckConcurrency = 8
+)
+
+// CIDCheckRequest is the request body of a batch CID check
+type CIDCheckRequest struct {
+	CIDs []string `json:"cids" binding:"required"`
+}
+
+// CIDCheckResult is the outcome of probing one CID of a batch
+type CIDCheckResult struct {
+	Available bool   `json:"available"`
+	Status    int    `json:"status,omitempty"` // Absent when the gateway couldn't be reached
+	Error     string `json:"error,omitempty"`
+}
+
+// CheckCIDs probes a batch of CIDs on the gateway concurrently and reports
+// the availability of each
+func (h *Handler) CheckCIDs(c *gin.Context) {
+	var req CIDCheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request: "+err.Error())
+		return
+	}
+	if len(req.CIDs) > maxCIDCheckBatch {
+		respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "At most %d CIDs can be checked at once", maxCIDCheckBatch)
+		return
+	}
+	var cids []string
+	for _, cid := range req.CIDs {
+		cid = strings.TrimSpace(cid)
+		if !isValidCID(cid) {
+			respondErrorf(c, http.StatusBadRequest, CodeBadRequest, "Invalid CID format: %q", cid)
+			return
+		}
+		if !slices.Contains(cids, cid) {
+			cids = append(cids, cid)
+		}
+	}
+
+	ctx := c.Request.Context()
+	gateway := h.clientGateway(c)
+	results := make(map[string]CIDCheckResult, len(cids))
+	var mu sync.Mutex
+	var g errgroup.Group
+	g.SetLimit(cidCheckConcurrency)
+	for _, cid := range cids {
+		cid := cid
+		g.Go(func() error {
+			var result CIDCheckResult
+			if probe, err := h.storage.ProbeCID(ctx, cid, gateway); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Available, result.Status = probe.Available, probe.Status
+			}
+			mu.Lock()
+			results[cid] = result
+			mu.Unlock()
+			return nil
+		})
+	}
+	g.Wait()
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// RegisterFileRequest is the request body for registering a file uploaded from frontend
+type RegisterFileRequest struct {
+	Name        string            `json:"name"` // Defaults to a generated name
+	Size        int64             `json:"size" binding:"required"`
+	ContentType string            `json:"contentType"`
+	CID         string            `json:"cid" binding:"required"`
+	Folder      string            `json:"folder"`
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// RegisterFile registers a file that was uploaded directly from frontend to Storacha
+func (h *Handler) RegisterFile(c *gin.Context) {
+	var req RegisterFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request: "+err.Error())
+		return
+	}
+
+	// Validate CID format
+	if !isValidCID(req.CID) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid CID format")
+		return
+	}
+
+	folder, err := normalizeFolder(req.Folder)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid folder: "+err.Error())
+		return
+	}
+
+	description := strings.TrimSpace(req.Description)
+	if err := validateAnnotations(description, req.Metadata); err != nil {
+		respondAPIError(c, err)
+		return
+	}
+
+	name := req.Name
+	if strings.TrimSpace(name) == "" {
+		name = h.fallbackName(req.ContentType)
+	}
+	name, err = h.resolveName(folder, name)
+	if err != nil {
+		respondAPIError(c, err)
+		return
+	}
+
+	// The type is only as reliable as the client declaring it
+	uploader := requestAPIKey(c)
+	if err := h.checkUploadAllowed(uploader, name, req.ContentType, req.Size); err != nil {
+		respondAPIError(c, err)
+		return
+	}
+
+	// Create file metadata
+	metadata := &FileMetadata{
+		Name:        name,
+		Folder:      folder,
+		Size:        req.Size,
+		ContentType: req.ContentType,
+		CID:         req.CID,
+		UploadedAt:  h.clock.Now(),
+		GatewayURL:  h.storage.GetGatewayURL(req.CID, ""),
+		UploadedBy:  uploaderID(uploader),
+		Description: description,
+		Metadata:    req.Metadata,
+		Available:   true,
+	}
+
+	// Save metadata
+	if err := h.saveNewFile(metadata); err != nil {
+		respondAPIError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file":    h.presentFile(metadata),
+		"message": "File registered successfully",
+	})
+}
+
+// sanitizeDisplayName cleans up a user-supplied file name for display. Path
+// separators and control characters are replaced so the name can't be
+// mistaken for a path when it is later used for downloads.
+func sanitizeDisplayName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, name)
+	return strings.TrimSpace(name)
+}
+
+// isValidCID reports whether a string is a well-formed CID, see ValidateCID
+func isValidCID(cid string) bool {
+	return ValidateCID(cid) == nil
 }
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type uploadResponse struct {
+	Files []*FileMetadata `json:"files"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+func TestUploadStoresFile(t *testing.T) {
+	s := newTestServer(t, nil)
+	content := []byte("hello, world\n")
+
+	w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload",
+		map[string]string{"folder": "/docs", "description": "A greeting"},
+		multipartFile{Name: "hello.txt", Content: content}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var resp uploadResponse
+	decodeJSON(t, w, &resp)
+	if len(resp.Files) != 1 {
+		t.Fatalf("got %d files, want 1", len(resp.Files))
+	}
+	file := resp.Files[0]
+	if file.Name != "hello.txt" || file.Folder != "docs" || file.Description != "A greeting" {
+		t.Errorf("file = %+v", file)
+	}
+	if file.Size != int64(len(content)) || file.Hash != sha256Hex(content) {
+		t.Errorf("size %d, hash %s; want %d, %s", file.Size, file.Hash, len(content), sha256Hex(content))
+	}
+	if want := computeUnixFSCID(content); file.CID != want {
+		t.Errorf("CID = %s, want %s", file.CID, want)
+	}
+	if !strings.HasPrefix(file.ContentType, "text/plain") {
+		t.Errorf("content type = %s", file.ContentType)
+	}
+
+	stored, ok := s.handler.fileRepo.GetFile(file.ID)
+	if !ok || stored.CID != file.CID {
+		t.Errorf("repository has %+v, %v", stored, ok)
+	}
+}
+
+func TestUploadMultipleFiles(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", nil,
+		multipartFile{Field: "files", Name: "a.txt", Content: []byte("a")},
+		multipartFile{Field: "files", Name: "b.txt", Content: []byte("b")}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var resp uploadResponse
+	decodeJSON(t, w, &resp)
+	if len(resp.Files) != 2 || s.storage.uploads != 2 {
+		t.Fatalf("got %d files and %d uploads, want 2", len(resp.Files), s.storage.uploads)
+	}
+}
+
+func TestUploadRejections(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		fields    map[string]string
+		files     []multipartFile
+		status    int
+		code      string
+	}{
+		{
+			name:   "no file",
+			fields: map[string]string{"folder": "docs"},
+			status: http.StatusBadRequest,
+			code:   CodeBadRequest,
+		},
+		{
+			name:      "too large",
+			configure: func(cfg *Config) { cfg.MaxFileSize = 4 },
+			files:     []multipartFile{{Name: "big.txt", Content: []byte("12345")}},
+			status:    http.StatusBadRequest,
+			code:      CodeFileTooLarge,
+		},
+		{
+			name:      "too many files",
+			configure: func(cfg *Config) { cfg.MaxFilesPerUpload = 1 },
+			files: []multipartFile{
+				{Field: "files", Name: "a.txt", Content: []byte("a")},
+				{Field: "files", Name: "b.txt", Content: []byte("b")},
+			},
+			status: http.StatusBadRequest,
+			code:   CodeBadRequest,
+		},
+		{
+			name:   "invalid folder",
+			fields: map[string]string{"folder": "../up"},
+			files:  []multipartFile{{Name: "a.txt", Content: []byte("a")}},
+			status: http.StatusBadRequest,
+			code:   CodeBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.configure)
+			w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", tt.fields, tt.files...))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.status, w.Body)
+			}
+			var resp errorResponse
+			decodeJSON(t, w, &resp)
+			if resp.Code != tt.code {
+				t.Errorf("code = %s, want %s", resp.Code, tt.code)
+			}
+			if s.storage.uploads != 0 {
+				t.Errorf("%d files were uploaded", s.storage.uploads)
+			}
+		})
+	}
+}
+
+func TestUploadStorageFailure(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.storage.uploadErr = ErrUploadQueueFull
+
+	w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", nil,
+		multipartFile{Name: "a.txt", Content: []byte("a")}))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	s.storage.uploadErr = errors.New("storacha exited with status 1")
+	w = s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", nil,
+		multipartFile{Name: "a.txt", Content: []byte("a")}))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if files := s.handler.fileRepo.ListFiles(ListOptions{}); len(files) != 0 {
+		t.Errorf("failed uploads left %d files behind", len(files))
+	}
+}
+
+func TestGetFileNotFound(t *testing.T) {
+	s := newTestServer(t, nil)
+	w := s.do(httptest.NewRequest(http.MethodGet, "/api/files/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+}
+
+func TestDeleteFileKeepsSharedContent(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.DeleteFromStorage = true
+		cfg.APIKeys = []APIKey{{Key: "test-key"}}
+	})
+	content := []byte("same content")
+	first := s.uploadTestFile("first.txt", content)
+	second := s.uploadTestFile("second.txt", content)
+	if first.CID != second.CID || first.ID == second.ID {
+		t.Fatalf("files %s (%s) and %s (%s) don't share content", first.ID, first.CID, second.ID, second.CID)
+	}
+	deleteFile := func(id, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/api/files/"+id, nil)
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		return s.do(req)
+	}
+
+	// Removing stored content takes an API key
+	if w := deleteFile(first.ID, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("deleting without a key: status %d, body %s", w.Code, w.Body)
+	}
+
+	var resp struct {
+		StorageRemoved bool `json:"storageRemoved"`
+	}
+	w := deleteFile(first.ID, "test-key")
+	if w.Code != http.StatusOK {
+		t.Fatalf("deleting the first file: status %d, body %s", w.Code, w.Body)
+	}
+	if decodeJSON(t, w, &resp); resp.StorageRemoved || len(s.storage.removals) != 0 {
+		t.Fatalf("content still used by %s was removed: %s", second.ID, w.Body)
+	}
+	link := s.createShareLink(second.ID, "")
+	w = s.do(httptest.NewRequest(http.MethodGet, "/api/share/"+link.Token+"/download", nil))
+	if w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Fatalf("downloading the second file: status %d, body %q", w.Code, w.Body)
+	}
+
+	// Uploading the same content again while it is being removed would
+	// leave the new file pointing at nothing
+	var reupload *httptest.ResponseRecorder
+	s.storage.onRemove = func(string) {
+		reupload = s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", nil,
+			multipartFile{Name: "third.txt", Content: content}))
+	}
+	w = deleteFile(second.ID, "test-key")
+	if decodeJSON(t, w, &resp); !resp.StorageRemoved {
+		t.Errorf("deleting the last file kept its content: %s", w.Body)
+	}
+	if len(s.storage.removals) != 1 || s.storage.removals[0] != second.CID {
+		t.Errorf("removals = %v, want [%s]", s.storage.removals, second.CID)
+	}
+	var errResp errorResponse
+	if decodeJSON(t, reupload, &errResp); reupload.Code != http.StatusConflict || errResp.Code != CodeContentRemoving {
+		t.Errorf("upload during removal: status %d, body %s", reupload.Code, reupload.Body)
+	}
+	s.storage.onRemove = nil
+	s.uploadTestFile("third.txt", content)
+}
+
+func TestScopedDelegationRequiresAPIKey(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.APIKeys = []APIKey{{Key: "test-key"}}
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/delegation",
+		strings.NewReader(`{"audience": "did:key:z6MkclientDID", "abilities": ["store/add"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	if w := s.do(req); w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, body %s", w.Code, w.Body)
+	}
+}
+
+func TestHiddenGatewayURLKeepsCIDOutOfResponses(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.HideGatewayURL = true
+		cfg.APIKeys = []APIKey{{Key: "test-key"}}
+	})
+	content := []byte("content only reachable through the proxy")
+	cid := computeUnixFSCID(content)
+	check := func(name string, w *httptest.ResponseRecorder) {
+		t.Helper()
+		if w.Code >= http.StatusBadRequest {
+			t.Fatalf("%s: status %d, body %s", name, w.Code, w.Body)
+		}
+		if strings.Contains(w.Body.String(), cid) {
+			t.Errorf("%s: body contains the CID: %s", name, w.Body)
+		}
+		for header, values := range w.Header() {
+			if strings.Contains(strings.Join(values, " "), cid) {
+				t.Errorf("%s: header %s contains the CID", name, header)
+			}
+		}
+	}
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(apiKeyHeader, "test-key")
+		return s.do(req)
+	}
+
+	w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", nil,
+		multipartFile{Name: "notes.txt", Content: content}))
+	check("upload", w)
+	var uploaded uploadResponse
+	decodeJSON(t, w, &uploaded)
+	id := uploaded.Files[0].ID
+	if stored, _ := s.handler.fileRepo.GetFile(id); stored.CID != cid {
+		t.Fatalf("stored CID = %s, want %s", stored.CID, cid)
+	}
+
+	w = request(http.MethodPost, "/api/files/"+id+"/share", "")
+	check("create share link", w)
+	var created ShareLinkResponse
+	decodeJSON(t, w, &created)
+	token := created.ShareLink.Token
+
+	for name, target := range map[string]string{
+		"list files":       "/api/files",
+		"list fields":      "/api/files?fields=id,cid,gatewayUrl",
+		"get file":         "/api/files/" + id,
+		"list share links": "/api/files/" + id + "/shares",
+		"latest link":      "/api/files/" + id + "/share/latest",
+		"shared file":      "/api/share/" + token,
+		"download":         "/api/share/" + token + "/download",
+		"file content":     "/api/files/" + id + "/content",
+		"json export":      "/api/export?includeShares=true",
+		"csv export":       "/api/export?format=csv",
+	} {
+		check(name, request(http.MethodGet, target, ""))
+	}
+	check("update file", request(http.MethodPatch, "/api/files/"+id, `{"description": "notes"}`))
+	check("head share link", request(http.MethodHead, "/api/share/"+token, ""))
+}
+
+func TestHiddenGatewayURLStatelessToken(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.HideGatewayURL = true
+		cfg.StatelessShareLinks = true
+		cfg.ShareSecret = strings.Repeat("s", minShareSecretLength)
+	})
+	content := []byte("stateless content")
+	file := s.uploadTestFile("notes.txt", content)
+	link := s.createShareLink(file.ID, "")
+	claims, err := verifyShareToken([]byte(s.config.ShareSecret), link.Token)
+	if err != nil || claims.CID != "" {
+		t.Fatalf("token claims = %+v, %v; want no CID", claims, err)
+	}
+	w := s.do(httptest.NewRequest(http.MethodGet, "/api/share/"+link.Token+"/download", nil))
+	if w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Errorf("download: status %d, body %q", w.Code, w.Body)
+	}
+}
+
+func TestShareLinkLifecycle(t *testing.T) {
+	s := newTestServer(t, nil)
+	content := []byte("shared content")
+	file := s.uploadTestFile("notes.txt", content)
+
+	w := s.do(httptest.NewRequest(http.MethodPost, "/api/files/"+file.ID+"/share", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("creating share link: status %d, body %s", w.Code, w.Body)
+	}
+	var created ShareLinkResponse
+	decodeJSON(t, w, &created)
+	token := created.ShareLink.Token
+
+	w = s.do(httptest.NewRequest(http.MethodGet, "/api/share/"+token+"/download", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("downloading: status %d, body %s", w.Code, w.Body)
+	}
+	if w.Body.String() != string(content) {
+		t.Errorf("downloaded %q, want %q", w.Body, content)
+	}
+	if got := w.Header().Get("Content-Disposition"); !strings.Contains(got, "notes.txt") {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	w = s.do(httptest.NewRequest(http.MethodDelete, "/api/share/"+token, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoking: status %d, body %s", w.Code, w.Body)
+	}
+	if len(s.storage.revocations) != 1 || s.storage.revocations[0] != created.ShareLink.DelegationID {
+		t.Errorf("revocations = %v, want [%s]", s.storage.revocations, created.ShareLink.DelegationID)
+	}
+
+	w = s.do(httptest.NewRequest(http.MethodGet, "/api/share/"+token+"/download", nil))
+	if w.Code == http.StatusOK {
+		t.Errorf("revoked link still downloads")
+	}
+}
+
+func TestRevocationRetriedWhenUnpublished(t *testing.T) {
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("shared content"))
+
+	w := s.do(httptest.NewRequest(http.MethodPost, "/api/files/"+file.ID+"/share", nil))
+	var created ShareLinkResponse
+	decodeJSON(t, w, &created)
+
+	// The link is revoked locally even when the revocation can't be
+	// published, and the reconciler publishes it later
+	s.storage.revokeErr = errors.New("revocation service unreachable")
+	w = s.do(httptest.NewRequest(http.MethodDelete, "/api/share/"+created.ShareLink.Token, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoking: status %d, body %s", w.Code, w.Body)
+	}
+	if pending := s.handler.fileRepo.PendingRevocations(); len(pending) != 1 {
+		t.Fatalf("%d pending revocations, want 1", len(pending))
+	}
+
+	s.storage.revokeErr = nil
+	NewRevocationReconciler(s.storage, s.handler.fileRepo, s.config).retryPending(context.Background())
+	if pending := s.handler.fileRepo.PendingRevocations(); len(pending) != 0 {
+		t.Errorf("%d revocations still pending", len(pending))
+	}
+	if len(s.storage.revocations) != 1 {
+		t.Errorf("revocations = %v", s.storage.revocations)
+	}
+}
+
+func TestListFilesETag(t *testing.T) {
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+
+	w := s.do(httptest.NewRequest(http.MethodGet, "/api/files", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("status %d, ETag %q", w.Code, etag)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "private, max-age=5" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+
+	revalidate := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+		req.Header.Set("If-None-Match", etag)
+		return s.do(req)
+	}
+	if w := revalidate(); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("unchanged listing: status %d, body %s", w.Code, w.Body)
+	}
+
+	// Creating a share link is a change too
+	s.do(httptest.NewRequest(http.MethodPost, "/api/files/"+file.ID+"/share", nil))
+	if w := revalidate(); w.Code != http.StatusOK {
+		t.Fatalf("after sharing: status %d", w.Code)
+	}
+}
+
+func TestShareLinkAccessLimitUnderConcurrency(t *testing.T) {
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+	link := s.createShareLink(file.ID, `{"maxAccesses": 3}`)
+
+	statuses := s.concurrentStatuses(3+5, "/api/share/"+link.Token)
+	if statuses[http.StatusOK] != 3 {
+		t.Errorf("statuses = %v, want exactly 3 OK", statuses)
+	}
+	if stored, _ := s.handler.fileRepo.GetShareLink(link.Token); stored.AccessCount != 3 {
+		t.Errorf("access count = %d, want 3", stored.AccessCount)
+	}
+}
+
+func TestShareLinkDownloadLimitUnderConcurrency(t *testing.T) {
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+	link := s.createShareLink(file.ID, `{"maxDownloads": 2}`)
+
+	statuses := s.concurrentStatuses(2+6, "/api/share/"+link.Token+"/download")
+	if statuses[http.StatusOK] != 2 {
+		t.Errorf("statuses = %v, want exactly 2 OK", statuses)
+	}
+	if stored, _ := s.handler.fileRepo.GetShareLink(link.Token); stored.DownloadCount != 2 {
+		t.Errorf("download count = %d, want 2", stored.DownloadCount)
+	}
+}
+
+func TestShareLinkDownloadLimitWithRanges(t *testing.T) {
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("0123456789"))
+	link := s.createShareLink(file.ID, `{"maxDownloads": 1}`)
+	download := func(rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/share/"+link.Token+"/download", nil)
+		req.Header.Set("Range", rangeHeader)
+		return s.do(req)
+	}
+
+	if w := download("bytes=0-3"); w.Code != http.StatusPartialContent || w.Body.String() != "0123" {
+		t.Fatalf("first range: status %d, body %q", w.Code, w.Body)
+	}
+	// The rest of the content, from the middle or from the end, is a second
+	// download the link doesn't allow
+	for _, r := range []string{"bytes=4-", "bytes=-6", "bytes=0-"} {
+		if w := download(r); w.Code == http.StatusOK || w.Code == http.StatusPartialContent {
+			t.Errorf("%s: status %d, body %q", r, w.Code, w.Body)
+		}
+	}
+	if stored, _ := s.handler.fileRepo.GetShareLink(link.Token); stored.DownloadCount != 1 {
+		t.Errorf("download count = %d, want 1", stored.DownloadCount)
+	}
+}
+
+func TestDownloadURLAvoidsShareRoutes(t *testing.T) {
+	s := newTestServer(t, nil)
+	for name := range s.handler.shareRoutes {
+		t.Run(name, func(t *testing.T) {
+			content := []byte("content of " + name)
+			file := s.uploadTestFile(name, content)
+			w := s.do(httptest.NewRequest(http.MethodPost, "/api/files/"+file.ID+"/share", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("sharing: status %d, body %s", w.Code, w.Body)
+			}
+			var created ShareLinkResponse
+			decodeJSON(t, w, &created)
+			if !strings.HasSuffix(created.DownloadURL, "/share/"+created.ShareLink.Token+"/download") {
+				t.Fatalf("download URL = %s", created.DownloadURL)
+			}
+			u, err := url.Parse(created.DownloadURL)
+			if err != nil {
+				t.Fatalf("parsing download URL: %v", err)
+			}
+			w = s.do(httptest.NewRequest(http.MethodGet, u.Path, nil))
+			if w.Code != http.StatusOK || w.Body.String() != string(content) {
+				t.Errorf("download: status %d, body %q", w.Code, w.Body)
+			}
+		})
+	}
+	if !s.handler.shareRoutes["analytics"] || !s.handler.shareRoutes["ls"] {
+		t.Errorf("share routes = %v", s.handler.shareRoutes)
+	}
+
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+	w := s.do(httptest.NewRequest(http.MethodPost, "/api/files/"+file.ID+"/share", nil))
+	var created ShareLinkResponse
+	decodeJSON(t, w, &created)
+	if !strings.HasSuffix(created.DownloadURL, "/"+created.ShareLink.Token+"/notes.txt") {
+		t.Errorf("download URL = %s", created.DownloadURL)
+	}
+}
+
+func TestShareLinkAnalyticsRequiresAPIKey(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.APIKeys = []APIKey{{Key: "test-key"}} })
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+	link := s.createShareLink(file.ID, "")
+	target := "/api/share/" + link.Token + "/analytics"
+
+	if w := s.do(httptest.NewRequest(http.MethodGet, target, nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a key: status %d, body %s", w.Code, w.Body)
+	}
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set(apiKeyHeader, "test-key")
+	if w := s.do(req); w.Code != http.StatusOK {
+		t.Errorf("with a key: status %d, body %s", w.Code, w.Body)
+	}
+}
+
+func TestListShareLinksWhileAccessed(t *testing.T) {
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+	link := s.createShareLink(file.ID, "")
+
+	// Listed links must be copies, which -race checks while views update
+	// the stored link
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.do(httptest.NewRequest(http.MethodGet, "/api/share/"+link.Token, nil))
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		for _, target := range []string{"/api/files/" + file.ID, "/api/files/" + file.ID + "/shares?active=true"} {
+			if w := s.do(httptest.NewRequest(http.MethodGet, target, nil)); w.Code != http.StatusOK {
+				t.Errorf("GET %s: status %d", target, w.Code)
+			}
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func TestMalformedCIDsRejected(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.APIKeys = []APIKey{{Key: "test-key"}} })
+	valid := computeUnixFSCID([]byte("content"))
+	// Each starts like a CID but doesn't decode to one
+	malformed := []string{"bafyinvalidcid123", "bafk" + strings.Repeat("a", 20), "QmNotARealCIDButLongEnough", valid[:len(valid)-1]}
+
+	register := func(cid string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/register",
+			strings.NewReader(`{"name": "a.txt", "size": 7, "cid": "`+cid+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		return s.do(req).Code
+	}
+	withKey := func(req *http.Request) *http.Request {
+		req.Header.Set(apiKeyHeader, "test-key")
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+	for _, cid := range malformed {
+		if status := register(cid); status != http.StatusBadRequest {
+			t.Errorf("register %s: status %d", cid, status)
+		}
+		if w := s.do(withKey(httptest.NewRequest(http.MethodGet, "/api/cid/"+cid, nil))); w.Code != http.StatusBadRequest {
+			t.Errorf("probe %s: status %d", cid, w.Code)
+		}
+		body := strings.NewReader(`{"cids": ["` + valid + `", "` + cid + `"]}`)
+		if w := s.do(withKey(httptest.NewRequest(http.MethodPost, "/api/cid/check", body))); w.Code != http.StatusBadRequest {
+			t.Errorf("check %s: status %d", cid, w.Code)
+		}
+	}
+	if status := register(valid); status != http.StatusOK {
+		t.Errorf("register %s: status %d", valid, status)
+	}
+}
+
+func TestCreateShareLinkRejectsMalformedBody(t *testing.T) {
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+	for _, body := range []string{
+		`{"allowedIps": "10.0.0.0/8"}`,
+		`{"allowedReferers": "example.com"}`,
+		`{"maxDownloads": "1"}`,
+		`{"password": 1234}`,
+		`{"maxAccesses": 3`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/files/"+file.ID+"/share", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if w := s.do(req); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, body %s", body, w.Code, w.Body)
+		}
+	}
+	if _, total := s.handler.fileRepo.GetShareLinksForFile(file.ID, ShareLinkListOptions{}); total != 0 {
+		t.Errorf("%d share links were created", total)
+	}
+	// An empty body still takes the defaults
+	s.createShareLink(file.ID, "")
+}
+
+func TestShareLinkIPAllowlist(t *testing.T) {
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+	link := s.createShareLink(file.ID, `{"allowedIps": ["10.0.0.0/8"], "expiresIn": "1h"}`)
+	from := func(method, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/share/"+link.Token, nil)
+		req.RemoteAddr = ip + ":1234"
+		return s.do(req)
+	}
+
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		if w := from(method, "192.0.2.1"); w.Code != http.StatusForbidden {
+			t.Errorf("%s from outside: status %d", method, w.Code)
+		}
+		if w := from(method, "10.1.2.3"); w.Code != http.StatusOK {
+			t.Errorf("%s from inside: status %d", method, w.Code)
+		}
+	}
+
+	// Outsiders don't learn that the link has been revoked
+	s.do(httptest.NewRequest(http.MethodDelete, "/api/share/"+link.Token, nil))
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		w := from(method, "192.0.2.1")
+		if w.Code != http.StatusForbidden || w.Header().Get("X-Share-Status") == AccessRevoked.Code() {
+			t.Errorf("%s of a revoked link from outside: status %d, X-Share-Status %q", method, w.Code, w.Header().Get("X-Share-Status"))
+		}
+	}
+}
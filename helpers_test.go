@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// fakeStorage is an in-memory Storage. Uploads are kept under the CID the
+// Storacha client would assign them and served back by FetchFromGateway.
+// Methods it doesn't implement panic through the nil embedded Storage, so a
+// test touching unexpected storage fails loudly.
+type fakeStorage struct {
+	Storage
+
+	mu          sync.Mutex
+	contents    map[string][]byte
+	uploads     int
+	revocations []string // Delegation IDs, in the order revoked
+	removals    []string // CIDs, in the order removed
+
+	// uploadErr and revokeErr, when set, fail every upload or revocation
+	uploadErr error
+	revokeErr error
+
+	// onRemove, when set, runs at the start of every removal
+	onRemove func(cid string)
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{contents: make(map[string][]byte)}
+}
+
+func (f *fakeStorage) Upload(ctx context.Context, content []byte, filename, contentType string) (*UploadResult, error) {
+	if f.uploadErr != nil {
+		return nil, f.uploadErr
+	}
+	cid := computeUnixFSCID(content)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.contents[cid] = bytes.Clone(content)
+	f.uploads++
+	return &UploadResult{CID: cid, GatewayURL: f.GetGatewayURL(cid, "")}, nil
+}
+
+func (f *fakeStorage) UploadFromReader(ctx context.Context, reader io.Reader, filename, contentType string) (*UploadResult, error) {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return f.Upload(ctx, content, filename, contentType)
+}
+
+// UploadDirectory stores each file under its own CID and the directory
+// under a CID derived from its paths, resolving "{cid}/{path}" to the files
+func (f *fakeStorage) UploadDirectory(ctx context.Context, files []DirectoryFile) (*UploadResult, error) {
+	if f.uploadErr != nil {
+		return nil, f.uploadErr
+	}
+	var paths []byte
+	for _, file := range files {
+		paths = append(paths, file.Path+"\n"...)
+	}
+	cid := computeUnixFSCID(paths)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.contents[cid] = paths
+	for _, file := range files {
+		f.contents[directoryContentPath(cid, file.Path)] = bytes.Clone(file.Content)
+	}
+	f.uploads++
+	return &UploadResult{CID: cid, GatewayURL: f.GetGatewayURL(cid, "")}, nil
+}
+
+func (f *fakeStorage) FetchFromGateway(ctx context.Context, cid string, opts FetchOptions) (*GatewayContent, error) {
+	f.mu.Lock()
+	content, ok := f.contents[cid]
+	f.mu.Unlock()
+	if !ok {
+		return nil, errors.New("gateway returned status 404")
+	}
+	if opts.Range == "" {
+		return plaintextContent(content), nil
+	}
+	start, end, ok := parseByteRange(opts.Range, int64(len(content)))
+	if !ok {
+		return nil, errRangeNotSatisfiable
+	}
+	partial := plaintextContent(content[start : end+1])
+	partial.Status = http.StatusPartialContent
+	partial.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, len(content))
+	return partial, nil
+}
+
+func (f *fakeStorage) Remove(cid string) error {
+	if f.onRemove != nil {
+		f.onRemove(cid)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.contents, cid)
+	f.removals = append(f.removals, cid)
+	return nil
+}
+
+func (f *fakeStorage) CheckAvailability(ctx context.Context, cid string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.contents[cid]
+	return ok, nil
+}
+
+func (f *fakeStorage) GetGatewayURL(cid, gateway string) string {
+	return "https://gateway.test/ipfs/" + cid
+}
+
+func (f *fakeStorage) PublicGateway() string                 { return "https://gateway.test" }
+func (f *fakeStorage) GatewayForRegion(region string) string { return "https://gateway.test" }
+func (f *fakeStorage) UploadMode() string                    { return "fake" }
+
+func (f *fakeStorage) VerifyAccess(link *ShareLink) AccessStatus {
+	return linkAccessStatus(link, time.Now())
+}
+
+func (f *fakeStorage) CreateDelegation(clientDID string, abilities []string, expiration time.Duration) ([]byte, error) {
+	return []byte(`{"aud":"` + clientDID + `"}`), nil
+}
+
+func (f *fakeStorage) RevokeAccess(ctx context.Context, delegationID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.revokeErr != nil {
+		return f.revokeErr
+	}
+	f.revocations = append(f.revocations, delegationID)
+	return nil
+}
+
+// fakeClock is a Clock that only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock { return &fakeClock{now: now} }
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// testServer is a router with every API route, backed by a fake storage
+// and a fresh repository
+type testServer struct {
+	t       *testing.T
+	router  *gin.Engine
+	handler *Handler
+	storage *fakeStorage
+	config  *Config
+}
+
+// newTestServer builds a test server from the default configuration, as
+// loaded without any environment, after configure adjusts it
+func newTestServer(t *testing.T, configure func(*Config)) *testServer {
+	t.Helper()
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	storage := newFakeStorage()
+	handler := NewHandler(storage, NewFileRepository(), cfg)
+
+	router := gin.New()
+	router.Use(requestID())
+	registerRoutes(router.Group("/api"), handler, cfg)
+	return &testServer{t: t, router: router, handler: handler, storage: storage, config: cfg}
+}
+
+// do serves req and returns the recorded response
+func (s *testServer) do(req *http.Request) *httptest.ResponseRecorder {
+	s.t.Helper()
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// multipartFile is a file part of a multipart upload
+type multipartFile struct {
+	Field   string // Defaults to "file"
+	Name    string
+	Content []byte
+}
+
+// newMultipartRequest builds a multipart/form-data request with the given
+// form fields and files
+func newMultipartRequest(t *testing.T, method, target string, fields map[string]string, files ...multipartFile) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := w.WriteField(name, value); err != nil {
+			t.Fatalf("WriteField: %v", err)
+		}
+	}
+	for _, f := range files {
+		field := f.Field
+		if field == "" {
+			field = "file"
+		}
+		part, err := w.CreateFormFile(field, f.Name)
+		if err != nil {
+			t.Fatalf("CreateFormFile: %v", err)
+		}
+		if _, err := part.Write(f.Content); err != nil {
+			t.Fatalf("writing %s: %v", f.Name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing multipart body: %v", err)
+	}
+	req := httptest.NewRequest(method, target, &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+// uploadTestFile uploads content as name and returns the stored file
+func (s *testServer) uploadTestFile(name string, content []byte) *FileMetadata {
+	s.t.Helper()
+	w := s.do(newMultipartRequest(s.t, http.MethodPost, "/api/upload", nil, multipartFile{Name: name, Content: content}))
+	if w.Code != http.StatusOK {
+		s.t.Fatalf("uploading %s: status %d, body %s", name, w.Code, w.Body)
+	}
+	var resp struct {
+		Files []*FileMetadata `json:"files"`
+	}
+	decodeJSON(s.t, w, &resp)
+	return resp.Files[0]
+}
+
+// createShareLink shares a file with the given JSON request body, "" for
+// the defaults, and returns the new link
+func (s *testServer) createShareLink(fileID, body string) *ShareLink {
+	s.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/files/"+fileID+"/share", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := s.do(req)
+	if w.Code != http.StatusOK {
+		s.t.Fatalf("sharing %s: status %d, body %s", fileID, w.Code, w.Body)
+	}
+	var resp ShareLinkResponse
+	decodeJSON(s.t, w, &resp)
+	return resp.ShareLink
+}
+
+// concurrentStatuses sends n copies of a GET request at once and counts
+// the response statuses
+func (s *testServer) concurrentStatuses(n int, target string) map[int]int {
+	s.t.Helper()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	statuses := make(map[int]int)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+			mu.Lock()
+			statuses[w.Code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+// decodeJSON decodes a response body into v
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+}
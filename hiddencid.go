@@ -0,0 +1,60 @@
+package main
+
+// With HideGatewayURL, shared content is only reachable through the download
+// proxy, where revocation takes effect at once. Anyone holding a CID can
+// fetch it from any gateway, so no response may contain one: files and
+// share links are passed through these helpers before they are returned.
+
+// withoutContentAddress returns a copy of file without its CID, gateway URL
+// and IPNS name, or the CIDs of its directory entries
+func withoutContentAddress(file *FileMetadata) *FileMetadata {
+	hidden := *file
+	hidden.CID = ""
+	hidden.GatewayURL = ""
+	hidden.IPNSName, hidden.IPNSKey = "", ""
+	hidden.Entries = hiddenEntries(file.Entries)
+	return &hidden
+}
+
+// presentFile returns file as it may be shown to clients
+func (h *Handler) presentFile(file *FileMetadata) *FileMetadata {
+	if !h.config.HideGatewayURL || file == nil {
+		return file
+	}
+	return withoutContentAddress(file)
+}
+
+// presentFiles is presentFile for a list of files
+func (h *Handler) presentFiles(files []*FileMetadata) []*FileMetadata {
+	if !h.config.HideGatewayURL || files == nil {
+		return files
+	}
+	presented := make([]*FileMetadata, len(files))
+	for i, f := range files {
+		presented[i] = withoutContentAddress(f)
+	}
+	return presented
+}
+
+// presentShareLink returns link as it may be shown to clients
+func (h *Handler) presentShareLink(link *ShareLink) *ShareLink {
+	if !h.config.HideGatewayURL || link == nil {
+		return link
+	}
+	hidden := *link
+	hidden.CID = ""
+	return &hidden
+}
+
+// presentShareLinks is presentShareLink for a list of links
+func (h *Handler) presentShareLinks(links []ShareLink) []ShareLink {
+	if !h.config.HideGatewayURL || links == nil {
+		return links
+	}
+	presented := make([]ShareLink, len(links))
+	for i, link := range links {
+		link.CID = ""
+		presented[i] = link
+	}
+	return presented
+}
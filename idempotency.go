@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Idempotency keys let clients retry a write after a timeout without
+// repeating it: the first response for a key is kept for a while and
+// replayed to retries carrying the same key and the same request.
+// Reusing a key for a different request is an error rather than a replay.
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	idempotencySweepEvery    = 100
+)
+
+// IdempotencyStore remembers responses by idempotency key
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*idempotentResponse
+	begins  int
+}
+
+// errIdempotencyKeyMismatch is returned when a key is reused for a request
+// with different content
+var errIdempotencyKeyMismatch = errors.New("idempotency key reused for a different request")
+
+type idempotentResponse struct {
+	fingerprint string // Of the request that claimed the key
+	pending     bool   // The first request is still running
+	status      int
+	contentType string
+	body        []byte
+	expiresAt   time.Time
+}
+
+// NewIdempotencyStore creates a store keeping responses for ttl
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{ttl: ttl, entries: make(map[string]*idempotentResponse)}
+}
+
+// begin claims key for a new request with the given fingerprint. It
+// returns the stored response when the key was already used, or
+// claimed=false while the first request using it is still in progress.
+// A key used by a request with another fingerprint fails with
+// errIdempotencyKeyMismatch.
+func (s *IdempotencyStore) begin(key, fingerprint string) (resp *idempotentResponse, claimed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.begins++
+	if s.begins%idempotencySweepEvery == 0 {
+		for k, e := range s.entries {
+			if !e.pending && now.After(e.expiresAt) {
+				delete(s.entries, k)
+			}
+		}
+	}
+
+	if e, ok := s.entries[key]; ok && (e.pending || now.Before(e.expiresAt)) {
+		if e.fingerprint != fingerprint {
+			return nil, false, errIdempotencyKeyMismatch
+		}
+		if e.pending {
+			return nil, false, nil
+		}
+		return e, false, nil
+	}
+	s.entries[key] = &idempotentResponse{fingerprint: fingerprint, pending: true}
+	return nil, true, nil
+}
+
+// finish stores the response for a claimed key
+func (s *IdempotencyStore) finish(key, fingerprint string, status int, contentType string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = &idempotentResponse{
+		fingerprint: fingerprint,
+		status:      status,
+		contentType: contentType,
+		body:        body,
+		expiresAt:   time.Now().Add(s.ttl),
+	}
+}
+
+// release gives up a claimed key so the request can be retried
+func (s *IdempotencyStore) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+// idempotent replays the stored response for a repeated Idempotency-Key
+// instead of running the handler again. Requests without the header are
+// unaffected. Server errors aren't stored, so a retry after a 5xx runs
+// the request again.
+func idempotent(store *IdempotencyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			respondErrorf(c, http.StatusBadRequest, CodeBadRequest,
+				"%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+			c.Abort()
+			return
+		}
+
+		// A request that can't be read has nothing to replay; the handler
+		// reports why
+		fingerprint, err := requestFingerprint(c)
+		if err != nil {
+			c.Next()
+			return
+		}
+
+		// Keys are scoped to the route and the client so one key can't
+		// replay another endpoint's or another client's response
+		key = c.FullPath() + " " + idempotencyScope(c) + " " + key
+		resp, claimed, err := store.begin(key, fingerprint)
+		if err != nil {
+			respondErrorf(c, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused,
+				"This %s was already used for a different request", idempotencyKeyHeader)
+			c.Abort()
+			return
+		}
+		if !claimed {
+			if resp == nil {
+				respondErrorf(c, http.StatusConflict, CodeIdempotencyKeyInUse,
+					"A request with this %s is still in progress", idempotencyKeyHeader)
+			} else {
+				c.Header(idempotentReplayedHeader, "true")
+				c.Data(resp.status, resp.contentType, resp.body)
+			}
+			c.Abort()
+			return
+		}
+
+		w := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		defer func() {
+			// A panic leaves no response worth replaying
+			if r := recover(); r != nil {
+				store.release(key)
+				panic(r)
+			}
+			if status := w.Status(); status < http.StatusInternalServerError {
+				store.finish(key, fingerprint, status, w.Header().Get("Content-Type"), w.body.Bytes())
+			} else {
+				store.release(key)
+			}
+		}()
+		c.Next()
+	}
+}
+
+// idempotencyScope identifies the client owning an idempotency key: the
+// API key the request was made with, or the client's address for
+// anonymous requests
+func idempotencyScope(c *gin.Context) string {
+	if key := requestAPIKey(c); key != nil {
+		return "key:" + key.ID()
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// requestFingerprint hashes the content of a request, so a retry can be told
+// from a different request reusing its key. Multipart forms are hashed by
+// their fields and files rather than their raw bytes, whose boundary
+// usually changes between retries. Other bodies are hashed as they are.
+func requestFingerprint(c *gin.Context) (string, error) {
+	h := sha256.New()
+	if mediaType, _, _ := mime.ParseMediaType(c.ContentType()); mediaType == "multipart/form-data" {
+		form, err := c.MultipartForm()
+		if err != nil {
+			return "", err
+		}
+		if err := hashForm(h, form.Value, form.File); err != nil {
+			return "", err
+		}
+	} else if c.Request.Body != nil {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return "", err
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashForm writes the fields and files of a multipart form to h in a
+// fixed order, each length-prefixed so values can't run into each other
+func hashForm(h hash.Hash, values map[string][]string, files map[string][]*multipart.FileHeader) error {
+	write := func(s string) { fmt.Fprintf(h, "%d:%s", len(s), s) }
+	for _, name := range sortedKeys(values) {
+		write("field")
+		write(name)
+		for _, v := range values[name] {
+			write(v)
+		}
+	}
+	for _, name := range sortedKeys(files) {
+		write("file")
+		write(name)
+		for _, fh := range files[name] {
+			write(fh.Filename)
+			write(fh.Header.Get("Content-Type"))
+			fmt.Fprintf(h, "%d:", fh.Size)
+			f, err := fh.Open()
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// recordingWriter keeps a copy of the response body
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
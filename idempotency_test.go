@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIdempotentUploads(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.APIKeys = []APIKey{{Key: "first-key", Name: "first"}, {Key: "second-key", Name: "second"}}
+	})
+	upload := func(apiKey, idempotencyKey, content string) *http.Request {
+		// Every request gets a new multipart boundary, as retries usually do
+		req := newMultipartRequest(t, http.MethodPost, "/api/upload", map[string]string{"folder": "docs"},
+			multipartFile{Name: "notes.txt", Content: []byte(content)})
+		req.Header.Set(apiKeyHeader, apiKey)
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+		return req
+	}
+
+	first := s.do(upload("first-key", "retry-1", "notes"))
+	if first.Code != http.StatusOK {
+		t.Fatalf("first upload: status %d, body %s", first.Code, first.Body)
+	}
+	w := s.do(upload("first-key", "retry-1", "notes"))
+	if w.Code != http.StatusOK || w.Header().Get(idempotentReplayedHeader) != "true" || w.Body.String() != first.Body.String() {
+		t.Errorf("retry: status %d, replayed %q, body %s", w.Code, w.Header().Get(idempotentReplayedHeader), w.Body)
+	}
+	if s.storage.uploads != 1 {
+		t.Fatalf("%d uploads after a retry, want 1", s.storage.uploads)
+	}
+
+	// The same key with other content is a mistake, not a retry
+	w = s.do(upload("first-key", "retry-1", "other notes"))
+	var resp errorResponse
+	if decodeJSON(t, w, &resp); w.Code != http.StatusUnprocessableEntity || resp.Code != CodeIdempotencyKeyReused {
+		t.Errorf("reused key: status %d, body %s", w.Code, w.Body)
+	}
+
+	// Another client's key doesn't replay the first client's response
+	w = s.do(upload("second-key", "retry-1", "notes"))
+	if w.Code != http.StatusOK || w.Header().Get(idempotentReplayedHeader) != "" {
+		t.Errorf("another API key: status %d, replayed %q", w.Code, w.Header().Get(idempotentReplayedHeader))
+	}
+	if s.storage.uploads != 2 {
+		t.Errorf("%d uploads, want 2", s.storage.uploads)
+	}
+}
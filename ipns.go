@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ipnsPublishTimeout bounds one IPNS publish, which has to reach the DHT
+const ipnsPublishTimeout = 2 * time.Minute
+
+// ipnsKeyPattern restricts key names, which end up on an ipfs command line
+var ipnsKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// PublishIPNS publishes /ipfs/<cid> under the IPNS key keyName of the local
+// IPFS node, generating the key first if it doesn't exist, and returns the
+// IPNS name
+func (s *StorageService) PublishIPNS(ctx context.Context, cidStr, keyName string) (string, error) {
+	ipfs, err := exec.LookPath(s.config.IPFSCLI)
+	if err != nil {
+		return "", fmt.Errorf("ipfs CLI not available: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, ipnsPublishTimeout)
+	defer cancel()
+
+	keys, err := exec.CommandContext(ctx, ipfs, "key", "list").Output()
+	if err != nil {
+		return "", fmt.Errorf("ipfs key list failed: %w", err)
+	}
+	if !containsLine(string(keys), keyName) {
+		if output, err := exec.CommandContext(ctx, ipfs, "key", "gen", keyName).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("ipfs key gen failed: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	output, err := exec.CommandContext(ctx, ipfs, "name", "publish", "--quieter", "--key="+keyName, "/ipfs/"+cidStr).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ipfs name publish failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	name := strings.TrimSpace(string(output))
+	if name == "" {
+		return "", fmt.Errorf("ipfs name publish returned no name")
+	}
+	return name, nil
+}
+
+// IPNSGatewayURL returns the user-facing gateway URL of an IPNS name, on the
+// /ipns path of the public gateway
+func (s *StorageService) IPNSGatewayURL(name string) string {
+	base := strings.TrimSuffix(strings.TrimSuffix(s.PublicGateway(), "/"), "/ipfs")
+	return base + "/ipns/" + name
+}
+
+// containsLine reports whether one of the lines of s is exactly line
+func containsLine(s, line string) bool {
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) == line {
+			return true
+		}
+	}
+	return false
+}
+
+// PublishFileRequest is the optional request body of PublishFile
+type PublishFileRequest struct {
+	Key string `json:"key"` // IPNS key name; defaults to one per file
+}
+
+// PublishFile publishes a file's CID under an IPNS name, giving it a URL
+// that stays the same if the file is later pointed at other content.
+// Publishing again updates the name to the file's current CID.
+func (h *Handler) PublishFile(c *gin.Context) {
+	if !h.config.IPNSPublish {
+		respondError(c, http.StatusNotFound, CodeNotFound, "IPNS publishing is not enabled")
+		return
+	}
+
+	id := c.Param("id")
+	file, exists := h.fileRepo.GetFile(id)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File not found")
+		return
+	}
+	if isPlaceholderCID(file.CID) {
+		respondError(c, http.StatusConflict, CodeContentUnavailable, "The file's content has not reached Storacha")
+		return
+	}
+
+	var req PublishFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		// Use defaults if no body provided
+		req = PublishFileRequest{}
+	}
+	if req.Key == "" {
+		req.Key = file.IPNSKey
+	}
+	if req.Key == "" {
+		req.Key = "file-" + file.ID
+	}
+	if !ipnsKeyPattern.MatchString(req.Key) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "key must be 1-64 letters, digits, '-' or '_'")
+		return
+	}
+
+	name, err := h.storage.PublishIPNS(c.Request.Context(), file.CID, req.Key)
+	if err != nil {
+		respondErrorf(c, http.StatusBadGateway, CodeGatewayError, "Failed to publish to IPNS: %v", err)
+		return
+	}
+
+	h.fileRepo.UpdateFile(id, func(f *FileMetadata) {
+		f.IPNSName = name
+		f.IPNSKey = req.Key
+	})
+	file, _ = h.fileRepo.GetFile(id)
+
+	c.JSON(http.StatusOK, gin.H{
+		"file":    h.presentFile(file),
+		"ipnsUrl": h.storage.IPNSGatewayURL(name),
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upload job states
+const (
+	JobQueued     = "queued"
+	JobProcessing = "processing"
+	JobCompleted  = "completed"
+	JobFailed     = "failed"
+)
+
+// jobRetention is how long finished jobs can still be looked up
+const jobRetention = time.Hour
+
+// Job tracks an asynchronous upload
+type Job struct {
+	ID        string          `json:"id"`
+	State     string          `json:"state"`
+	Progress  int             `json:"progress"` // Percentage of files processed
+	Total     int             `json:"total"`    // Files in the upload
+	Files     []*FileMetadata `json:"files"`
+	Errors    []string        `json:"errors,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// finished reports whether the job has reached a final state
+func (j *Job) finished() bool {
+	return j.State == JobCompleted || j.State == JobFailed
+}
+
+// JobStore keeps upload jobs in memory and notifies watchers of changes
+type JobStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*trackedJob
+	clock Clock
+}
+
+type trackedJob struct {
+	job     Job
+	changed chan struct{} // Closed and replaced on every update
+}
+
+// NewJobStore creates an empty job store
+func NewJobStore(clock Clock) *JobStore {
+	return &JobStore{jobs: make(map[string]*trackedJob), clock: clock}
+}
+
+// Create registers a new queued job for total files
+func (s *JobStore) Create(total int) (Job, error) {
+	id, err := GenerateID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Finished jobs are forgotten after a while
+	now := s.clock.Now()
+	for k, t := range s.jobs {
+		if t.job.finished() && now.Sub(t.job.UpdatedAt) > jobRetention {
+			delete(s.jobs, k)
+		}
+	}
+
+	job := Job{ID: id, State: JobQueued, Total: total, Files: []*FileMetadata{}, CreatedAt: now, UpdatedAt: now}
+	s.jobs[id] = &trackedJob{job: job, changed: make(chan struct{})}
+	return job, nil
+}
+
+// Update applies fn to a job and wakes its watchers
+func (s *JobStore) Update(id string, fn func(*Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+	fn(&t.job)
+	t.job.UpdatedAt = s.clock.Now()
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// Watch returns a snapshot of a job and a channel closed at its next change
+func (s *JobStore) Watch(id string) (Job, <-chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.jobs[id]
+	if !ok {
+		return Job{}, nil, false
+	}
+	job := t.job
+	job.Files = append([]*FileMetadata(nil), t.job.Files...)
+	job.Errors = append([]string(nil), t.job.Errors...)
+	return job, t.changed, true
+}
+
+// pendingUpload is a file read from an upload request, waiting to be stored
+type pendingUpload struct {
+	content []byte
+	opts    uploadOptions
+}
+
+// startUploadJob stores files in the background and returns the job
+// tracking them. The work outlives the request but stays part of its trace.
+func (h *Handler) startUploadJob(ctx context.Context, files []pendingUpload) (Job, error) {
+	ctx = context.WithoutCancel(ctx)
+	job, err := h.jobs.Create(len(files))
+	if err != nil {
+		return Job{}, err
+	}
+
+	go func() {
+		h.jobs.Update(job.ID, func(j *Job) { j.State = JobProcessing })
+		for i, f := range files {
+			stored, err := h.storeContent(ctx, f.content, f.opts)
+			h.jobs.Update(job.ID, func(j *Job) {
+				if err != nil {
+					j.Errors = append(j.Errors, fmt.Sprintf("%s: %v", f.opts.Name, err))
+				} else {
+					j.Files = append(j.Files, stored)
+				}
+				j.Progress = (i + 1) * 100 / len(files)
+			})
+		}
+		h.jobs.Update(job.ID, func(j *Job) {
+			j.State = JobCompleted
+			if len(j.Errors) > 0 {
+				j.State = JobFailed
+			}
+		})
+	}()
+	return job, nil
+}
+
+// GetJob returns the current state of an upload job
+func (h *Handler) GetJob(c *gin.Context) {
+	job, _, exists := h.jobs.Watch(c.Param("id"))
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Job not found")
+		return
+	}
+	job.Files = h.presentFiles(job.Files)
+	c.JSON(http.StatusOK, job)
+}
+
+// JobEvents streams an upload job's state as Server-Sent Events: a "job"
+// event with the current state, another on every change, and the end of
+// the stream once the job has finished or failed
+func (h *Handler) JobEvents(c *gin.Context) {
+	id := c.Param("id")
+	job, changed, exists := h.jobs.Watch(id)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Job not found")
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // Keep nginx-style proxies from buffering
+	c.Status(http.StatusOK)
+
+	for {
+		job.Files = h.presentFiles(job.Files)
+		data, err := json.Marshal(job)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		fmt.Fprintf(c.Writer, "event: job\ndata: %s\n\n", data)
+		c.Writer.Flush()
+		if job.finished() {
+			return
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-changed:
+		}
+		if job, changed, exists = h.jobs.Watch(id); !exists {
+			return
+		}
+	}
+}
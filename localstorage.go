@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Storage backends selected by STORAGE_BACKEND
+const (
+	StorageBackendStoracha = "storacha"
+	StorageBackendLocal    = "local"
+)
+
+// localGatewayPath is where the local backend serves content by CID, in
+// place of an IPFS gateway
+const localGatewayPath = "/api/ipfs"
+
+// errLocalUnsupported is returned for Storacha features the local backend
+// has no equivalent of
+var errLocalUnsupported = errors.New("not supported by the local storage backend")
+
+// LocalStorage keeps content in a directory on this server instead of
+// Storacha, for development, demos and air-gapped deployments. Content is
+// named by the CID the Storacha client would assign it, so files keep the
+// same CIDs whichever backend stored them, and is served back by this
+// server under localGatewayPath.
+type LocalStorage struct {
+	config *Config
+	dir    string
+	clock  Clock
+}
+
+var _ Storage = (*LocalStorage)(nil)
+
+// NewLocalStorage creates the content directory if needed
+func NewLocalStorage(cfg *Config) (*LocalStorage, error) {
+	if err := os.MkdirAll(cfg.StorageDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &LocalStorage{config: cfg, dir: cfg.StorageDir, clock: realClock{}}, nil
+}
+
+// NewStorage creates the storage backend selected by cfg
+func NewStorage(cfg *Config) (Storage, error) {
+	if cfg.StorageBackend == StorageBackendLocal {
+		return NewLocalStorage(cfg)
+	}
+	return NewStorageService(cfg)
+}
+
+// path returns where the content of a CID is kept. CIDs are checked before
+// they're used as file names.
+func (l *LocalStorage) path(cidStr string) (string, error) {
+	if !isValidCID(cidStr) || strings.ContainsAny(cidStr, `/\.`) {
+		return "", fmt.Errorf("invalid CID %q", cidStr)
+	}
+	return filepath.Join(l.dir, cidStr), nil
+}
+
+// Upload writes content under its CID. Content that is already stored is
+// left as it is.
+func (l *LocalStorage) Upload(ctx context.Context, content []byte, filename string, contentType string) (_ *UploadResult, err error) {
+	_, span := startSpan(ctx, "LocalStorage.Upload", attrFileSize.Int(len(content)))
+	defer func() { endSpan(span, err) }()
+
+	cidStr := computeUnixFSCID(content)
+	span.SetAttributes(attrCID.String(cidStr))
+	if err := l.store(cidStr, content); err != nil {
+		return nil, err
+	}
+	return &UploadResult{CID: cidStr, GatewayURL: l.GetGatewayURL(cidStr, "")}, nil
+}
+
+// store writes content under a CID unless it is already stored
+func (l *LocalStorage) store(cidStr string, content []byte) error {
+	path, err := l.path(cidStr)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	// Write and rename so a crash never leaves partial content
+	tmp, err := os.CreateTemp(l.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write content: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store content: %w", err)
+	}
+
+	log.Printf("Stored %s (%d bytes) locally", cidStr, len(content))
+	return nil
+}
+
+// UploadFromReader uploads content from a reader
+func (l *LocalStorage) UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string) (*UploadResult, error) {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content: %w", err)
+	}
+	return l.Upload(ctx, content, filename, contentType)
+}
+
+// UploadDirectory stores each file under its own CID and a manifest of
+// their paths under a CID for the directory. The directory CID is derived
+// from the manifest rather than built as Storacha would build it.
+func (l *LocalStorage) UploadDirectory(ctx context.Context, files []DirectoryFile) (_ *UploadResult, err error) {
+	ctx, span := startSpan(ctx, "LocalStorage.UploadDirectory")
+	defer func() { endSpan(span, err) }()
+
+	manifest := make(map[string]string, len(files))
+	for _, f := range files {
+		result, err := l.Upload(ctx, f.Content, path.Base(f.Path), "")
+		if err != nil {
+			return nil, err
+		}
+		manifest[f.Path] = result.CID
+	}
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	cidStr := "b" + strings.ToLower(cidBase32.EncodeToString(encodeCID(codecDagPB, encoded)))
+	if err := l.store(cidStr, encoded); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attrCID.String(cidStr))
+	return &UploadResult{CID: cidStr, GatewayURL: l.GetGatewayURL(cidStr, "")}, nil
+}
+
+// resolvePath resolves "{cid}/{path}", with the path escaped as by
+// directoryContentPath, to the CID of the file through the manifest of an
+// uploaded directory
+func (l *LocalStorage) resolvePath(cidPath string) (string, error) {
+	cidStr, escaped, _ := strings.Cut(cidPath, "/")
+	entryPath, err := url.PathUnescape(escaped)
+	if err != nil {
+		return "", fmt.Errorf("invalid path %q", escaped)
+	}
+	manifest, err := l.LocalCopy(cidStr)
+	if errors.Is(err, errNoLocalCopy) {
+		return "", fmt.Errorf("gateway returned status %d", http.StatusNotFound)
+	}
+	if err != nil {
+		return "", err
+	}
+	var entries map[string]string
+	if json.Unmarshal(manifest, &entries) != nil || entries[entryPath] == "" {
+		return "", fmt.Errorf("gateway returned status %d", http.StatusNotFound)
+	}
+	return entries[entryPath], nil
+}
+
+// FetchFromGateway opens the stored content of a CID, or of a file within
+// an uploaded directory given as "{cid}/{path}", honouring a single byte
+// range in opts.Range. Content that isn't stored is reported as a gateway
+// 404.
+func (l *LocalStorage) FetchFromGateway(ctx context.Context, cidStr string, opts FetchOptions) (*GatewayContent, error) {
+	if strings.Contains(cidStr, "/") {
+		resolved, err := l.resolvePath(cidStr)
+		if err != nil {
+			return nil, err
+		}
+		cidStr = resolved
+	}
+	path, err := l.path(cidStr)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("gateway returned status %d", http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := info.Size()
+
+	content := &GatewayContent{
+		Body:          f,
+		Status:        http.StatusOK,
+		ContentType:   opts.ContentType,
+		ContentLength: size,
+	}
+	if opts.Range == "" {
+		return content, nil
+	}
+	start, end, ok := parseByteRange(opts.Range, size)
+	if !ok {
+		f.Close()
+		return nil, errRangeNotSatisfiable
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	content.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, end-start+1), f}
+	content.Status = http.StatusPartialContent
+	content.ContentLength = end - start + 1
+	content.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, size)
+	return content, nil
+}
+
+// parseByteRange parses a Range header holding one range ("bytes=0-99",
+// "bytes=100-" or "bytes=-100") against content of size bytes, returning
+// the first and last byte. ok is false when the range can't be satisfied.
+func parseByteRange(header string, size int64) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.ReplaceAll(header, " ", ""), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false
+	}
+	if first == "" {
+		// The final bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+// CheckAvailability reports whether the content of a CID is stored
+func (l *LocalStorage) CheckAvailability(ctx context.Context, cidStr string) (bool, error) {
+	path, err := l.path(cidStr)
+	if err != nil {
+		return false, nil
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ProbeCID reports on the stored content of a CID as a gateway would
+func (l *LocalStorage) ProbeCID(ctx context.Context, cidStr, gateway string) (*CIDProbe, error) {
+	probe := &CIDProbe{Status: http.StatusNotFound, ContentLength: -1}
+	path, err := l.path(cidStr)
+	if err != nil {
+		return probe, nil
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return probe, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	probe.Available = true
+	probe.Status = http.StatusOK
+	probe.ContentLength = info.Size()
+	return probe, nil
+}
+
+// Remove deletes the stored content of a CID
+func (l *LocalStorage) Remove(cidStr string) error {
+	path, err := l.path(cidStr)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	log.Printf("Removed %s from storage", cidStr)
+	return nil
+}
+
+// LocalCopy returns the stored content of a CID, so repin can restore
+// content from it like from a retained copy
+func (l *LocalStorage) LocalCopy(cidStr string) ([]byte, error) {
+	path, err := l.path(cidStr)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoLocalCopy
+	}
+	return content, err
+}
+
+// GetGatewayURL returns the URL this server serves a CID at, under the
+// given gateway or PublicGateway
+func (l *LocalStorage) GetGatewayURL(cidStr, gateway string) string {
+	if gateway == "" {
+		gateway = l.PublicGateway()
+	}
+	return fmt.Sprintf("%s/%s", gateway, cidStr)
+}
+
+// PublicGateway returns the base URL content is served from: PublicGateway
+// if configured, otherwise localGatewayPath on PublicBaseURL (relative to
+// this server when that is unset too)
+func (l *LocalStorage) PublicGateway() string {
+	if l.config.PublicGateway != "" {
+		return l.config.PublicGateway
+	}
+	return strings.TrimSuffix(l.config.PublicBaseURL, "/") + localGatewayPath
+}
+
+// GatewayForRegion returns "": all content is served by this server
+func (l *LocalStorage) GatewayForRegion(region string) string {
+	return ""
+}
+
+// UploadMode reports that content is stored locally
+func (l *LocalStorage) UploadMode() string {
+	return UploadModeLocal
+}
+
+// CreateDelegation fails: there's no Storacha space to delegate access to
+func (l *LocalStorage) CreateDelegation(clientDID string, abilities []string, expiration time.Duration) ([]byte, error) {
+	return nil, fmt.Errorf("delegations are %w", errLocalUnsupported)
+}
+
+// VerifyAccess checks if a share link is still valid
+func (l *LocalStorage) VerifyAccess(link *ShareLink) AccessStatus {
+	return linkAccessStatus(link, l.clock.Now())
+}
+
+// RevokeAccess has nothing to publish: share links are only checked by
+// this server
+func (l *LocalStorage) RevokeAccess(ctx context.Context, delegationID string) error {
+	return nil
+}
+
+// PublishIPNS fails: content stored locally isn't on IPFS
+func (l *LocalStorage) PublishIPNS(ctx context.Context, cidStr, keyName string) (string, error) {
+	return "", fmt.Errorf("IPNS publishing is %w", errLocalUnsupported)
+}
+
+// IPNSGatewayURL returns "": names can't be published
+func (l *LocalStorage) IPNSGatewayURL(name string) string {
+	return ""
+}
+
+// UploadStats reports no load: local uploads aren't queued
+func (l *LocalStorage) UploadStats() ConcurrencyStats {
+	return ConcurrencyStats{}
+}
+
+// FetchStats reports no load: local reads aren't queued
+func (l *LocalStorage) FetchStats() ConcurrencyStats {
+	return ConcurrencyStats{}
+}
+
+// LocalStoreUsage returns nil: no copies are retained besides the content
+// itself
+func (l *LocalStorage) LocalStoreUsage() *LocalStoreUsage {
+	return nil
+}
+
+// LocalGatewayContent serves stored content by CID at localGatewayPath, as
+// an IPFS gateway would for the Storacha backend, and the files of uploaded
+// directories by their path under the directory CID. Like a gateway it
+// needs no credentials: anyone who knows a CID may fetch its content.
+func (h *Handler) LocalGatewayContent(c *gin.Context) {
+	cidStr := c.Param("cid")
+	if !isValidCID(cidStr) {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid CID format")
+		return
+	}
+	if available, err := h.storage.CheckAvailability(c.Request.Context(), cidStr); err != nil || !available {
+		respondError(c, http.StatusNotFound, CodeNotFound, "Content not found")
+		return
+	}
+
+	// Files with this content tell its type; otherwise it is served as
+	// opaque bytes
+	file := &FileMetadata{CID: cidStr, ContentType: "application/octet-stream"}
+	files := h.fileRepo.FindByCID(cidStr)
+	target, filename := cidStr, cidStr
+	if entryPath := strings.TrimPrefix(c.Param("path"), "/"); entryPath != "" {
+		target, filename = directoryContentPath(cidStr, entryPath), path.Base(entryPath)
+		for _, dir := range files {
+			for _, entry := range dir.Entries {
+				if entry.Path == entryPath {
+					file.ContentType = entry.ContentType
+				}
+			}
+		}
+	} else if len(files) > 0 {
+		file.ContentType = files[0].ContentType
+	}
+
+	content, ok := h.fetchContent(c, target, file.ContentType)
+	if !ok {
+		return
+	}
+	defer content.Body.Close()
+	h.writeContent(c, content, file, DispositionInline, filename)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-99", 0, 99, true},
+		{"bytes=10-", 10, 999, true},
+		{"bytes=-100", 900, 999, true},
+		{"bytes=-5000", 0, 999, true},
+		{"bytes=990-2000", 990, 999, true},
+		{"bytes=1000-", 0, 0, false},
+		{"bytes=50-10", 0, 0, false},
+		{"bytes=0-1,5-6", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, end, ok := parseByteRange(tt.header, 1000)
+		if ok != tt.ok || ok && (start != tt.start || end != tt.end) {
+			t.Errorf("parseByteRange(%q) = %d, %d, %v; want %d, %d, %v", tt.header, start, end, ok, tt.start, tt.end, tt.ok)
+		}
+	}
+}
+
+func TestLocalStorageRoundTrip(t *testing.T) {
+	cfg := &Config{StorageDir: t.TempDir(), PublicBaseURL: "https://files.example.com"}
+	storage, err := NewLocalStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	content := []byte("stored on this server")
+
+	result, err := storage.Upload(ctx, content, "a.txt", "text/plain")
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if result.CID != computeUnixFSCID(content) {
+		t.Errorf("CID = %s, want %s", result.CID, computeUnixFSCID(content))
+	}
+	if want := "https://files.example.com/api/ipfs/" + result.CID; result.GatewayURL != want {
+		t.Errorf("gateway URL = %s, want %s", result.GatewayURL, want)
+	}
+
+	fetched, err := storage.FetchFromGateway(ctx, result.CID, FetchOptions{Range: "bytes=10-13"})
+	if err != nil {
+		t.Fatalf("FetchFromGateway: %v", err)
+	}
+	body, _ := io.ReadAll(fetched.Body)
+	fetched.Body.Close()
+	if string(body) != "this" || fetched.Status != http.StatusPartialContent || fetched.ContentRange != "bytes 10-13/21" {
+		t.Errorf("fetched %q, status %d, range %q", body, fetched.Status, fetched.ContentRange)
+	}
+
+	if err := storage.Remove(result.CID); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if available, _ := storage.CheckAvailability(ctx, result.CID); available {
+		t.Error("content still available after Remove")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LocalStore keeps encrypted copies of uploaded content on disk, named by
+// CID, so content the gateway has lost can be uploaded again. When the
+// copies exceed maxBytes the oldest are deleted.
+type LocalStore struct {
+	dir      string
+	maxBytes int64 // 0 = unlimited
+	gcm      cipher.AEAD
+	mu       sync.Mutex
+}
+
+// LocalStoreUsage reports the disk space used by local copies
+type LocalStoreUsage struct {
+	Files    int   `json:"files"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"maxBytes"`
+}
+
+// errNoLocalCopy is returned when no local copy of a CID is kept
+var errNoLocalCopy = errors.New("no local copy")
+
+// NewLocalStore creates the store directory if needed. Copies are
+// encrypted with AES-256-GCM under a key derived from secret.
+func NewLocalStore(dir string, maxBytes int64, secret string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create local store: %w", err)
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: dir, maxBytes: maxBytes, gcm: gcm}, nil
+}
+
+// path returns where the copy of a CID is kept. CIDs are checked before
+// they're used as file names.
+func (l *LocalStore) path(cid string) (string, error) {
+	if !isValidCID(cid) || strings.ContainsAny(cid, `/\.`) {
+		return "", fmt.Errorf("invalid CID %q", cid)
+	}
+	return filepath.Join(l.dir, cid), nil
+}
+
+// Put stores an encrypted copy of content under its CID, then deletes the
+// oldest copies until the store is within its size limit. Content larger
+// than the whole store isn't kept.
+func (l *LocalStore) Put(cid string, content []byte) error {
+	path, err := l.path(cid)
+	if err != nil {
+		return err
+	}
+	nonce, err := randomBytes(l.gcm.NonceSize())
+	if err != nil {
+		return err
+	}
+	sealed := l.gcm.Seal(nonce, nonce, content, []byte(cid))
+	if l.maxBytes > 0 && int64(len(sealed)) > l.maxBytes {
+		return fmt.Errorf("content of %d bytes exceeds the local store limit", len(content))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Write and rename so a crash never leaves a partial copy
+	tmp, err := os.CreateTemp(l.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(sealed)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	l.enforceLimit(cid)
+	return nil
+}
+
+// Get returns the decrypted copy of a CID, or errNoLocalCopy
+func (l *LocalStore) Get(cid string) ([]byte, error) {
+	path, err := l.path(cid)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoLocalCopy
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := l.gcm.NonceSize()
+	if len(sealed) < size {
+		return nil, fmt.Errorf("local copy of %s is corrupt", cid)
+	}
+	content, err := l.gcm.Open(nil, sealed[:size], sealed[size:], []byte(cid))
+	if err != nil {
+		return nil, fmt.Errorf("local copy of %s is corrupt or was written with another key", cid)
+	}
+	return content, nil
+}
+
+// Usage returns the number and total size of the local copies
+func (l *LocalStore) Usage() LocalStoreUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	usage := LocalStoreUsage{MaxBytes: l.maxBytes}
+	for _, e := range l.entries() {
+		usage.Files++
+		usage.Bytes += e.size
+	}
+	return usage
+}
+
+type localEntry struct {
+	name string
+	size int64
+	mod  int64
+}
+
+// entries lists the stored copies, oldest first. Callers must hold mu.
+func (l *LocalStore) entries() []localEntry {
+	dirEntries, err := os.ReadDir(l.dir)
+	if err != nil {
+		log.Printf("Failed to list local store: %v", err)
+		return nil
+	}
+	var entries []localEntry
+	for _, d := range dirEntries {
+		if d.IsDir() || !isValidCID(d.Name()) {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, localEntry{name: d.Name(), size: info.Size(), mod: info.ModTime().UnixNano()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mod < entries[j].mod })
+	return entries
+}
+
+// enforceLimit deletes the oldest copies, other than keep, until the store
+// fits in maxBytes. Callers must hold mu.
+func (l *LocalStore) enforceLimit(keep string) {
+	if l.maxBytes <= 0 {
+		return
+	}
+	entries := l.entries()
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	for _, e := range entries {
+		if total <= l.maxBytes {
+			return
+		}
+		if e.name == keep {
+			continue
+		}
+		if err := os.Remove(filepath.Join(l.dir, e.name)); err != nil {
+			log.Printf("Failed to remove local copy %s: %v", e.name, err)
+			continue
+		}
+		total -= e.size
+	}
+}
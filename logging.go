@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupLogging makes a leveled slog logger the default. The standard log
+// package writes through it at info level, so existing log.Printf calls
+// are silenced by LOG_LEVEL=warn or error.
+func setupLogging(level string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})))
+	return nil
+}
+
+// parseLogLevel parses a LOG_LEVEL value
+func parseLogLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return lvl, fmt.Errorf("unknown LOG_LEVEL %q (expected debug, info, warn or error)", level)
+	}
+	return lvl, nil
+}
+
+// requestLogger logs requests like gin's default logger, except those to
+// one of skipPaths
+func requestLogger(skipPaths []string) gin.HandlerFunc {
+	logger := gin.Logger()
+	return func(c *gin.Context) {
+		if skipLogging(c.Request.URL.Path, skipPaths) {
+			c.Next()
+			return
+		}
+		logger(c)
+	}
+}
+
+// skipLogging reports whether path is one of skipPaths, or below one
+// ending in "/*"
+func skipLogging(path string, skipPaths []string) bool {
+	for _, skip := range skipPaths {
+		if prefix, ok := strings.CutSuffix(skip, "*"); ok && strings.HasSuffix(prefix, "/") {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == skip {
+			return true
+		}
+	}
+	return false
+}
+
+// fatal logs msg at error level, which no LOG_LEVEL hides, and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+const redacted = "[REDACTED]"
+
+var (
+	// DIDs name the space and its agents: did:key:z6Mk..., did:web:...
+	didPattern = regexp.MustCompile(`\bdid:[a-z0-9]+:[A-Za-z0-9._:%-]+`)
+
+	// Credentials given as key=value or "key": "value"
+	secretAssignmentPattern = regexp.MustCompile(`(?i)("?(?:private[_-]?key|secret|token|password|proof|authorization)"?\s*[:=]\s*"?)([^\s",}]+)`)
+
+	// Bearer credentials in headers echoed by the CLI
+	bearerPattern = regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`)
+
+	// Long base64 or hex runs: private keys (Mg...), UCAN proofs, tokens
+	longTokenPattern = regexp.MustCompile(`[A-Za-z0-9+/_=-]{40,}`)
+)
+
+// redactedValues are configured secrets, such as gateway tokens, masked
+// wherever they appear in text bound for the logs
+var redactedValues []string
+
+// redactValues adds secrets for redactSecrets to mask. It must be called
+// before the server starts.
+func redactValues(values ...string) {
+	for _, v := range values {
+		if v != "" {
+			redactedValues = append(redactedValues, v)
+		}
+	}
+}
+
+// redactSecrets masks DIDs, keys, tokens and configured secrets in text
+// bound for the logs, such as CLI output. CIDs are kept so uploads can
+// still be traced.
+func redactSecrets(s string) string {
+	for _, v := range redactedValues {
+		s = strings.ReplaceAll(s, v, redacted)
+	}
+	s = didPattern.ReplaceAllString(s, "did:"+redacted)
+	s = bearerPattern.ReplaceAllString(s, "Bearer "+redacted)
+	s = secretAssignmentPattern.ReplaceAllString(s, "${1}"+redacted)
+	return longTokenPattern.ReplaceAllStringFunc(s, func(token string) string {
+		if isTraceablePath(token) {
+			return token
+		}
+		return redacted
+	})
+}
+
+// isTraceablePath reports whether a long token is made only of CIDs and
+// short path segments, like "/ipfs/bafy...", rather than being key material
+func isTraceablePath(token string) bool {
+	for _, segment := range strings.Split(token, "/") {
+		switch {
+		case isValidCID(segment), strings.HasPrefix(segment, placeholderCIDPrefix):
+		case len(segment) < 16 && strings.Trim(segment, "abcdefghijklmnopqrstuvwxyz_-") == "":
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSkipLogging(t *testing.T) {
+	skipPaths := []string{"/api/health", "/metrics", "/api/jobs/*"}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/api/health", true},
+		{"/metrics", true},
+		{"/api/jobs/abc", true},
+		{"/api/jobs/abc/events", true},
+		{"/api/health/deep", false}, // Only paths ending in "/*" cover subpaths
+		{"/api/jobs", false},
+		{"/api/healthz", false},
+		{"/api/upload", false},
+	}
+	for _, tt := range tests {
+		if got := skipLogging(tt.path, skipPaths); got != tt.want {
+			t.Errorf("skipLogging(%q) = %t, want %t", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRequestLoggerSkipsPaths(t *testing.T) {
+	var logged bytes.Buffer
+	defaultWriter := gin.DefaultWriter
+	gin.DefaultWriter = &logged
+	t.Cleanup(func() { gin.DefaultWriter = defaultWriter })
+
+	router := gin.New()
+	router.Use(requestLogger([]string{"/api/health", "/api/jobs/*"}))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.GET("/api/health", ok)
+	router.GET("/api/jobs/:id", ok)
+	router.GET("/api/files", ok)
+
+	for _, path := range []string{"/api/health", "/api/jobs/abc"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if logged.Len() != 0 {
+			t.Fatalf("request to %s was logged: %s", path, logged.String())
+		}
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/files", nil))
+	if lines := strings.Count(logged.String(), "\n"); lines != 1 || !strings.Contains(logged.String(), "/api/files") {
+		t.Errorf("log = %q, want one line for /api/files", logged.String())
+	}
+}
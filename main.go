@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 func main() {
@@ -17,73 +27,293 @@ func main() {
 	}
 
 	// Initialize configuration
-	cfg := LoadConfig()
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	if err := setupLogging(cfg.LogLevel); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	for _, value := range cfg.GatewayHeaders {
+		redactValues(value)
+	}
+
+	if cfg.MaxFileSize <= 0 {
+		slog.Warn("MAX_FILE_SIZE is not set to a positive size, files are limited only by MAX_REQUEST_BYTES",
+			"maxRequestBytes", cfg.MaxRequestBytes)
+	}
+
+	if err := registerContentTypes(cfg.ContentTypesByExtension); err != nil {
+		fatal("Invalid CONTENT_TYPES_BY_EXTENSION", "error", err)
+	}
+
+	// Tracing stays a no-op unless a collector is configured
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.OTLPEndpoint != "" {
+		if shutdownTracing, err = setupTracing(context.Background()); err != nil {
+			fatal("Failed to set up tracing", "error", err)
+		}
+	}
 
 	// Initialize storage service
-	storage, err := NewStorageService(cfg)
+	storage, err := NewStorage(cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize storage service: %v", err)
+		fatal("Failed to initialize storage service", "error", err)
+	}
+	if cfg.StorageBackend == StorageBackendLocal {
+		log.Printf("Storing content locally in %s", cfg.StorageDir)
 	}
 
 	// Initialize file repository (in-memory for demo, use database in production)
 	fileRepo := NewFileRepository()
+	fileRepo.SetMaxStoredFiles(cfg.MaxStoredFiles)
+	if cfg.SnapshotPath != "" {
+		if err := fileRepo.LoadSnapshot(cfg.SnapshotPath); err == nil {
+			log.Printf("Loaded repository snapshot from %s", cfg.SnapshotPath)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			fatal("Failed to load repository snapshot", "path", cfg.SnapshotPath, "error", err)
+		}
+	}
 
 	// Initialize handlers
 	handler := NewHandler(storage, fileRepo, cfg)
 
 	// Setup Gin router
-	r := gin.Default()
-
-	// Trust only the proxy (Render uses reverse proxy)
-	// Set to nil to not trust any proxy, or specific IPs for your proxy
-	r.SetTrustedProxies(nil)
-
-	// CORS configuration for React frontend
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:5173", "http://localhost:3000", "https://*dec-filesharer.vercel.app"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		AllowOriginFunc: func(origin string) bool {
-			// Allow localhost and vercel deployments
-			return true
-		},
-		MaxAge: 12 * time.Hour,
-	}))
+	r := gin.New()
+	r.Use(requestLogger(cfg.LogSkipPaths), gin.Recovery())
+
+	// Trust only the configured proxies (Render uses a reverse proxy) so
+	// ClientIP, used by per-link IP allowlists, can't be spoofed
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		fatal("Invalid TRUSTED_PROXIES", "error", err)
+	}
+
+	// Tag every request with an ID that error responses and logs refer to
+	r.Use(requestID())
+
+	if cfg.OTLPEndpoint != "" {
+		r.Use(otelgin.Middleware(serviceName))
+	}
+
+	// CORS configuration for React frontend. The allowed methods default to
+	// those of the routes, which are only known once they're registered, so
+	// the middleware is created after the routes below.
+	corsConfig, err := newCORSConfig(cfg)
+	if err != nil {
+		fatal("Invalid CORS configuration", "error", err)
+	}
+	var corsHandler gin.HandlerFunc
+	r.Use(func(c *gin.Context) { corsHandler(c) })
+
+	if cfg.CompressResponses {
+		r.Use(compressResponses(cfg.CompressMinBytes))
+	}
 
 	// API routes
-	api := r.Group("/api")
+	registerRoutes(r.Group("/api"), handler, cfg)
+
+	if len(corsConfig.AllowMethods) == 0 {
+		corsConfig.AllowMethods = routeMethods(r.Routes())
+	}
+	corsHandler = cors.New(corsConfig)
+
+	// Stop background work and the server on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.AvailabilityCheckInterval > 0 {
+		go NewAvailabilityChecker(storage, fileRepo, cfg).Run(ctx)
+	}
+	go NewRevocationReconciler(storage, fileRepo, cfg).Run(ctx)
+	if cfg.SnapshotPath != "" {
+		go fileRepo.RunSnapshots(ctx, cfg.SnapshotPath, cfg.SnapshotInterval)
+	}
+
+	// Get port from environment or use default
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           r,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+
+	go func() {
+		log.Printf("Starting server on port %s", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("Failed to start server", "error", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Printf("Shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown error: %v", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("Tracing shutdown error: %v", err)
+	}
+
+	// Save once more after in-flight requests finish so a clean shutdown
+	// loses nothing
+	if cfg.SnapshotPath != "" {
+		if err := fileRepo.SaveSnapshot(cfg.SnapshotPath); err != nil {
+			log.Printf("Final snapshot failed: %v", err)
+		}
+	}
+}
+
+// registerRoutes registers the API's routes and their middleware on api
+func registerRoutes(api *gin.RouterGroup, handler *Handler, cfg *Config) {
+	apiKey := requireAPIKey(cfg.APIKeys)
+	identify := identifyAPIKey(cfg.APIKeys)
+	admin := requireAdmin(cfg.AdminUser, cfg.AdminPass)
+	stream := extendDeadlines(cfg.StreamTimeout)
+	uploadKeys := NewIdempotencyStore(cfg.IdempotencyKeyTTL)
 	{
 		// File upload and management
-		api.POST("/upload", handler.Upload)
-		api.POST("/register", handler.RegisterFile) // Register file with CID from frontend
+		api.POST("/upload", stream, limitRequestBody(cfg.MaxRequestBytes), identify, idempotent(uploadKeys), handler.Upload)
+		api.POST("/upload/from-url", stream, identify, handler.UploadFromURL)
+		api.POST("/upload/directory", stream, limitRequestBody(cfg.MaxRequestBytes), identify, handler.UploadDirectory)
+		api.GET("/upload/params", apiKey, handler.UploadParams)
+		api.GET("/jobs/:id", handler.GetJob)
+		api.GET("/jobs/:id/events", stream, handler.JobEvents)
+		api.POST("/register", identify, handler.RegisterFile) // Register file with CID from frontend
 		api.GET("/files", handler.ListFiles)
 		api.GET("/files/:id", handler.GetFile)
-		api.DELETE("/files/:id", handler.DeleteFile)
+		api.PATCH("/files/:id", handler.UpdateFile)
+		if cfg.DeleteFromStorage {
+			// Deleting also removes the stored content, which needs a key
+			api.DELETE("/files/:id", apiKey, handler.DeleteFile)
+		} else {
+			api.DELETE("/files/:id", handler.DeleteFile)
+		}
+		api.GET("/files/:id/content", stream, apiKey, handler.FileContent)
+		api.POST("/files/:id/repin", apiKey, handler.RepinFile)
+		api.POST("/files/:id/publish", stream, apiKey, handler.PublishFile)
 
 		// Share link management with UCAN delegations
 		api.POST("/files/:id/share", handler.CreateShareLink)
+		api.GET("/files/:id/share/latest", handler.LatestShareLink)
+		api.GET("/files/:id/shares", handler.ListFileShareLinks)
+		api.DELETE("/files/:id/shares", apiKey, handler.RevokeFileShareLinks)
 		api.GET("/share/:token", handler.GetSharedFile)
+		api.HEAD("/share/:token", handler.HeadSharedFile)
+		shareRoute(api, handler, "download", stream, handler.DownloadSharedFile)
+		shareRoute(api, handler, "analytics", apiKey, handler.ShareLinkAnalytics)
+		shareRoute(api, handler, "ls", handler.ListSharedDirectory)
+		shareRoute(api, handler, "preview", handler.PreviewSharedFile)
+		shareRoute(api, handler, "poster", stream, handler.PosterSharedFile)
+		api.GET("/share/:token/:filename", stream, handler.DownloadSharedFile)
 		api.DELETE("/share/:token", handler.RevokeShareLink)
 
 		// Delegation endpoint for client-side uploads
 		api.GET("/delegation/:did", handler.CreateDelegation)
+		api.POST("/delegation", apiKey, handler.CreateScopedDelegation)
+		api.GET("/whoami", identify, handler.WhoAmI)
+		api.GET("/cid/:cid", apiKey, handler.ProbeCID)
+		api.POST("/cid/check", apiKey, handler.CheckCIDs)
+
+		// Catalog backup
+		api.GET("/export", stream, apiKey, handler.ExportCatalog)
+		api.POST("/import", stream, apiKey, handler.ImportCatalog)
+
+		// Repository maintenance
+		api.POST("/admin/maintenance", admin, handler.RunMaintenance)
+		api.POST("/admin/expire-before", admin, handler.ExpireLinksBefore)
+
+		// Operational statistics
+		api.GET("/stats", admin, handler.Stats)
+
+		// Content of the local storage backend, served like a gateway
+		if cfg.StorageBackend == StorageBackendLocal {
+			api.GET(strings.TrimPrefix(localGatewayPath, "/api")+"/:cid/*path", stream, handler.LocalGatewayContent)
+			api.GET(strings.TrimPrefix(localGatewayPath, "/api")+"/:cid", stream, handler.LocalGatewayContent)
+		}
 
 		// Health check
 		api.GET("/health", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"status": "ok"})
 		})
 	}
+}
 
-	// Get port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+// shareRoute registers GET /share/:token/{name} and reserves name, so that
+// download URLs don't put a file called name where the route expects it
+func shareRoute(api *gin.RouterGroup, handler *Handler, name string, handlers ...gin.HandlerFunc) {
+	handler.shareRoutes[name] = true
+	api.GET("/share/:token/"+name, handlers...)
+}
+
+// devOrigins are the frontend origins allowed by default during development
+var devOrigins = []string{"http://localhost:5173", "http://localhost:3000", "https://*dec-filesharer.vercel.app"}
+
+// defaultCORSExposeHeaders are the response headers browser code needs to
+// handle downloads (filename, resuming, verification) and report errors
+var defaultCORSExposeHeaders = []string{
+	"Content-Length", "Content-Disposition", "Content-Range", "Accept-Ranges", "ETag",
+	"Digest", "X-File-CID", "X-Share-Status", previewTruncatedHeader, idempotentReplayedHeader,
+	requestIDHeader,
+}
+
+// newCORSConfig builds the CORS policy for the configured environment. In dev
+// any origin is accepted; in prod only the explicitly listed origins are.
+func newCORSConfig(cfg *Config) (cors.Config, error) {
+	corsConfig := cors.Config{
+		AllowMethods: cfg.CORSAllowMethods,
+		AllowHeaders: []string{"Origin", "Content-Type", "Authorization", "Range",
+			apiKeyHeader, requestIDHeader, sharePasswordHeader, idempotencyKeyHeader},
+		ExposeHeaders:    cfg.CORSExposeHeaders,
+		AllowCredentials: true,
+		AllowWildcard:    true,
+		MaxAge:           cfg.CORSMaxAge,
+	}
+
+	switch cfg.Environment {
+	case EnvDev:
+		corsConfig.AllowOrigins = devOrigins
+		if len(cfg.AllowedOrigins) > 0 {
+			corsConfig.AllowOrigins = cfg.AllowedOrigins
+		}
+		corsConfig.AllowOriginFunc = func(origin string) bool {
+			// Allow any origin (localhost, previews) during development
+			return true
+		}
+	case EnvProd:
+		if len(cfg.AllowedOrigins) == 0 {
+			return cors.Config{}, fmt.Errorf("ALLOWED_ORIGINS must be set when ENVIRONMENT=%s", EnvProd)
+		}
+		corsConfig.AllowOrigins = cfg.AllowedOrigins
+	default:
+		return cors.Config{}, fmt.Errorf("unknown ENVIRONMENT %q (expected %q or %q)", cfg.Environment, EnvDev, EnvProd)
 	}
 
-	log.Printf("Starting server on port %s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	return corsConfig, nil
+}
+
+// routeMethods returns the HTTP methods used by routes, plus OPTIONS for
+// preflight requests
+func routeMethods(routes gin.RoutesInfo) []string {
+	methods := []string{http.MethodOptions}
+	for _, route := range routes {
+		if !slices.Contains(methods, route.Method) {
+			methods = append(methods, route.Method)
+		}
 	}
+	sort.Strings(methods)
+	return methods
 }
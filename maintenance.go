@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MaintenanceReport summarizes a maintenance run
+type MaintenanceReport struct {
+	DryRun                  bool     `json:"dryRun"`
+	OrphanedShareLinks      int      `json:"orphanedShareLinks"`
+	ExpiredShareLinksPurged int      `json:"expiredShareLinksPurged"`
+	Inconsistencies         []string `json:"inconsistencies"`
+	Compacted               bool     `json:"compacted"`
+	DurationMs              int64    `json:"durationMs"`
+}
+
+// RunMaintenance removes share links whose file is gone, purges links that
+// expired more than ShareLinkRetention ago, reports inconsistencies and
+// compacts the repository. With dryRun=true nothing is changed and the
+// report shows what would have been removed.
+func (h *Handler) RunMaintenance(c *gin.Context) {
+	start := time.Now()
+	report := MaintenanceReport{
+		DryRun:          c.Query("dryRun") == "true",
+		Inconsistencies: []string{},
+	}
+
+	orphaned := h.fileRepo.FindOrphanedShareLinks()
+	expired := h.fileRepo.FindExpiredShareLinks(h.clock.Now().Add(-h.config.ShareLinkRetention))
+	report.OrphanedShareLinks = len(orphaned)
+	report.ExpiredShareLinksPurged = len(expired)
+
+	// Stored links should point at the content their file currently has
+	for _, link := range h.fileRepo.ListShareLinks() {
+		if file, exists := h.fileRepo.GetFile(link.FileID); exists && file.CID != link.CID {
+			report.Inconsistencies = append(report.Inconsistencies,
+				fmt.Sprintf("share link for file %s references CID %s, file has %s", link.FileID, link.CID, file.CID))
+		}
+	}
+	for _, file := range h.fileRepo.ListFiles(ListOptions{}) {
+		if isPlaceholderCID(file.CID) {
+			report.Inconsistencies = append(report.Inconsistencies,
+				fmt.Sprintf("file %s has placeholder CID %s", file.ID, file.CID))
+		}
+	}
+
+	if !report.DryRun {
+		report.OrphanedShareLinks = h.fileRepo.DeleteShareLinks(orphaned)
+		report.ExpiredShareLinksPurged = h.fileRepo.DeleteShareLinks(expired)
+		if err := h.fileRepo.Compact(); err != nil {
+			respondErrorf(c, http.StatusInternalServerError, CodeInternal, "Compaction failed: %v", err)
+			return
+		}
+		report.Compacted = true
+	}
+
+	report.DurationMs = time.Since(start).Milliseconds()
+	c.JSON(http.StatusOK, report)
+}
+
+// ExpireBeforeRequest is the request body of ExpireLinksBefore
+type ExpireBeforeRequest struct {
+	Before string `json:"before" binding:"required"` // RFC3339
+}
+
+// ExpireLinksBefore revokes every active share link created before a given
+// time, e.g. to invalidate links handed out before a key rotation.
+// Stateless links aren't stored and can only be invalidated by rotating
+// SHARE_SECRET.
+func (h *Handler) ExpireLinksBefore(c *gin.Context) {
+	var req ExpireBeforeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "Invalid request: "+err.Error())
+		return
+	}
+	before, err := time.Parse(time.RFC3339, req.Before)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeBadRequest, "before must be an RFC3339 timestamp")
+		return
+	}
+
+	revoked := h.fileRepo.RevokeCreatedBefore(before)
+	log.Printf("Audit: admin %s (%s) revoked %d share link(s) created before %s",
+		c.GetString(adminUserContextKey), c.ClientIP(), revoked, before.Format(time.RFC3339))
+
+	c.JSON(http.StatusOK, gin.H{
+		"revoked": revoked,
+		"message": fmt.Sprintf("Revoked %d share link(s) created before %s", revoked, before.Format(time.RFC3339)),
+	})
+}
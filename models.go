@@ -2,7 +2,15 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -11,11 +19,40 @@ import (
 type FileMetadata struct {
 	ID          string    `json:"id"`
 	Name        string    `json:"name"`
+	Folder      string    `json:"folder,omitempty"` // Slash-separated path, empty for the root
 	Size        int64     `json:"size"`
 	ContentType string    `json:"contentType"`
-	CID         string    `json:"cid"` // IPFS Content Identifier
+	CID         string    `json:"cid"`            // IPFS Content Identifier
+	Hash        string    `json:"hash,omitempty"` // Hex SHA-256 of the content, when uploaded through us
 	UploadedAt  time.Time `json:"uploadedAt"`
 	GatewayURL  string    `json:"gatewayUrl"`
+	UploadedBy  string    `json:"uploadedBy,omitempty"` // ID of the API key used to upload, if any
+
+	// User-supplied notes
+	Description string            `json:"description,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+
+	// Availability of the content on the gateway, as last verified
+	Available      bool       `json:"available"`
+	LastVerifiedAt *time.Time `json:"lastVerifiedAt,omitempty"`
+
+	// IPNS name the CID was published under, and the key of the local IPFS
+	// node that signs it
+	IPNSName string `json:"ipnsName,omitempty"`
+	IPNSKey  string `json:"ipnsKey,omitempty"`
+
+	// Uploaded directories are stored under one CID, their files found at
+	// {cid}/{path}
+	IsDirectory bool             `json:"isDirectory,omitempty"`
+	Entries     []DirectoryEntry `json:"entries,omitempty"`
+}
+
+// DirectoryEntry is a file of an uploaded directory
+type DirectoryEntry struct {
+	Path        string `json:"path"` // Slash-separated, relative to the directory
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	CID         string `json:"cid"` // CID of the file on its own
 }
 
 // ShareLink represents a shareable link with expiration
@@ -30,12 +67,68 @@ type ShareLink struct {
 	DelegationID string     `json:"delegationId,omitempty"` // UCAN delegation identifier
 	AccessCount  int        `json:"accessCount"`
 	MaxAccesses  int        `json:"maxAccesses,omitempty"` // 0 = unlimited
+
+	// Content downloads through the proxy, counted separately from views
+	DownloadCount int `json:"downloadCount"`
+	MaxDownloads  int `json:"maxDownloads,omitempty"` // 0 = unlimited
+
+	// Hosts the download proxy may be embedded on, matched against the
+	// Referer/Origin header. Empty allows any site.
+	AllowedReferers []string `json:"allowedReferers,omitempty"`
+
+	// Client IPs or CIDR ranges allowed to use the link. Empty allows all.
+	AllowedIPs []string `json:"allowedIps,omitempty"`
+
+	// Set when CID holds a password-encrypted copy of the file
+	Encryption *ShareEncryption `json:"encryption,omitempty"`
+
+	// Sliding links stay valid for ExtendBy (in nanoseconds) after each
+	// view, but never beyond MaxShareTTL after creation
+	SlidingExpiry bool          `json:"slidingExpiry,omitempty"`
+	ExtendBy      time.Duration `json:"extendBy,omitempty"`
+
+	// Set when the link was revoked locally but publishing the revocation
+	// of its delegation failed; the RevocationReconciler retries it
+	RevocationPending bool `json:"revocationPending,omitempty"`
 }
 
 // ShareLinkRequest is the request body for creating a share link
 type ShareLinkRequest struct {
-	ExpiresIn   string `json:"expiresIn"`   // Duration string like "24h", "7d"
-	MaxAccesses int    `json:"maxAccesses"` // Maximum number of accesses (0 = unlimited)
+	ExpiresIn    string `json:"expiresIn"`    // Duration string like "24h", "7d" (default DEFAULT_SHARE_EXPIRATION)
+	MaxAccesses  *int   `json:"maxAccesses"`  // Maximum number of accesses (0 = unlimited, default DEFAULT_MAX_ACCESSES)
+	MaxDownloads int    `json:"maxDownloads"` // Maximum number of content downloads (0 = unlimited)
+
+	// Hosts or origins allowed to embed the download, e.g. "example.com",
+	// ".example.com" (any subdomain) or "https://example.com"
+	AllowedReferers []string `json:"allowedReferers"`
+
+	// IPs or CIDR ranges allowed to use the link, e.g. "203.0.113.0/24"
+	AllowedIPs []string `json:"allowedIps"`
+
+	// Encrypts the shared copy under this password (requires ENCRYPT_SHARES)
+	Password string `json:"password"`
+
+	// Keeps the link valid for extendBy (default expiresIn) after each view
+	SlidingExpiry bool   `json:"slidingExpiry"`
+	ExtendBy      string `json:"extendBy"`
+}
+
+// UpdateFileRequest is the request body for updating mutable file fields.
+// Omitted fields are left unchanged.
+type UpdateFileRequest struct {
+	Name        *string            `json:"name"`
+	Folder      *string            `json:"folder"` // "" moves the file to the root
+	Description *string            `json:"description"`
+	Metadata    *map[string]string `json:"metadata"` // Replaces all metadata
+}
+
+// UploadFromURLRequest is the request body for uploading a file from a URL
+type UploadFromURLRequest struct {
+	URL         string            `json:"url" binding:"required"`
+	Name        string            `json:"name"` // Defaults to the last path segment of the URL
+	Folder      string            `json:"folder"`
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
 }
 
 // UploadResponse is returned after successful upload
@@ -46,15 +139,25 @@ type UploadResponse struct {
 
 // ShareLinkResponse is returned when creating a share link
 type ShareLinkResponse struct {
-	ShareLink *ShareLink `json:"shareLink"`
-	URL       string     `json:"url"` // Full shareable URL
+	ShareLink   *ShareLink `json:"shareLink"`
+	URL         string     `json:"url"`         // Full shareable URL
+	DownloadURL string     `json:"downloadUrl"` // Download proxy URL ending in the filename
 }
 
 // FileRepository stores file metadata (in-memory for demo)
 type FileRepository struct {
 	files      map[string]*FileMetadata
 	shareLinks map[string]*ShareLink
+	cidRefs    map[string]int  // Number of files referencing each CID
+	removing   map[string]bool // CIDs whose content is being removed from storage
+	accessLog  map[string][]AccessLogEntry
+	maxFiles   int // Evict the oldest files beyond this many; 0 = unlimited
+	clock      Clock
 	mu         sync.RWMutex
+
+	// version counts changes to files and share links, starting from the
+	// creation time so a restarted server doesn't repeat versions
+	version uint64
 }
 
 // NewFileRepository creates a new file repository
@@ -62,17 +165,137 @@ func NewFileRepository() *FileRepository {
 	return &FileRepository{
 		files:      make(map[string]*FileMetadata),
 		shareLinks: make(map[string]*ShareLink),
+		cidRefs:    make(map[string]int),
+		removing:   make(map[string]bool),
+		accessLog:  make(map[string][]AccessLogEntry),
+		clock:      realClock{},
+		version:    uint64(time.Now().UnixNano()),
+	}
+}
+
+// Version returns a number that changes whenever files or share links are
+// saved, updated or removed. Access and download counts don't change it.
+func (r *FileRepository) Version() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.version
+}
+
+// ErrDuplicateKey is returned when saving a record whose ID or token is
+// already taken. Callers generating keys should generate a new one and retry.
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// ErrContentRemoving is returned when saving a file whose content is being
+// removed from storage because the last file referencing it was deleted
+var ErrContentRemoving = errors.New("content is being removed from storage")
+
+// maxKeyAttempts is how many freshly generated keys are tried before giving up
+const maxKeyAttempts = 3
+
+// retryOnDuplicate calls insert, which must generate a new key on every
+// call, until it stops failing with ErrDuplicateKey
+func retryOnDuplicate(insert func() error) error {
+	var err error
+	for attempt := 0; attempt < maxKeyAttempts; attempt++ {
+		if err = insert(); !errors.Is(err, ErrDuplicateKey) {
+			return err
+		}
 	}
+	return err
 }
 
-// SaveFile stores file metadata
+// SetMaxStoredFiles bounds the number of stored files. Saving beyond the
+// limit evicts the oldest uploads along with their share links.
+func (r *FileRepository) SetMaxStoredFiles(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxFiles = n
+	if r.evictOldest() {
+		r.version++
+	}
+}
+
+// SaveFile stores new file metadata, failing with ErrDuplicateKey if the ID
+// is already in use
 func (r *FileRepository) SaveFile(file *FileMetadata) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if _, exists := r.files[file.ID]; exists {
+		return ErrDuplicateKey
+	}
+	if r.removing[file.CID] {
+		return ErrContentRemoving
+	}
 	r.files[file.ID] = file
+	r.cidRefs[file.CID]++
+	r.evictOldest()
+	r.version++
 	return nil
 }
 
+// PutFile stores file metadata, replacing any file with the same ID
+func (r *FileRepository) PutFile(file *FileMetadata) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, exists := r.files[file.ID]; exists {
+		r.releaseCID(old.CID)
+	}
+	r.files[file.ID] = file
+	r.cidRefs[file.CID]++
+	r.evictOldest()
+	r.version++
+}
+
+// evictOldest removes the least recently uploaded files, and their share
+// links, until the store is within maxFiles, reporting whether any were
+// evicted. Callers must hold the write lock.
+func (r *FileRepository) evictOldest() bool {
+	if r.maxFiles <= 0 {
+		return false
+	}
+	evicted := false
+	for len(r.files) > r.maxFiles {
+		var oldest *FileMetadata
+		for _, f := range r.files {
+			if oldest == nil || f.UploadedAt.Before(oldest.UploadedAt) {
+				oldest = f
+			}
+		}
+
+		delete(r.files, oldest.ID)
+		r.releaseCID(oldest.CID)
+		links := 0
+		for token, link := range r.shareLinks {
+			if link.FileID == oldest.ID {
+				delete(r.shareLinks, token)
+				delete(r.accessLog, token)
+				links++
+			}
+		}
+		log.Printf("Evicted file %s (uploaded %s) and %d share link(s): store limit of %d files reached",
+			oldest.ID, oldest.UploadedAt.Format(time.RFC3339), links, r.maxFiles)
+		evicted = true
+	}
+	return evicted
+}
+
+// refCountForCID returns how many files reference cid. Stored content may
+// only be removed once this drops to zero.
+func (r *FileRepository) refCountForCID(cid string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cidRefs[cid]
+}
+
+// releaseCID drops one reference to cid. Callers must hold the write lock.
+func (r *FileRepository) releaseCID(cid string) {
+	if r.cidRefs[cid] <= 1 {
+		delete(r.cidRefs, cid)
+		return
+	}
+	r.cidRefs[cid]--
+}
+
 // GetFile retrieves file metadata by ID
 func (r *FileRepository) GetFile(id string) (*FileMetadata, bool) {
 	r.mu.RLock()
@@ -81,36 +304,240 @@ func (r *FileRepository) GetFile(id string) (*FileMetadata, bool) {
 	return file, exists
 }
 
-// ListFiles returns all files
-func (r *FileRepository) ListFiles() []*FileMetadata {
+// ListOptions filters the files returned by ListFiles. All set filters
+// must match (AND); zero values don't filter.
+type ListOptions struct {
+	From time.Time // Uploaded at or after
+	To   time.Time // Uploaded before
+
+	Query string // Case-insensitive substring of the name or description
+
+	After *FileCursor // Only files listed after this position
+	Limit int         // Files returned at most (0 = unlimited)
+}
+
+// FileCursor is a position in the ListFiles order, that of the file with
+// this upload time and ID
+type FileCursor struct {
+	UploadedAt time.Time
+	ID         string
+}
+
+// before reports whether f comes after the cursor in the ListFiles order
+func (cur *FileCursor) before(f *FileMetadata) bool {
+	if !f.UploadedAt.Equal(cur.UploadedAt) {
+		return f.UploadedAt.Before(cur.UploadedAt)
+	}
+	return f.ID > cur.ID
+}
+
+// Matches reports whether f passes every filter in o
+func (o ListOptions) Matches(f *FileMetadata) bool {
+	if !o.From.IsZero() && f.UploadedAt.Before(o.From) {
+		return false
+	}
+	if !o.To.IsZero() && !f.UploadedAt.Before(o.To) {
+		return false
+	}
+	if o.Query != "" && !matchesQuery(f, o.Query) {
+		return false
+	}
+	if o.After != nil && !o.After.before(f) {
+		return false
+	}
+	return true
+}
+
+// ListFiles returns the files matching opts, newest first, with ties
+// broken by ID so the order is the same on every call
+func (r *FileRepository) ListFiles(opts ListOptions) []*FileMetadata {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	files := make([]*FileMetadata, 0, len(r.files))
+	for _, f := range r.files {
+		if opts.Matches(f) {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].UploadedAt.Equal(files[j].UploadedAt) {
+			return files[i].UploadedAt.After(files[j].UploadedAt)
+		}
+		return files[i].ID < files[j].ID
+	})
+	if opts.Limit > 0 && len(files) > opts.Limit {
+		files = files[:opts.Limit]
+	}
+	return files
+}
+
+// UpdateFile applies fn to the stored metadata for id under the write lock.
+// It returns false when the file does not exist.
+func (r *FileRepository) UpdateFile(id string, fn func(*FileMetadata)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file, exists := r.files[id]
+	if !exists {
+		return false
+	}
+	cid := file.CID
+	fn(file)
+	if file.CID != cid {
+		r.releaseCID(cid)
+		r.cidRefs[file.CID]++
+	}
+	r.version++
+	return true
+}
+
+// FilesForVerification returns up to n files, least recently verified first
+// (never-verified files come before everything else)
+func (r *FileRepository) FilesForVerification(n int) []*FileMetadata {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	files := make([]*FileMetadata, 0, len(r.files))
 	for _, f := range r.files {
 		files = append(files, f)
 	}
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i].LastVerifiedAt, files[j].LastVerifiedAt
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return a.Before(*b)
+	})
+	if len(files) > n {
+		files = files[:n]
+	}
 	return files
 }
 
+// AvailabilityCounts returns how many files are currently marked available
+// and unavailable
+func (r *FileRepository) AvailabilityCounts() (available, unavailable int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, f := range r.files {
+		if f.Available {
+			available++
+		} else {
+			unavailable++
+		}
+	}
+	return available, unavailable
+}
+
+// Counts returns the number of stored files and share links
+func (r *FileRepository) Counts() (files, shareLinks int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.files), len(r.shareLinks)
+}
+
+// NameExistsInFolder reports whether a file with exactly this name is stored
+// in folder
+func (r *FileRepository) NameExistsInFolder(folder, name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, f := range r.files {
+		if f.Folder == folder && f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NameExists reports whether a file with exactly this name is stored in any
+// folder
+func (r *FileRepository) NameExists(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, f := range r.files {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // DeleteFile removes file metadata
 func (r *FileRepository) DeleteFile(id string) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if _, exists := r.files[id]; exists {
+	if file, exists := r.files[id]; exists {
 		delete(r.files, id)
+		r.releaseCID(file.CID)
+		r.version++
 		return true
 	}
 	return false
 }
 
-// SaveShareLink stores a share link
+// DeleteFileReleasingContent removes a file like DeleteFile and reports
+// whether it was the last file referencing its content. The content may
+// then be removed from storage: until ContentRemoved is called, saving a
+// file with the same CID fails with ErrContentRemoving rather than pointing
+// the new file at content about to disappear.
+func (r *FileRepository) DeleteFileReleasingContent(id string) (file *FileMetadata, last, exists bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file, exists = r.files[id]
+	if !exists {
+		return nil, false, false
+	}
+	delete(r.files, id)
+	r.releaseCID(file.CID)
+	r.version++
+	if r.cidRefs[file.CID] > 0 {
+		return file, false, true
+	}
+	r.removing[file.CID] = true
+	return file, true, true
+}
+
+// ContentRemoved ends the removal of a CID's content started by
+// DeleteFileReleasingContent, whether or not it succeeded
+func (r *FileRepository) ContentRemoved(cid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.removing, cid)
+}
+
+// FindByCID returns the files whose content has the given CID
+func (r *FileRepository) FindByCID(cid string) []*FileMetadata {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var files []*FileMetadata
+	for _, f := range r.files {
+		if f.CID == cid {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// SaveShareLink stores a new share link, failing with ErrDuplicateKey if
+// the token is already in use. Overwriting would hand the existing link's
+// holders access to a different file.
 func (r *FileRepository) SaveShareLink(link *ShareLink) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if _, exists := r.shareLinks[link.Token]; exists {
+		return ErrDuplicateKey
+	}
 	r.shareLinks[link.Token] = link
+	r.version++
 	return nil
 }
 
+// PutShareLink stores a share link, replacing any link with the same token
+func (r *FileRepository) PutShareLink(link *ShareLink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.shareLinks[link.Token] = link
+	r.version++
+}
+
 // GetShareLink retrieves a share link by token
 func (r *FileRepository) GetShareLink(token string) (*ShareLink, bool) {
 	r.mu.RLock()
@@ -119,13 +546,95 @@ func (r *FileRepository) GetShareLink(token string) (*ShareLink, bool) {
 	return link, exists
 }
 
-// IncrementAccessCount increments the access count for a share link
-func (r *FileRepository) IncrementAccessCount(token string) {
+// IncrementAccessCount increments the access count for a share link,
+// sliding its expiry forward (up to maxTTL after creation) if it has a
+// sliding expiry, and returns a snapshot of the link taken under the same
+// lock, so callers see the link exactly as it was after their own update.
+// The link is checked under that lock too: a link that may no longer be
+// used is left as it is and its status returned, so concurrent requests
+// can't take it past MaxAccesses.
+func (r *FileRepository) IncrementAccessCount(token string, maxTTL time.Duration) (ShareLink, AccessStatus, bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if link, exists := r.shareLinks[token]; exists {
-		link.AccessCount++
+	link, exists := r.shareLinks[token]
+	if !exists {
+		return ShareLink{}, AccessGranted, false
+	}
+	if status := linkAccessStatus(link, r.clock.Now()); status != AccessGranted {
+		return *link, status, true
+	}
+	link.AccessCount++
+	if link.SlidingExpiry {
+		expiresAt := r.clock.Now().Add(link.ExtendBy)
+		if limit := link.CreatedAt.Add(maxTTL); expiresAt.After(limit) {
+			expiresAt = limit
+		}
+		if expiresAt.After(link.ExpiresAt) {
+			link.ExpiresAt = expiresAt
+		}
+	}
+	return *link, AccessGranted, true
+}
+
+// IncrementDownloadCount increments the download count for a share link and
+// returns a snapshot of the updated link. Like IncrementAccessCount it
+// leaves a link that may no longer be used as it is and returns its status.
+func (r *FileRepository) IncrementDownloadCount(token string) (ShareLink, AccessStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	link, exists := r.shareLinks[token]
+	if !exists {
+		return ShareLink{}, AccessGranted, false
+	}
+	if status := linkAccessStatus(link, r.clock.Now()); status != AccessGranted {
+		return *link, status, true
 	}
+	link.DownloadCount++
+	return *link, AccessGranted, true
+}
+
+// RevokeShareLinksForFile revokes every active share link of a file in one
+// locked pass and returns copies of the links it revoked
+func (r *FileRepository) RevokeShareLinksForFile(fileID string) []ShareLink {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock.Now()
+	var revoked []ShareLink
+	for _, link := range r.shareLinks {
+		if link.FileID != fileID || link.IsRevoked || now.After(link.ExpiresAt) {
+			continue
+		}
+		link.IsRevoked = true
+		link.RevokedAt = &now
+		revoked = append(revoked, *link)
+	}
+	if len(revoked) > 0 {
+		r.version++
+	}
+	return revoked
+}
+
+// RevokeCreatedBefore revokes every active share link created before t in
+// one locked pass and returns how many it revoked. Publishing the
+// revocations of their delegations is left to the RevocationReconciler.
+func (r *FileRepository) RevokeCreatedBefore(t time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock.Now()
+	revoked := 0
+	for _, link := range r.shareLinks {
+		if !link.CreatedAt.Before(t) || link.IsRevoked || now.After(link.ExpiresAt) {
+			continue
+		}
+		link.IsRevoked = true
+		link.RevokedAt = &now
+		link.RevocationPending = true
+		revoked++
+	}
+	if revoked > 0 {
+		r.version++
+	}
+	return revoked
 }
 
 // RevokeShareLink marks a share link as revoked
@@ -133,58 +642,238 @@ func (r *FileRepository) RevokeShareLink(token string) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if link, exists := r.shareLinks[token]; exists {
-		now := time.Now()
+		now := r.clock.Now()
 		link.IsRevoked = true
 		link.RevokedAt = &now
+		r.version++
 		return true
 	}
 	return false
 }
 
-// GetShareLinksForFile returns all share links for a file
-func (r *FileRepository) GetShareLinksForFile(fileID string) []*ShareLink {
+// SetRevocationPending records whether the revocation of a link's
+// delegation still has to be published
+func (r *FileRepository) SetRevocationPending(token string, pending bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if link, exists := r.shareLinks[token]; exists {
+		link.RevocationPending = pending
+	}
+}
+
+// PendingRevocations returns copies of the links whose revocation still has
+// to be published
+func (r *FileRepository) PendingRevocations() []ShareLink {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var pending []ShareLink
+	for _, link := range r.shareLinks {
+		if link.RevocationPending {
+			pending = append(pending, *link)
+		}
+	}
+	return pending
+}
+
+// FindOrphanedShareLinks returns the tokens of share links whose file no
+// longer exists
+func (r *FileRepository) FindOrphanedShareLinks() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var tokens []string
+	for token, link := range r.shareLinks {
+		if _, exists := r.files[link.FileID]; !exists {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// FindExpiredShareLinks returns the tokens of share links that expired
+// before cutoff
+func (r *FileRepository) FindExpiredShareLinks(cutoff time.Time) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var tokens []string
+	for token, link := range r.shareLinks {
+		if link.ExpiresAt.Before(cutoff) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// DeleteShareLinks removes the given share links and returns how many existed
+func (r *FileRepository) DeleteShareLinks(tokens []string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deleted := 0
+	for _, token := range tokens {
+		if _, exists := r.shareLinks[token]; exists {
+			delete(r.shareLinks, token)
+			delete(r.accessLog, token)
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		r.version++
+	}
+	return deleted
+}
+
+// Compact reclaims storage space. The in-memory repository has nothing to
+// reclaim; database-backed repositories would VACUUM here.
+func (r *FileRepository) Compact() error {
+	return nil
+}
+
+// ListShareLinks returns all share links
+func (r *FileRepository) ListShareLinks() []*ShareLink {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	links := make([]*ShareLink, 0, len(r.shareLinks))
+	for _, link := range r.shareLinks {
+		links = append(links, link)
+	}
+	return links
+}
+
+// StorageUsedBy returns the total size of the files uploaded with an API key
+func (r *FileRepository) StorageUsedBy(keyID string) int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var total int64
+	for _, f := range r.files {
+		if f.UploadedBy == keyID {
+			total += f.Size
+		}
+	}
+	return total
+}
+
+// ShareLinkListOptions selects and pages the share links of a file
+type ShareLinkListOptions struct {
+	// Only links it accepts; nil accepts all. It runs under the repository's
+	// read lock and must not call back into the repository.
+	Filter func(*ShareLink) bool
+	Offset int
+	Limit  int // 0 = no limit
+}
+
+// GetShareLinksForFile returns copies of a file's share links selected by
+// opts, newest first, and the number of links matching the filter. The
+// links are filtered, sorted and copied under the read lock so concurrent
+// updates can't change them halfway through.
+func (r *FileRepository) GetShareLinksForFile(fileID string, opts ShareLinkListOptions) ([]ShareLink, int) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	links := make([]*ShareLink, 0)
 	for _, link := range r.shareLinks {
-		if link.FileID == fileID {
+		if link.FileID == fileID && (opts.Filter == nil || opts.Filter(link)) {
 			links = append(links, link)
 		}
 	}
-	return links
+	sort.Slice(links, func(i, j int) bool {
+		if !links[i].CreatedAt.Equal(links[j].CreatedAt) {
+			return links[i].CreatedAt.After(links[j].CreatedAt)
+		}
+		return links[i].Token < links[j].Token
+	})
+
+	total := len(links)
+	if opts.Offset >= total {
+		return []ShareLink{}, total
+	}
+	links = links[opts.Offset:]
+	if opts.Limit > 0 && len(links) > opts.Limit {
+		links = links[:opts.Limit]
+	}
+	page := make([]ShareLink, len(links))
+	for i, link := range links {
+		page[i] = *link
+	}
+	return page, total
+}
+
+// AccessesRemaining returns how many more accesses the link allows, or nil
+// when the link has no access limit
+func (l *ShareLink) AccessesRemaining() *int {
+	if l.MaxAccesses <= 0 {
+		return nil
+	}
+	remaining := l.MaxAccesses - l.AccessCount
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &remaining
+}
+
+// DownloadsRemaining returns how many more downloads the link allows, or nil
+// when downloads are unlimited
+func (l *ShareLink) DownloadsRemaining() *int {
+	if l.MaxDownloads <= 0 {
+		return nil
+	}
+	remaining := l.MaxDownloads - l.DownloadCount
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &remaining
 }
 
 // GenerateID generates a random ID
-func GenerateID() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return hex.EncodeToString(b)
+func GenerateID() (string, error) {
+	b, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Share token encodings. Both only produce URL-safe characters; base64url
+// yields tokens about a third shorter than hex for the same entropy.
+const (
+	TokenEncodingHex       = "hex"
+	TokenEncodingBase64URL = "base64url"
+)
+
+// minShareTokenBytes is the least randomness a share token may carry (128 bits)
+const minShareTokenBytes = 16
+
+// GenerateToken generates a random share token of n bytes in the given encoding
+func GenerateToken(n int, encoding string) (string, error) {
+	b, err := randomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	if encoding == TokenEncodingBase64URL {
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	}
+	return hex.EncodeToString(b), nil
 }
 
-// GenerateToken generates a random share token
-func GenerateToken() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return hex.EncodeToString(b)
+// randReader is the entropy source for IDs and tokens (replaceable in tests)
+var randReader io.Reader = rand.Reader
+
+// randomBytes reads n bytes from randReader, failing rather than returning
+// a partially filled (predictable) buffer
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	return b, nil
 }
 
 // ParseDuration parses a duration string with support for days
 func ParseDuration(s string) (time.Duration, error) {
 	// Handle days (e.g., "7d")
-	if len(s) > 1 && s[len(s)-1] == 'd' {
-		var days int
-		_, err := time.ParseDuration(s[:len(s)-1] + "h")
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
 		if err != nil {
-			// Try parsing as integer days
-			if n, err := time.ParseDuration("1h"); err == nil {
-				for i := 0; i < len(s)-1; i++ {
-					if s[i] >= '0' && s[i] <= '9' {
-						days = days*10 + int(s[i]-'0')
-					}
-				}
-				return time.Duration(days) * 24 * n, nil
-			}
+			return 0, fmt.Errorf("invalid duration %q", s)
 		}
+		return time.Duration(n) * 24 * time.Hour, nil
 	}
 	return time.ParseDuration(s)
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setRandReader replaces the entropy source of IDs and tokens for the test
+func setRandReader(t *testing.T, r io.Reader) {
+	t.Helper()
+	old := randReader
+	randReader = r
+	t.Cleanup(func() { randReader = old })
+}
+
+// failingReader fails every read, like an exhausted entropy source
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("entropy source unavailable")
+}
+
+func TestRandomnessFailure(t *testing.T) {
+	setRandReader(t, failingReader{})
+
+	if id, err := GenerateID(); err == nil || id != "" {
+		t.Errorf("GenerateID() = %q, %v; want an error", id, err)
+	}
+	for _, encoding := range []string{TokenEncodingHex, TokenEncodingBase64URL} {
+		if token, err := GenerateToken(32, encoding); err == nil || token != "" {
+			t.Errorf("GenerateToken(32, %s) = %q, %v; want an error", encoding, token, err)
+		}
+	}
+}
+
+func TestRandomnessFailureResponses(t *testing.T) {
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+	setRandReader(t, failingReader{})
+
+	w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", nil,
+		multipartFile{Name: "other.txt", Content: []byte("other")}))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("upload: status %d, body %s", w.Code, w.Body)
+	}
+
+	w = s.do(httptest.NewRequest(http.MethodPost, "/api/files/"+file.ID+"/share", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("share: status %d, body %s", w.Code, w.Body)
+	}
+	if _, total := s.handler.fileRepo.GetShareLinksForFile(file.ID, ShareLinkListOptions{}); total != 0 {
+		t.Errorf("%d share links were created", total)
+	}
+}
+
+// seededReader reads the pseudo-random stream of seed. With repeat set,
+// every Read starts the stream over, so that every ID or token of a given
+// length is the same.
+type seededReader struct {
+	seed   int64
+	repeat bool
+	stream *rand.Rand
+	reads  map[int]int // Number of reads by length
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	if r.reads == nil {
+		r.reads = make(map[int]int)
+	}
+	r.reads[len(p)]++
+	if r.stream == nil || r.repeat {
+		r.stream = rand.New(rand.NewSource(r.seed))
+	}
+	return r.stream.Read(p)
+}
+
+func TestDuplicateKeysRetried(t *testing.T) {
+	s := newTestServer(t, nil)
+	file := s.uploadTestFile("notes.txt", []byte("notes"))
+
+	// The same stream again makes the second link's first token the token
+	// of the first link
+	setRandReader(t, &seededReader{seed: 1})
+	first := s.createShareLink(file.ID, "")
+	reader := &seededReader{seed: 1}
+	setRandReader(t, reader)
+	second := s.createShareLink(file.ID, "")
+	if first.Token == second.Token {
+		t.Fatalf("both links got token %s", first.Token)
+	}
+	if tokens := reader.reads[s.config.ShareTokenBytes]; tokens != 2 {
+		t.Errorf("%d tokens generated for the second link, want 2", tokens)
+	}
+	for _, link := range []*ShareLink{first, second} {
+		if stored, ok := s.handler.fileRepo.GetShareLink(link.Token); !ok || stored.DelegationID != link.DelegationID {
+			t.Errorf("link %s wasn't stored", link.Token)
+		}
+	}
+
+	// When every attempt collides, creating the link fails after the
+	// last attempt and stores nothing
+	reader = &seededReader{seed: 2, repeat: true}
+	setRandReader(t, reader)
+	s.createShareLink(file.ID, "")
+	reader.reads = nil
+	w := s.do(httptest.NewRequest(http.MethodPost, "/api/files/"+file.ID+"/share", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, body %s", w.Code, w.Body)
+	}
+	if tokens := reader.reads[s.config.ShareTokenBytes]; tokens != maxKeyAttempts {
+		t.Errorf("%d tokens generated, want %d", tokens, maxKeyAttempts)
+	}
+	if _, total := s.handler.fileRepo.GetShareLinksForFile(file.ID, ShareLinkListOptions{}); total != 3 {
+		t.Errorf("%d share links, want 3", total)
+	}
+}
+
+func TestDuplicateFileIDsRetried(t *testing.T) {
+	s := newTestServer(t, nil)
+	setRandReader(t, &seededReader{seed: 1})
+	first := s.uploadTestFile("first.txt", []byte("first"))
+	setRandReader(t, &seededReader{seed: 1})
+	second := s.uploadTestFile("second.txt", []byte("second"))
+	if first.ID == second.ID {
+		t.Fatalf("both files got ID %s", first.ID)
+	}
+
+	setRandReader(t, &seededReader{seed: 2, repeat: true})
+	w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", nil,
+		multipartFile{Name: "third.txt", Content: []byte("third")}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	w = s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", nil,
+		multipartFile{Name: "fourth.txt", Content: []byte("fourth")}))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("upload with only taken IDs: status %d, body %s", w.Code, w.Body)
+	}
+	if files, _ := s.handler.fileRepo.Counts(); files != 3 {
+		t.Errorf("%d files stored, want 3", files)
+	}
+}
+
+func TestEvictOldestFiles(t *testing.T) {
+	repo := NewFileRepository()
+	repo.SetMaxStoredFiles(3)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Saved out of upload order, so eviction can't just follow insertion
+	for _, f := range []struct {
+		id  string
+		age time.Duration
+	}{{"middle", time.Hour}, {"oldest", 0}, {"newer", 2 * time.Hour}} {
+		file := &FileMetadata{ID: f.id, CID: "cid-" + f.id, UploadedAt: start.Add(f.age)}
+		if err := repo.SaveFile(file); err != nil {
+			t.Fatalf("SaveFile(%s): %v", f.id, err)
+		}
+		for _, suffix := range []string{"-a", "-b"} {
+			if err := repo.SaveShareLink(&ShareLink{Token: f.id + suffix, FileID: f.id}); err != nil {
+				t.Fatalf("SaveShareLink: %v", err)
+			}
+		}
+	}
+
+	stored := func() []string {
+		var ids []string
+		for _, id := range []string{"oldest", "middle", "newer", "newest"} {
+			if _, ok := repo.GetFile(id); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	if err := repo.SaveFile(&FileMetadata{ID: "newest", CID: "cid-newest", UploadedAt: start.Add(3 * time.Hour)}); err != nil {
+		t.Fatalf("SaveFile(newest): %v", err)
+	}
+	if got := stored(); !slices.Equal(got, []string{"middle", "newer", "newest"}) {
+		t.Errorf("after exceeding the limit, files = %v", got)
+	}
+	repo.SetMaxStoredFiles(2)
+	if got := stored(); !slices.Equal(got, []string{"newer", "newest"}) {
+		t.Errorf("after lowering the limit, files = %v", got)
+	}
+
+	for _, id := range []string{"oldest", "middle"} {
+		for _, suffix := range []string{"-a", "-b"} {
+			if _, ok := repo.GetShareLink(id + suffix); ok {
+				t.Errorf("share link %s%s of an evicted file remains", id, suffix)
+			}
+		}
+		if refs := repo.refCountForCID("cid-" + id); refs != 0 {
+			t.Errorf("evicted file %s still references its CID %d time(s)", id, refs)
+		}
+	}
+	if _, total := repo.GetShareLinksForFile("newer", ShareLinkListOptions{}); total != 2 {
+		t.Errorf("file newer has %d share links, want 2", total)
+	}
+}
+
+func TestDeleteFilesSharingContent(t *testing.T) {
+	repo := NewFileRepository()
+	for round := 0; round < 50; round++ {
+		for _, id := range []string{"a", "b"} {
+			if err := repo.SaveFile(&FileMetadata{ID: id, CID: "cid"}); err != nil {
+				t.Fatalf("round %d: SaveFile(%s): %v", round, id, err)
+			}
+		}
+		// Deleted concurrently, exactly one of the files releases the content
+		var wg sync.WaitGroup
+		var releases atomic.Int32
+		for _, id := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				if _, last, ok := repo.DeleteFileReleasingContent(id); ok && last {
+					releases.Add(1)
+				}
+			}(id)
+		}
+		wg.Wait()
+		if n := releases.Load(); n != 1 {
+			t.Fatalf("round %d: content released %d times", round, n)
+		}
+		if err := repo.SaveFile(&FileMetadata{ID: "c", CID: "cid"}); !errors.Is(err, ErrContentRemoving) {
+			t.Fatalf("round %d: saving during removal: %v", round, err)
+		}
+		repo.ContentRemoved("cid")
+	}
+}
+
+func TestListOrderStableWithEqualTimes(t *testing.T) {
+	repo := NewFileRepository()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	earlier := now.Add(-time.Minute)
+	for _, f := range []struct {
+		id string
+		at time.Time
+	}{{"e", earlier}, {"c", now}, {"a", now}, {"f", earlier}, {"b", now}, {"d", earlier}} {
+		if err := repo.SaveFile(&FileMetadata{ID: f.id, CID: "cid-" + f.id, UploadedAt: f.at}); err != nil {
+			t.Fatalf("SaveFile: %v", err)
+		}
+		for _, token := range []string{f.id + "3", f.id + "1", f.id + "2"} {
+			if err := repo.SaveShareLink(&ShareLink{Token: token, FileID: "a", CreatedAt: f.at}); err != nil {
+				t.Fatalf("SaveShareLink: %v", err)
+			}
+		}
+	}
+
+	want := []string{"a", "b", "c", "d", "e", "f"}
+	for i := 0; i < 5; i++ {
+		if got := fileIDs(repo.ListFiles(ListOptions{})); !slices.Equal(got, want) {
+			t.Fatalf("call %d: files = %v, want %v", i, got, want)
+		}
+	}
+	var paged []string
+	opts := ListOptions{Limit: 2}
+	for {
+		page := repo.ListFiles(opts)
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, fileIDs(page)...)
+		last := page[len(page)-1]
+		opts.After = &FileCursor{UploadedAt: last.UploadedAt, ID: last.ID}
+	}
+	if !slices.Equal(paged, want) {
+		t.Errorf("files by page = %v, want %v", paged, want)
+	}
+
+	var tokens []string
+	for offset := 0; ; offset += 4 {
+		page, total := repo.GetShareLinksForFile("a", ShareLinkListOptions{Offset: offset, Limit: 4})
+		if total != 18 {
+			t.Fatalf("total = %d, want 18", total)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, link := range page {
+			tokens = append(tokens, link.Token)
+		}
+	}
+	wantTokens := []string{"a1", "a2", "a3", "b1", "b2", "b3", "c1", "c2", "c3", "d1", "d2", "d3", "e1", "e2", "e3", "f1", "f2", "f3"}
+	if !slices.Equal(tokens, wantTokens) {
+		t.Errorf("share links by page = %v, want %v", tokens, wantTokens)
+	}
+}
+
+func fileIDs(files []*FileMetadata) []string {
+	ids := make([]string, len(files))
+	for i, f := range files {
+		ids[i] = f.ID
+	}
+	return ids
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Supported values for the NAME_COLLISION setting
+const (
+	CollisionAllow  = "allow"  // Keep duplicate names side by side
+	CollisionRename = "rename" // Append " (2)", " (3)", ... to the new name
+	CollisionReject = "reject" // Refuse the upload with 409
+)
+
+// maxCollisionSuffix bounds the search for a free " (n)" suffix
+const maxCollisionSuffix = 1000
+
+// normalizeFolder cleans a user-supplied folder path into the canonical
+// "a/b/c" form (no leading or trailing slash). The empty string is the root.
+func normalizeFolder(folder string) (string, error) {
+	folder = strings.TrimSpace(strings.ReplaceAll(folder, "\\", "/"))
+	if folder == "" {
+		return "", nil
+	}
+	for _, segment := range strings.Split(folder, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("folder may not contain '..'")
+		}
+	}
+	folder = strings.Trim(path.Clean("/"+folder), "/")
+	return folder, nil
+}
+
+// fallbackName names a file uploaded without a name after the configured
+// prefix, the upload time and its content type, e.g.
+// "upload-20240131-150405.png"
+func (h *Handler) fallbackName(contentType string) string {
+	return h.config.FallbackFilename + "-" + h.clock.Now().UTC().Format("20060102-150405") + extensionForType(contentType)
+}
+
+// resolveName applies the configured collision policy to name within folder,
+// or across all folders with UniqueFilenames, returning the name to store.
+// With UniqueFilenames the "allow" policy rejects duplicates.
+func (h *Handler) resolveName(folder, name string) (string, error) {
+	exists := func(name string) bool { return h.fileRepo.NameExistsInFolder(folder, name) }
+	scope := "this folder"
+	policy := h.config.OnNameCollision
+	if h.config.UniqueFilenames {
+		exists = h.fileRepo.NameExists
+		scope = "any folder"
+		if policy == CollisionAllow {
+			policy = CollisionReject
+		}
+	}
+
+	if policy == CollisionAllow || !exists(name) {
+		return name, nil
+	}
+
+	if policy == CollisionReject {
+		return "", newAPIError(http.StatusConflict, CodeNameConflict,
+			"A file named %q already exists in %s", name, scope)
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 2; n <= maxCollisionSuffix; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if !exists(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", newAPIError(http.StatusConflict, CodeNameConflict, "Too many files named %q in %s", name, scope)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFallbackName(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 32)...)
+	tests := []struct {
+		name    string
+		prefix  string
+		content []byte
+		want    string
+	}{
+		{name: "default prefix", content: png, want: "upload-20260131-150405.png"},
+		{name: "configured prefix", prefix: "scan", content: png, want: "scan-20260131-150405.png"},
+		{name: "binary", content: []byte{0xff, 0x00, 0xfe, 0x01}, want: "upload-20260131-150405.bin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(cfg *Config) {
+				if tt.prefix != "" {
+					cfg.FallbackFilename = tt.prefix
+				}
+			})
+			// In another zone, to check the name uses UTC
+			zone := time.FixedZone("UTC+2", 2*60*60)
+			s.handler.SetClock(newFakeClock(time.Date(2026, 1, 31, 17, 4, 5, 0, zone)))
+
+			// A blank filename counts as none
+			file := s.uploadTestFile(" ", tt.content)
+			if file.Name != tt.want {
+				t.Errorf("name = %q, want %q", file.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveName(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		unique   bool
+		existing map[string]string // Name to folder
+		upload   string
+		want     string // "" when rejected with 409
+	}{
+		{name: "allow keeps duplicates", policy: CollisionAllow, existing: map[string]string{"a.txt": ""}, upload: "a.txt", want: "a.txt"},
+		{name: "reject", policy: CollisionReject, existing: map[string]string{"a.txt": ""}, upload: "a.txt"},
+		{name: "reject other folder", policy: CollisionReject, existing: map[string]string{"a.txt": "docs"}, upload: "a.txt", want: "a.txt"},
+		{name: "rename", policy: CollisionRename, existing: map[string]string{"a.txt": ""}, upload: "a.txt", want: "a (2).txt"},
+		{name: "rename next free", policy: CollisionRename, existing: map[string]string{"a.txt": "", "a (2).txt": ""}, upload: "a.txt", want: "a (3).txt"},
+		{name: "rename without extension", policy: CollisionRename, existing: map[string]string{"README": ""}, upload: "README", want: "README (2)"},
+		{name: "unique turns allow into reject", policy: CollisionAllow, unique: true, existing: map[string]string{"a.txt": "docs"}, upload: "a.txt"},
+		{name: "unique rename across folders", policy: CollisionRename, unique: true, existing: map[string]string{"a.txt": "docs"}, upload: "a.txt", want: "a (2).txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(cfg *Config) {
+				cfg.OnNameCollision = tt.policy
+				cfg.UniqueFilenames = tt.unique
+			})
+			for name, folder := range tt.existing {
+				s.handler.fileRepo.SaveFile(&FileMetadata{ID: "existing-" + name, Name: name, Folder: folder})
+			}
+
+			w := s.do(newMultipartRequest(t, http.MethodPost, "/api/upload", nil,
+				multipartFile{Name: tt.upload, Content: []byte("new content")}))
+			if tt.want == "" {
+				if w.Code != http.StatusConflict {
+					t.Fatalf("status = %d, want 409, body %s", w.Code, w.Body)
+				}
+				var resp errorResponse
+				if decodeJSON(t, w, &resp); resp.Code != CodeNameConflict {
+					t.Errorf("code = %s, want %s", resp.Code, CodeNameConflict)
+				}
+				return
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body)
+			}
+			var resp uploadResponse
+			if decodeJSON(t, w, &resp); resp.Files[0].Name != tt.want {
+				t.Errorf("name = %q, want %q", resp.Files[0].Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveNameSuffixLimit(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.OnNameCollision = CollisionRename })
+	s.handler.fileRepo.SaveFile(&FileMetadata{ID: "base", Name: "a.txt"})
+	for n := 2; n < maxCollisionSuffix; n++ {
+		s.handler.fileRepo.SaveFile(&FileMetadata{ID: fmt.Sprint(n), Name: fmt.Sprintf("a (%d).txt", n)})
+	}
+	if name, err := s.handler.resolveName("", "a.txt"); err != nil || name != fmt.Sprintf("a (%d).txt", maxCollisionSuffix) {
+		t.Fatalf("with the last suffix free: %q, %v", name, err)
+	}
+
+	s.handler.fileRepo.SaveFile(&FileMetadata{ID: "last", Name: fmt.Sprintf("a (%d).txt", maxCollisionSuffix)})
+	_, err := s.handler.resolveName("", "a.txt")
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusConflict || apiErr.Code != CodeNameConflict {
+		t.Errorf("with every suffix taken: %v", err)
+	}
+}
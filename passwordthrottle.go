@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PasswordThrottle slows down password guessing on encrypted share links.
+// Each link refuses further attempts after maxFailures wrong passwords
+// within window, before any ciphertext is fetched or key derived, until its
+// oldest failure leaves the window. It also bounds how many scrypt
+// derivations, ~100ms and 32MB each, run at once. Unlike the abuse guard it
+// is always on.
+type PasswordThrottle struct {
+	maxFailures int
+	window      time.Duration
+	clock       Clock
+	slots       chan struct{}
+
+	mu       sync.Mutex
+	failures map[string][]time.Time // Recent failures by token, oldest first
+	records  int
+}
+
+// NewPasswordThrottle creates a throttle from cfg
+func NewPasswordThrottle(cfg *Config, clock Clock) *PasswordThrottle {
+	return &PasswordThrottle{
+		maxFailures: cfg.SharePasswordMaxFailures,
+		window:      cfg.SharePasswordWindow,
+		clock:       clock,
+		slots:       make(chan struct{}, max(cfg.MaxConcurrentPasswordChecks, 1)),
+		failures:    make(map[string][]time.Time),
+	}
+}
+
+// Allow reports whether a password may be tried for token, or else how
+// long until the next attempt is allowed
+func (t *PasswordThrottle) Allow(token string) (time.Duration, bool) {
+	if t.maxFailures <= 0 {
+		return 0, true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	failures := t.recent(token, now)
+	if len(failures) < t.maxFailures {
+		return 0, true
+	}
+	return failures[0].Add(t.window).Sub(now), false
+}
+
+// Failed records a wrong password for token
+func (t *PasswordThrottle) Failed(token string) {
+	if t.maxFailures <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	t.records++
+	if t.records%sweepEvery == 0 {
+		for other := range t.failures {
+			t.recent(other, now)
+		}
+	}
+	failures := append(t.recent(token, now), now)
+	// Only the latest maxFailures matter to Allow
+	if len(failures) > t.maxFailures {
+		failures = failures[len(failures)-t.maxFailures:]
+	}
+	t.failures[token] = failures
+}
+
+// recent drops the failures of token that left the window and returns the
+// rest
+func (t *PasswordThrottle) recent(token string, now time.Time) []time.Time {
+	failures := t.failures[token]
+	cutoff := now.Add(-t.window)
+	i := 0
+	for i < len(failures) && !failures[i].After(cutoff) {
+		i++
+	}
+	if i == len(failures) {
+		delete(t.failures, token)
+		return nil
+	}
+	failures = failures[i:]
+	t.failures[token] = failures
+	return failures
+}
+
+// Acquire waits for a key derivation slot. The returned function releases
+// it.
+func (t *PasswordThrottle) Acquire(ctx context.Context) (func(), error) {
+	select {
+	case t.slots <- struct{}{}:
+		return func() { <-t.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
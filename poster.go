@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// posterTimeout bounds a single ffmpeg run
+const posterTimeout = 30 * time.Second
+
+// maxCachedPosters bounds the poster cache; the oldest entry goes first
+const maxCachedPosters = 256
+
+// derivedCache keeps content derived from a CID, such as posters, keyed by
+// the CID. Content behind a CID never changes, so entries never go stale.
+type derivedCache struct {
+	mu     sync.Mutex
+	max    int
+	images map[string][]byte
+	order  []string
+}
+
+func newDerivedCache(max int) *derivedCache {
+	return &derivedCache{max: max, images: make(map[string][]byte)}
+}
+
+func (p *derivedCache) get(key string) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	image, ok := p.images[key]
+	return image, ok
+}
+
+func (p *derivedCache) put(key string, image []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.images[key]; exists {
+		return
+	}
+	if len(p.order) >= p.max {
+		delete(p.images, p.order[0])
+		p.order = p.order[1:]
+	}
+	p.images[key] = image
+	p.order = append(p.order, key)
+}
+
+// isVideoType reports whether a content type is video
+func isVideoType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.HasPrefix(mediaType, "video/")
+}
+
+// PosterSharedFile serves a JPEG of the first frame of a shared video. Only
+// the first PosterFetchBytes of the video are fetched, which is enough for
+// formats that keep their index at the start (most streaming-ready MP4 and
+// WebM files). Without ffmpeg, or for other content, it returns 415.
+func (h *Handler) PosterSharedFile(c *gin.Context) {
+	shareLink, ok := h.lookupShareLink(c, c.Param("token"))
+	if !ok {
+		return
+	}
+
+	file, exists := h.fileRepo.GetFile(shareLink.FileID)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File no longer exists")
+		return
+	}
+	if !isVideoType(file.ContentType) {
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Posters are only available for videos")
+		return
+	}
+	if shareLink.Encryption != nil {
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Posters are not available for encrypted shares")
+		return
+	}
+	ffmpeg, err := exec.LookPath(h.config.FFmpegPath)
+	if err != nil {
+		respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Poster extraction is not available on this server")
+		return
+	}
+
+	image, cached := h.posters.get(shareLink.CID)
+	if !cached {
+		image, err = h.extractPoster(c.Request.Context(), ffmpeg, shareLink.CID, file.ContentType)
+		if err != nil {
+			respondAPIError(c, err)
+			return
+		}
+		h.posters.put(shareLink.CID, image)
+	}
+
+	secureDownloadHeaders(c, "image/jpeg")
+	c.Data(http.StatusOK, "image/jpeg", image)
+}
+
+// extractPoster fetches the start of a video and has ffmpeg decode its
+// first frame as a JPEG
+func (h *Handler) extractPoster(ctx context.Context, ffmpeg, cid, contentType string) ([]byte, error) {
+	limit := h.config.PosterFetchBytes
+	content, err := h.storage.FetchFromGateway(ctx, cid, FetchOptions{
+		Range:       fmt.Sprintf("bytes=0-%d", limit-1),
+		ContentType: contentType,
+	})
+	if err != nil {
+		return nil, fetchError(err)
+	}
+	defer content.Body.Close()
+
+	// ffmpeg needs to seek in some containers, so give it a file, not a pipe
+	tmp, err := os.CreateTemp("", "poster-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, io.LimitReader(content.Body, limit))
+	tmp.Close()
+	if err != nil {
+		return nil, newAPIError(http.StatusBadGateway, CodeGatewayError, "Failed to read content: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, posterTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, "-v", "error", "-i", tmp.Name(),
+		"-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil || stdout.Len() == 0 {
+		log.Printf("Poster extraction failed for %s: %v: %s", cid, err, strings.TrimSpace(stderr.String()))
+		return nil, newAPIError(http.StatusUnprocessableEntity, CodeUnsupportedMediaType,
+			"Could not extract a poster from the beginning of this video")
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// previewTruncatedHeader tells clients whether the preview was cut short
+const previewTruncatedHeader = "X-Preview-Truncated"
+
+// isTextLike reports whether content of this type can be shown as text
+func isTextLike(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/xml",
+		"application/javascript", "application/x-yaml", "application/yaml",
+		"application/toml", "application/x-sh":
+		return true
+	}
+	return false
+}
+
+// PreviewSharedFile returns the beginning of a shared text file as plain
+// text so the UI can show it without a download. At most PreviewMaxBytes
+// are fetched from the gateway; other content types get 415.
+func (h *Handler) PreviewSharedFile(c *gin.Context) {
+	shareLink, ok := h.lookupShareLink(c, c.Param("token"))
+	if !ok {
+		return
+	}
+
+	file, exists := h.fileRepo.GetFile(shareLink.FileID)
+	if !exists {
+		respondError(c, http.StatusNotFound, CodeNotFound, "File no longer exists")
+		return
+	}
+	if file.ContentType != "" && !isTextLike(file.ContentType) {
+		respondErrorf(c, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType,
+			"Preview is only available for text files, not %s", file.ContentType)
+		return
+	}
+
+	limit := h.config.PreviewMaxBytes
+	var data []byte
+	if shareLink.Encryption != nil {
+		// Ciphertext can't be read partially; decrypt all and cut it below
+		if file.ContentType == "" {
+			respondError(c, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType,
+				"Preview is only available for text files")
+			return
+		}
+		plaintext, ok := h.decryptSharedContent(c, shareLink)
+		if !ok {
+			return
+		}
+		data = plaintext
+	} else {
+		// Ask for one byte more than we show to learn whether there is more
+		content, err := h.storage.FetchFromGateway(c.Request.Context(), shareLink.CID,
+			FetchOptions{Range: fmt.Sprintf("bytes=0-%d", limit), Gateway: h.clientGateway(c), ContentType: file.ContentType})
+		if err != nil {
+			respondAPIError(c, fetchError(err))
+			return
+		}
+		defer content.Body.Close()
+
+		if file.ContentType == "" && !isTextLike(content.ContentType) {
+			respondErrorf(c, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType,
+				"Preview is only available for text files, not %s", content.ContentType)
+			return
+		}
+
+		// The gateway may ignore the range and send everything; read no further
+		data, err = io.ReadAll(io.LimitReader(content.Body, limit+1))
+		if err != nil {
+			respondErrorf(c, http.StatusBadGateway, CodeGatewayError, "Failed to read content: %v", err)
+			return
+		}
+	}
+
+	truncated := int64(len(data)) > limit
+	if truncated {
+		data = data[:limit]
+		// Don't end the preview in the middle of a multi-byte character
+		for i := 0; i < utf8.UTFMax && len(data) > 0; i++ {
+			if r, size := utf8.DecodeLastRune(data); r != utf8.RuneError || size != 1 {
+				break
+			}
+			data = data[:len(data)-1]
+		}
+	}
+
+	c.Header(previewTruncatedHeader, strconv.FormatBool(truncated))
+	secureDownloadHeaders(c, "text/plain")
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", data)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// parseFields splits a ?fields= value and checks every name against the
+// JSON field names of v's struct type. An empty value selects all fields
+// and yields nil.
+func parseFields(value string, v interface{}) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	known := jsonFieldNames(reflect.TypeOf(v))
+	var fields []string
+	for _, f := range strings.Split(value, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !known[f] {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// jsonFieldNames returns the JSON names of a struct type's fields
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	names := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// projectFields re-encodes each item keeping only the given JSON fields.
+// Fields omitted by omitempty stay omitted.
+func projectFields[T any](items []T, fields []string) ([]map[string]json.RawMessage, error) {
+	projected := make([]map[string]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		encoded, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		var all map[string]json.RawMessage
+		if err := json.Unmarshal(encoded, &all); err != nil {
+			return nil, err
+		}
+		subset := make(map[string]json.RawMessage, len(fields))
+		for _, f := range fields {
+			if v, ok := all[f]; ok {
+				subset[f] = v
+			}
+		}
+		projected = append(projected, subset)
+	}
+	return projected, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Machine-readable error codes returned in the "code" field of error responses
+const (
+	CodeBadRequest           = "BAD_REQUEST"
+	CodeNotFound             = "NOT_FOUND"
+	CodeFileTooLarge         = "FILE_TOO_LARGE"
+	CodeRequestTooLarge      = "REQUEST_TOO_LARGE"
+	CodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	CodeInfected             = "INFECTED"
+	CodeScannerUnavailable   = "SCANNER_UNAVAILABLE"
+	CodeInternal             = "INTERNAL_ERROR"
+	CodeFetchFailed          = "FETCH_FAILED"
+	CodeBusy                 = "SERVER_BUSY"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeGatewayError         = "GATEWAY_ERROR"
+	CodeContentUnavailable   = "CONTENT_UNAVAILABLE"
+	CodeNameConflict         = "NAME_CONFLICT"
+	CodeForbidden            = "FORBIDDEN"
+	CodeIdempotencyKeyInUse  = "IDEMPOTENCY_KEY_IN_USE"
+	CodeIdempotencyKeyReused = "IDEMPOTENCY_KEY_MISMATCH"
+	CodeQuotaExceeded        = "QUOTA_EXCEEDED"
+	CodeContentRemoving      = "CONTENT_BEING_REMOVED"
+	CodeTooManyAttempts      = "TOO_MANY_ATTEMPTS"
+
+	// Reported in otherwise successful responses
+	CodeStorageRemovalFailed = "STORAGE_REMOVAL_FAILED"
+)
+
+// apiError is an error that knows how it should be reported to the client.
+// Helpers that don't have access to the gin context return it so handlers
+// can pass it straight to respondAPIError.
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+	Details gin.H
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// newAPIError creates an apiError with a formatted message
+func newAPIError(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// respondAPIError reports err, using its status and code when it is an
+// apiError and a generic 500 otherwise
+func respondAPIError(c *gin.Context, err error) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		respondErrorDetails(c, apiErr.Status, apiErr.Code, apiErr.Message, apiErr.Details)
+		return
+	}
+	respondError(c, http.StatusInternalServerError, CodeInternal, err.Error())
+}
+
+// limitRequestBody rejects requests declaring a body larger than maxBytes
+// with 413 before anything is read, and caps bodies of unknown length
+// (chunked uploads) so reading past the limit fails
+func limitRequestBody(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if maxBytes <= 0 {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > maxBytes {
+			// Don't let the server drain a huge body just to reuse the connection
+			c.Header("Connection", "close")
+			respondErrorf(c, http.StatusRequestEntityTooLarge, CodeRequestTooLarge,
+				"Request body exceeds maximum size of %d bytes", maxBytes)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		c.Next()
+	}
+}
+
+// isBodyTooLarge reports whether err comes from reading past the limit set
+// by limitRequestBody
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// requestIDHeader carries the request ID between clients, proxies and us
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the gin context key holding the current request ID
+const requestIDKey = "requestId"
+
+// requestID assigns every request an ID, reusing one supplied by a proxy,
+// and echoes it in the response so errors can be matched to log lines
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			// Request IDs only correlate logs, so a clock-based ID is an
+			// acceptable fallback if the entropy source fails
+			var err error
+			if id, err = GenerateID(); err != nil {
+				id = strconv.FormatInt(time.Now().UnixNano(), 36)
+			}
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// respondError writes an error response with the standard shape
+// {error, code, requestId}. Server errors are logged; client errors are not,
+// since they are expected and would only add noise.
+func respondError(c *gin.Context, status int, code, msg string) {
+	respondErrorDetails(c, status, code, msg, nil)
+}
+
+// respondErrorf is like respondError with a formatted message
+func respondErrorf(c *gin.Context, status int, code, format string, args ...interface{}) {
+	respondError(c, status, code, fmt.Sprintf(format, args...))
+}
+
+// respondErrorDetails is like respondError but adds extra fields to the body
+func respondErrorDetails(c *gin.Context, status int, code, msg string, details gin.H) {
+	id := c.GetString(requestIDKey)
+	if status >= 500 {
+		log.Printf("[%s] %s %s -> %d %s: %s", id, c.Request.Method, c.Request.URL.Path, status, code, msg)
+	}
+
+	body := gin.H{
+		"error":     msg,
+		"code":      code,
+		"requestId": id,
+	}
+	for k, v := range details {
+		body[k] = v
+	}
+	c.AbortWithStatusJSON(status, body)
+}
+
+// extendDeadlines replaces the server's read and write timeouts with a
+// longer limit for routes that stream large bodies or hold the connection
+// open (uploads, downloads, event streams). A limit of 0 removes the
+// deadlines entirely.
+func extendDeadlines(limit time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var deadline time.Time
+		if limit > 0 {
+			deadline = time.Now().Add(limit)
+		}
+		rc := http.NewResponseController(c.Writer)
+		if err := rc.SetReadDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Failed to extend read deadline: %v", err)
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Failed to extend write deadline: %v", err)
+		}
+		c.Next()
+	}
+}
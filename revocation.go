@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RevocationReconciler retries publishing the revocations of share links
+// that were revoked locally while the revocation service was unreachable
+type RevocationReconciler struct {
+	storage  Storage
+	fileRepo *FileRepository
+	interval time.Duration
+}
+
+// NewRevocationReconciler creates a reconciler configured from cfg
+func NewRevocationReconciler(storage Storage, fileRepo *FileRepository, cfg *Config) *RevocationReconciler {
+	return &RevocationReconciler{
+		storage:  storage,
+		fileRepo: fileRepo,
+		interval: cfg.RevocationRetryInterval,
+	}
+}
+
+// Run retries pending revocations every interval until ctx is cancelled
+func (r *RevocationReconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.retryPending(ctx)
+		}
+	}
+}
+
+// retryPending publishes every pending revocation once more
+func (r *RevocationReconciler) retryPending(ctx context.Context) {
+	for _, link := range r.fileRepo.PendingRevocations() {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := r.storage.RevokeAccess(ctx, link.DelegationID); err != nil {
+			log.Printf("Revocation of delegation %s still pending: %v", link.DelegationID, err)
+			continue
+		}
+		r.fileRepo.SetRevocationPending(link.Token, false)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxFetchRedirects bounds how many redirects a safe fetch will follow
+const maxFetchRedirects = 5
+
+// errBlockedAddress is returned when a fetch would connect to an address we
+// refuse to reach (loopback, private networks, cloud metadata, ...)
+var errBlockedAddress = errors.New("destination address is not allowed")
+
+// errResponseTooLarge is returned when reading past a safe client's size cap
+var errResponseTooLarge = errors.New("response exceeds size limit")
+
+// SafeHTTPClient is the single place outbound HTTP requests go through,
+// whether the URL comes from a user or from our gateway configuration.
+// Every connection, including those made while following redirects, is
+// checked against the resolved IP, so DNS tricks can't reach internal hosts
+// unless their network has been explicitly allowlisted.
+type SafeHTTPClient struct {
+	client   *http.Client
+	allowed  []*net.IPNet
+	maxBytes int64
+}
+
+// NewSafeHTTPClient creates a client from cfg. checkRedirect, when non-nil,
+// is consulted for every redirect target in addition to the built-in checks.
+func NewSafeHTTPClient(cfg *Config, timeout time.Duration, checkRedirect func(*url.URL) error) *SafeHTTPClient {
+	c := &SafeHTTPClient{
+		allowed:  parseNetworks(cfg.FetchAllowedNetworks),
+		maxBytes: cfg.MaxFetchBytes,
+	}
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !c.ipAllowed(ip) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, host)
+			}
+			return nil
+		},
+	}
+
+	c.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 nil, // Never route requests through an environment proxy
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+			}
+			if err := checkScheme(req.URL); err != nil {
+				return err
+			}
+			if checkRedirect != nil {
+				return checkRedirect(req.URL)
+			}
+			return nil
+		},
+	}
+	return c
+}
+
+// Get performs a safe GET request for rawURL
+func (c *SafeHTTPClient) Get(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends req after validating its URL. The response body is capped at the
+// client's size limit; reading past it fails with errResponseTooLarge.
+func (c *SafeHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if err := checkScheme(req.URL); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if c.maxBytes > 0 {
+		if resp.ContentLength > c.maxBytes {
+			resp.Body.Close()
+			return nil, errResponseTooLarge
+		}
+		resp.Body = &cappedBody{ReadCloser: resp.Body, remaining: c.maxBytes}
+	}
+	return resp, nil
+}
+
+// ipAllowed reports whether connecting to ip is permitted
+func (c *SafeHTTPClient) ipAllowed(ip net.IP) bool {
+	for _, n := range c.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return !isBlockedIP(ip)
+}
+
+// cappedBody fails reads once more than remaining bytes have been consumed
+type cappedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	// Allow reading one byte past the limit so overflow is detected
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, errResponseTooLarge
+	}
+	return n, err
+}
+
+// checkScheme only permits plain HTTP(S) URLs with a host
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	return nil
+}
+
+// parseNetworks parses IPs and CIDRs, skipping (and logging) invalid entries
+func parseNetworks(entries []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		n, err := parseNetwork(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid network %q: %v", entry, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// parseNetwork parses a CIDR, or a single IP as a one-address network
+func parseNetwork(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if !strings.Contains(entry, "/") {
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+	}
+	_, n, err := net.ParseCIDR(entry)
+	return n, err
+}
+
+// cgnatNet is the carrier-grade NAT range, which is not covered by IsPrivate
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isBlockedIP reports whether ip belongs to a range that must not be reached
+// without an explicit allowlist entry
+func isBlockedIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || // Includes 169.254.169.254 cloud metadata
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() ||
+		cgnatNet.Contains(ip) ||
+		ip[0] == 0
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newSafeTestClient creates a safe client that may reach allowed networks
+func newSafeTestClient(t *testing.T, allowed ...string) *SafeHTTPClient {
+	t.Helper()
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	cfg.FetchAllowedNetworks = allowed
+	return NewSafeHTTPClient(cfg, 5*time.Second, nil)
+}
+
+// serveOn starts a test server listening on addr, e.g. "127.0.0.2:0"
+func serveOn(t *testing.T, addr string, handler http.Handler) *httptest.Server {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", addr, err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSafeHTTPClientBlocksInternalAddresses(t *testing.T) {
+	local := serveOn(t, "127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "internal")
+	}))
+	client := newSafeTestClient(t)
+
+	for _, target := range []string{
+		"http://169.254.169.254/latest/meta-data/", // Cloud metadata
+		"http://localhost/",
+		"http://127.0.0.1/",
+		"http://[::1]/",
+		"http://10.0.0.1/",
+		local.URL, // The IP is checked when dialling, whatever the port
+	} {
+		resp, err := client.Get(context.Background(), target)
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("GET %s succeeded", target)
+			continue
+		}
+		if !errors.Is(err, errBlockedAddress) {
+			t.Errorf("GET %s: %v, want errBlockedAddress", target, err)
+		}
+	}
+}
+
+func TestSafeHTTPClientAllowedNetworks(t *testing.T) {
+	local := serveOn(t, "127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "allowed")
+	}))
+	client := newSafeTestClient(t, "127.0.0.0/8")
+
+	resp, err := client.Get(context.Background(), local.URL)
+	if err != nil {
+		t.Fatalf("GET of an allowlisted network: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "allowed" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSafeHTTPClientBlocksRedirectToLoopback(t *testing.T) {
+	internal := serveOn(t, "127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("redirect reached the internal server")
+	}))
+	// Only the redirecting server's address is allowlisted
+	redirector := serveOn(t, "127.0.0.2:0", http.RedirectHandler(internal.URL+"/secret", http.StatusFound))
+	client := newSafeTestClient(t, "127.0.0.2/32")
+
+	resp, err := client.Get(context.Background(), redirector.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("redirect to loopback was followed")
+	}
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("error = %v, want errBlockedAddress", err)
+	}
+}
+
+func TestSafeHTTPClientRejectsSchemes(t *testing.T) {
+	client := newSafeTestClient(t)
+	for _, target := range []string{"file:///etc/passwd", "gopher://example.com/", "ftp://example.com/"} {
+		if resp, err := client.Get(context.Background(), target); err == nil {
+			resp.Body.Close()
+			t.Errorf("GET %s succeeded", target)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// normalizeReferers validates a referer allowlist and reduces each entry
+// to a lowercase host pattern understood by hostMatches
+func normalizeReferers(entries []string) ([]string, error) {
+	var hosts []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "://") {
+			u, err := url.Parse(entry)
+			if err != nil || u.Hostname() == "" {
+				return nil, errors.New("invalid origin " + entry)
+			}
+			entry = u.Hostname()
+		}
+		if strings.ContainsAny(entry, "/ ") {
+			return nil, errors.New("invalid host " + entry)
+		}
+		hosts = append(hosts, strings.ToLower(entry))
+	}
+	return hosts, nil
+}
+
+// refererAllowed checks the Origin or Referer header of a download request
+// against the link's allowlist
+func (h *Handler) refererAllowed(c *gin.Context, link *ShareLink) bool {
+	if len(link.AllowedReferers) == 0 {
+		return true
+	}
+
+	source := c.GetHeader("Origin")
+	if source == "" || source == "null" {
+		source = c.GetHeader("Referer")
+	}
+	if source == "" {
+		return h.config.AllowMissingReferer
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	return hostMatches(strings.ToLower(u.Hostname()), link.AllowedReferers)
+}
+
+// normalizeAllowedIPs validates IPs and CIDRs, returning them in canonical
+// CIDR form
+func normalizeAllowedIPs(entries []string) ([]string, error) {
+	var nets []string
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		n, err := parseNetwork(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+		}
+		nets = append(nets, n.String())
+	}
+	return nets, nil
+}
+
+// clientIPAllowed checks the client address against the link's IP allowlist
+func clientIPAllowed(c *gin.Context, link *ShareLink) bool {
+	if len(link.AllowedIPs) == 0 {
+		return true
+	}
+	ip := net.ParseIP(c.ClientIP())
+	if ip == nil {
+		return false
+	}
+	for _, n := range parseNetworks(link.AllowedIPs) {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
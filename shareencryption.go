@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Password-encrypted shares
+//
+// When EncryptShares is on and a share link is created with a password, the
+// file is fetched, encrypted with AES-256-GCM under a key derived from the
+// password with scrypt, and the ciphertext is uploaded as a separate object.
+// The link points at the ciphertext CID, so the gateway and anyone who only
+// learns the link's CID see ciphertext. Only the salt and nonce are stored;
+// the password and key never are, so a lost password cannot be recovered.
+//
+// Tradeoffs of encrypting at share time rather than requiring encrypted
+// uploads:
+//   - The server handles plaintext while encrypting and again on every
+//     download, when it decrypts on behalf of the password holder. This
+//     protects content from the gateway and storage, not from the server.
+//   - The original upload remains stored in plaintext under its own CID.
+//     Only clients that encrypt before uploading get end-to-end secrecy.
+//   - Every share stores another full copy of the content, and ciphertext
+//     is not reference counted, so it stays when the file is deleted.
+//   - Decryption needs the whole ciphertext (GCM authenticates it as one
+//     message), so encrypted downloads are buffered in memory and do not
+//     support range requests.
+//   - scrypt is deliberately expensive, which makes password guessing slow
+//     for attackers and for us. PasswordThrottle limits wrong passwords per
+//     link and the derivations running at once.
+
+// sharePasswordHeader carries the password for encrypted share downloads.
+// A header rather than a query parameter keeps it out of access logs.
+const sharePasswordHeader = "X-Share-Password"
+
+// scrypt parameters (N=2^15, r=8, p=1: ~100ms and 32MB per derivation)
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	shareKeySize = 32 // AES-256
+	shareSaltLen = 16
+)
+
+// minSharePasswordLength is the shortest password accepted for encryption
+const minSharePasswordLength = 8
+
+// errWrongSharePassword is returned when decryption fails authentication
+var errWrongSharePassword = errors.New("incorrect share password")
+
+// ShareEncryption describes how a share link's content was encrypted
+type ShareEncryption struct {
+	Algorithm string `json:"algorithm"` // Always "AES-256-GCM/scrypt"
+	Salt      []byte `json:"salt"`
+	Nonce     []byte `json:"nonce"`
+}
+
+// shareEncryptionAlgorithm names the only supported scheme
+const shareEncryptionAlgorithm = "AES-256-GCM/scrypt"
+
+// deriveShareKey stretches password into an AES key
+func deriveShareKey(password string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, shareKeySize)
+}
+
+// encryptForShare encrypts plaintext under password, returning the
+// ciphertext and the parameters needed to decrypt it
+func encryptForShare(plaintext []byte, password string) ([]byte, *ShareEncryption, error) {
+	salt, err := randomBytes(shareSaltLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := shareCipher(password, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := randomBytes(gcm.NonceSize())
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := &ShareEncryption{Algorithm: shareEncryptionAlgorithm, Salt: salt, Nonce: nonce}
+	return gcm.Seal(nil, nonce, plaintext, nil), enc, nil
+}
+
+// decryptShare reverses encryptForShare, failing with errWrongSharePassword
+// when the password is wrong or the ciphertext was tampered with
+func decryptShare(ciphertext []byte, password string, enc *ShareEncryption) ([]byte, error) {
+	if enc.Algorithm != shareEncryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption %q", enc.Algorithm)
+	}
+	gcm, err := shareCipher(password, enc.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, enc.Nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errWrongSharePassword
+	}
+	return plaintext, nil
+}
+
+func shareCipher(password string, salt []byte) (cipher.AEAD, error) {
+	key, err := deriveShareKey(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptShareContent fetches a file's content, encrypts it under password
+// and uploads the ciphertext, returning its CID and encryption parameters
+func (h *Handler) encryptShareContent(c *gin.Context, file *FileMetadata, password string) (string, *ShareEncryption, error) {
+	plaintext, err := h.fetchAll(c, file.CID, file.ContentType)
+	if err != nil {
+		return "", nil, err
+	}
+	if hash := sha256Hex(plaintext); file.Hash != "" && hash != file.Hash {
+		return "", nil, newAPIError(http.StatusBadGateway, CodeGatewayError, "Gateway returned content that does not match the stored hash")
+	}
+
+	release, err := h.passwords.Acquire(c.Request.Context())
+	if err != nil {
+		return "", nil, newAPIError(http.StatusServiceUnavailable, CodeBusy, "Server is busy, please retry later")
+	}
+	ciphertext, enc, err := encryptForShare(plaintext, password)
+	release()
+	if err != nil {
+		return "", nil, newAPIError(http.StatusInternalServerError, CodeInternal, "Failed to encrypt content")
+	}
+
+	result, err := h.storage.Upload(c.Request.Context(), ciphertext, file.Name+".enc", "application/octet-stream")
+	if errors.Is(err, ErrUploadQueueFull) {
+		return "", nil, newAPIError(http.StatusServiceUnavailable, CodeBusy, "Server is busy, please retry later")
+	}
+	if err != nil {
+		return "", nil, newAPIError(http.StatusInternalServerError, CodeInternal, "Failed to store encrypted content: %v", err)
+	}
+	return result.CID, enc, nil
+}
+
+// decryptSharedContent fetches and decrypts an encrypted link's content with
+// the password from the request. On failure it writes the error response
+// and returns false.
+func (h *Handler) decryptSharedContent(c *gin.Context, link *ShareLink) ([]byte, bool) {
+	password := c.GetHeader(sharePasswordHeader)
+	if password == "" {
+		respondErrorf(c, http.StatusUnauthorized, CodeUnauthorized, "This share is encrypted; send its password in the %s header", sharePasswordHeader)
+		return nil, false
+	}
+
+	// Refused before anything expensive is done
+	if wait, ok := h.passwords.Allow(link.Token); !ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondError(c, http.StatusTooManyRequests, CodeTooManyAttempts, "Too many incorrect passwords for this share; try again later")
+		return nil, false
+	}
+
+	ciphertext, err := h.fetchAll(c, link.CID, "application/octet-stream")
+	if err != nil {
+		respondAPIError(c, err)
+		return nil, false
+	}
+
+	release, err := h.passwords.Acquire(c.Request.Context())
+	if err != nil {
+		respondError(c, http.StatusServiceUnavailable, CodeBusy, "Server is busy, please retry later")
+		return nil, false
+	}
+	plaintext, err := decryptShare(ciphertext, password, link.Encryption)
+	release()
+	if errors.Is(err, errWrongSharePassword) {
+		h.passwords.Failed(link.Token)
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "Incorrect share password")
+		return nil, false
+	}
+	if err != nil {
+		respondErrorf(c, http.StatusInternalServerError, CodeInternal, "Failed to decrypt content: %v", err)
+		return nil, false
+	}
+	return plaintext, true
+}
+
+// fetchAll reads a CID's complete content, bounded by the file size limit plus the
+// GCM tag
+func (h *Handler) fetchAll(c *gin.Context, cid, contentType string) ([]byte, error) {
+	content, err := h.storage.FetchFromGateway(c.Request.Context(), cid,
+		FetchOptions{Gateway: h.clientGateway(c), ContentType: contentType})
+	if err != nil {
+		return nil, fetchError(err)
+	}
+	defer content.Body.Close()
+
+	limit := h.config.FileSizeLimit() + 64
+	data, err := io.ReadAll(io.LimitReader(content.Body, limit+1))
+	if err != nil {
+		return nil, newAPIError(http.StatusBadGateway, CodeGatewayError, "Failed to read content: %v", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, newAPIError(http.StatusBadGateway, CodeFileTooLarge, "Content exceeds the maximum file size")
+	}
+	return data, nil
+}
+
+// plaintextContent wraps decrypted bytes for writeContent
+func plaintextContent(data []byte) *GatewayContent {
+	return &GatewayContent{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		Status:        http.StatusOK,
+		ContentLength: int64(len(data)),
+	}
+}
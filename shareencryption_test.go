@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSharePasswordThrottled(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.EncryptShares = true
+		cfg.SharePasswordMaxFailures = 2
+		cfg.SharePasswordWindow = time.Minute
+	})
+	s.handler.SetClock(clock)
+	content := []byte("secret notes")
+	file := s.uploadTestFile("notes.txt", content)
+	link := s.createShareLink(file.ID, `{"password": "correct horse"}`)
+	other := s.createShareLink(file.ID, `{"password": "correct horse"}`)
+	download := func(token, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/share/"+token+"/download", nil)
+		req.Header.Set(sharePasswordHeader, password)
+		return s.do(req)
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := download(link.Token, "wrong guess"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: status %d, body %s", i+1, w.Code, w.Body)
+		}
+	}
+	// Even the right password is refused until the failures age out
+	w := download(link.Token, "correct horse")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("after too many failures: status %d, Retry-After %q, body %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+	}
+	if w := download(other.Token, "correct horse"); w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Errorf("another link of the file: status %d, body %q", w.Code, w.Body)
+	}
+
+	clock.Advance(time.Minute)
+	if w := download(link.Token, "correct horse"); w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Errorf("after the window: status %d, body %q", w.Code, w.Body)
+	}
+}
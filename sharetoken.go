@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minShareSecretLength is the minimum SHARE_SECRET length for signed tokens
+const minShareSecretLength = 32
+
+var (
+	errInvalidShareToken = errors.New("invalid share token")
+	errBadShareSignature = errors.New("share token signature mismatch")
+)
+
+// shareClaims is the signed payload of a stateless share token. Everything
+// needed to authorize access lives in the token itself, so any instance
+// holding the secret can verify it without a repository lookup.
+type shareClaims struct {
+	FileID       string   `json:"fid"`
+	CID          string   `json:"cid,omitempty"` // Left out with HideGatewayURL
+	IssuedAt     int64    `json:"iat"`
+	ExpiresAt    int64    `json:"exp"`
+	MaxAccesses  int      `json:"max,omitempty"`
+	MaxDownloads int      `json:"mdl,omitempty"`
+	Referers     []string `json:"ref,omitempty"`
+	IPs          []string `json:"ips,omitempty"`
+	Nonce        string   `json:"n"` // Makes every token unique, even for identical claims
+}
+
+// isStatelessToken reports whether token has the signed "payload.signature"
+// form rather than being a random lookup key
+func isStatelessToken(token string) bool {
+	return strings.Contains(token, ".")
+}
+
+// signShareToken encodes claims as base64url(JSON) + "." + base64url(HMAC)
+func signShareToken(secret []byte, claims *shareClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(shareTokenMAC(secret, encoded)), nil
+}
+
+// verifyShareToken checks the token's signature and returns its claims.
+// Expiry is left to VerifyAccess so stateless and stored links report it
+// the same way.
+func verifyShareToken(secret []byte, token string) (*shareClaims, error) {
+	encoded, sig, found := strings.Cut(token, ".")
+	if !found {
+		return nil, errInvalidShareToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, errInvalidShareToken
+	}
+	if !hmac.Equal(mac, shareTokenMAC(secret, encoded)) {
+		return nil, errBadShareSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidShareToken
+	}
+	var claims shareClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidShareToken
+	}
+	return &claims, nil
+}
+
+func shareTokenMAC(secret []byte, encodedPayload string) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(encodedPayload))
+	return m.Sum(nil)
+}
+
+// toShareLink builds the ShareLink view of a stateless token
+func (sc *shareClaims) toShareLink(token string) *ShareLink {
+	return &ShareLink{
+		Token:        token,
+		FileID:       sc.FileID,
+		CID:          sc.CID,
+		CreatedAt:    time.Unix(sc.IssuedAt, 0),
+		ExpiresAt:    time.Unix(sc.ExpiresAt, 0),
+		MaxAccesses:  sc.MaxAccesses,
+		MaxDownloads: sc.MaxDownloads,
+
+		AllowedReferers: sc.Referers,
+		AllowedIPs:      sc.IPs,
+	}
+}
+
+// AccessCounter counts accesses and downloads of stateless share links.
+// Multi-instance deployments need an implementation backed by a shared store
+// (e.g. Redis) for limits to hold across instances.
+type AccessCounter interface {
+	// Counts returns the current access and download counts for token
+	Counts(token string) (accesses, downloads int)
+	// IncrementAccess records an access and returns the new counts
+	IncrementAccess(token string, expiresAt time.Time) (accesses, downloads int)
+	// IncrementDownload records a download and returns the new counts
+	IncrementDownload(token string, expiresAt time.Time) (accesses, downloads int)
+}
+
+// memoryAccessCounter is the in-process AccessCounter
+type memoryAccessCounter struct {
+	mu      sync.Mutex
+	entries map[string]*accessCount
+	writes  int
+}
+
+type accessCount struct {
+	accesses  int
+	downloads int
+	expiresAt time.Time
+}
+
+// sweepEvery controls how often expired counters are dropped
+const sweepEvery = 1000
+
+// NewMemoryAccessCounter creates an in-memory counter store
+func NewMemoryAccessCounter() AccessCounter {
+	return &memoryAccessCounter{entries: make(map[string]*accessCount)}
+}
+
+func (m *memoryAccessCounter) Counts(token string) (int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[token]; ok {
+		return e.accesses, e.downloads
+	}
+	return 0, 0
+}
+
+func (m *memoryAccessCounter) IncrementAccess(token string, expiresAt time.Time) (int, int) {
+	return m.increment(token, expiresAt, func(e *accessCount) { e.accesses++ })
+}
+
+func (m *memoryAccessCounter) IncrementDownload(token string, expiresAt time.Time) (int, int) {
+	return m.increment(token, expiresAt, func(e *accessCount) { e.downloads++ })
+}
+
+func (m *memoryAccessCounter) increment(token string, expiresAt time.Time, fn func(*accessCount)) (int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Counters of expired links are useless; drop them now and then
+	m.writes++
+	if m.writes%sweepEvery == 0 {
+		now := time.Now()
+		for k, e := range m.entries {
+			if now.After(e.expiresAt) {
+				delete(m.entries, k)
+			}
+		}
+	}
+
+	e, ok := m.entries[token]
+	if !ok {
+		e = &accessCount{expiresAt: expiresAt}
+		m.entries[token] = e
+	}
+	fn(e)
+	return e.accesses, e.downloads
+}
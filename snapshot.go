@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotVersion is bumped whenever the snapshot layout changes
+// incompatibly
+const snapshotVersion = 1
+
+// repositorySnapshot is the on-disk form of a FileRepository
+type repositorySnapshot struct {
+	Version    int                         `json:"version"`
+	SavedAt    time.Time                   `json:"savedAt"`
+	Files      []*FileMetadata             `json:"files"`
+	ShareLinks []*ShareLink                `json:"shareLinks"`
+	AccessLog  map[string][]AccessLogEntry `json:"accessLog,omitempty"`
+}
+
+// SaveSnapshot writes the repository to path as JSON. The snapshot is
+// written to a temporary file in the same directory and renamed into
+// place, so a crash mid-write never leaves a truncated snapshot behind.
+func (r *FileRepository) SaveSnapshot(path string) error {
+	r.mu.RLock()
+	snapshot := repositorySnapshot{
+		Version:    snapshotVersion,
+		SavedAt:    r.clock.Now(),
+		Files:      make([]*FileMetadata, 0, len(r.files)),
+		ShareLinks: make([]*ShareLink, 0, len(r.shareLinks)),
+		AccessLog:  r.accessLog,
+	}
+	for _, f := range r.files {
+		snapshot.Files = append(snapshot.Files, f)
+	}
+	for _, l := range r.shareLinks {
+		snapshot.ShareLinks = append(snapshot.ShareLinks, l)
+	}
+	data, err := json.Marshal(snapshot)
+	r.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshot replaces the repository's contents with a snapshot written
+// by SaveSnapshot. A missing file is reported as an os.ErrNotExist error.
+func (r *FileRepository) LoadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var snapshot repositorySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files = make(map[string]*FileMetadata, len(snapshot.Files))
+	r.cidRefs = make(map[string]int)
+	for _, f := range snapshot.Files {
+		r.files[f.ID] = f
+		r.cidRefs[f.CID]++
+	}
+	r.shareLinks = make(map[string]*ShareLink, len(snapshot.ShareLinks))
+	for _, l := range snapshot.ShareLinks {
+		r.shareLinks[l.Token] = l
+	}
+	r.accessLog = snapshot.AccessLog
+	if r.accessLog == nil {
+		r.accessLog = make(map[string][]AccessLogEntry)
+	}
+	r.evictOldest()
+	r.version++
+	return nil
+}
+
+// RunSnapshots saves the repository to path every interval until ctx is
+// cancelled
+func (r *FileRepository) RunSnapshots(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.SaveSnapshot(path); err != nil {
+				log.Printf("Snapshot failed: %v", err)
+			}
+		}
+	}
+}
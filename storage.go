@@ -1,35 +1,220 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 // StorageService handles file storage operations with Storacha/IPFS
 type StorageService struct {
 	config *Config
-	client *http.Client
+	client *SafeHTTPClient
+
+	// Upload concurrency control: uploadSlots bounds in-flight uploads and
+	// queuedUploads counts callers waiting for a slot
+	uploadSlots   chan struct{}
+	queuedUploads int64
+
+	// Gateway fetch concurrency control, as for uploads. A slot is held
+	// until the fetched body is closed.
+	fetchSlots    chan struct{}
+	queuedFetches int64
+
+	// In-progress whole-content fetches, keyed by CID and gateway
+	fetches singleflight.Group
+
+	// Encrypted copies of uploaded content, for re-uploading (nil unless
+	// RetainLocalCopy is set)
+	local *LocalStore
+
+	clock Clock
+}
+
+// Storage is the content storage the handlers and background workers work
+// against. StorageService implements it with Storacha and IPFS gateways;
+// tests substitute a fake, and other backends can be added alongside.
+type Storage interface {
+	Upload(ctx context.Context, content []byte, filename string, contentType string) (*UploadResult, error)
+	UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string) (*UploadResult, error)
+	UploadDirectory(ctx context.Context, files []DirectoryFile) (*UploadResult, error)
+	FetchFromGateway(ctx context.Context, cidStr string, opts FetchOptions) (*GatewayContent, error)
+	CheckAvailability(ctx context.Context, cidStr string) (bool, error)
+	ProbeCID(ctx context.Context, cidStr, gateway string) (*CIDProbe, error)
+	Remove(cidStr string) error
+	LocalCopy(cidStr string) ([]byte, error)
+
+	GetGatewayURL(cidStr, gateway string) string
+	PublicGateway() string
+	GatewayForRegion(region string) string
+	UploadMode() string
+
+	CreateDelegation(clientDID string, abilities []string, expiration time.Duration) ([]byte, error)
+	VerifyAccess(link *ShareLink) AccessStatus
+	RevokeAccess(ctx context.Context, delegationID string) error
+
+	PublishIPNS(ctx context.Context, cidStr, keyName string) (string, error)
+	IPNSGatewayURL(name string) string
+
+	UploadStats() ConcurrencyStats
+	FetchStats() ConcurrencyStats
+	LocalStoreUsage() *LocalStoreUsage
+}
+
+var _ Storage = (*StorageService)(nil)
+
+// ErrUploadQueueFull is returned when too many uploads are already waiting
+var ErrUploadQueueFull = errors.New("upload queue is full")
+
+// ErrFetchQueueFull is returned when too many gateway fetches are already
+// waiting
+var ErrFetchQueueFull = errors.New("gateway fetch queue is full")
+
+// ConcurrencyStats reports the current load of uploads or gateway fetches
+type ConcurrencyStats struct {
+	InFlight      int `json:"inFlight"`
+	Queued        int `json:"queued"`
+	MaxConcurrent int `json:"maxConcurrent"`
+	MaxQueued     int `json:"maxQueued"`
 }
 
 // NewStorageService creates a new storage service
 func NewStorageService(cfg *Config) (*StorageService, error) {
-	return &StorageService{
-		config: cfg,
-		client: &http.Client{
-			Timeout: 5 * time.Minute,
-		},
-	}, nil
+	maxConcurrent := cfg.MaxConcurrentUploads
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	maxFetches := cfg.MaxConcurrentFetches
+	if maxFetches < 1 {
+		maxFetches = 1
+	}
+	s := &StorageService{
+		config:      cfg,
+		client:      NewSafeHTTPClient(cfg, 5*time.Minute, nil),
+		uploadSlots: make(chan struct{}, maxConcurrent),
+		fetchSlots:  make(chan struct{}, maxFetches),
+		clock:       realClock{},
+	}
+	if cfg.RetainLocalCopy {
+		local, err := NewLocalStore(cfg.LocalStoreDir, cfg.LocalStoreMaxBytes, cfg.LocalStoreKey)
+		if err != nil {
+			return nil, err
+		}
+		s.local = local
+	}
+	return s, nil
+}
+
+// acquireUploadSlot waits for a free upload slot, failing immediately with
+// ErrUploadQueueFull when the wait queue is already at capacity, or giving
+// up when ctx is cancelled, e.g. by the client disconnecting. The returned
+// function releases the slot.
+func (s *StorageService) acquireUploadSlot(ctx context.Context) (func(), error) {
+	// Fast path: a slot is free, no need to queue
+	select {
+	case s.uploadSlots <- struct{}{}:
+		return s.releaseUploadSlot, nil
+	default:
+	}
+
+	if atomic.AddInt64(&s.queuedUploads, 1) > int64(s.config.MaxQueuedUploads) {
+		atomic.AddInt64(&s.queuedUploads, -1)
+		return nil, ErrUploadQueueFull
+	}
+	defer atomic.AddInt64(&s.queuedUploads, -1)
+	select {
+	case s.uploadSlots <- struct{}{}:
+		return s.releaseUploadSlot, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *StorageService) releaseUploadSlot() {
+	<-s.uploadSlots
+}
+
+// UploadStats returns the number of in-flight and queued uploads
+func (s *StorageService) UploadStats() ConcurrencyStats {
+	return ConcurrencyStats{
+		InFlight:      len(s.uploadSlots),
+		Queued:        int(atomic.LoadInt64(&s.queuedUploads)),
+		MaxConcurrent: cap(s.uploadSlots),
+		MaxQueued:     s.config.MaxQueuedUploads,
+	}
+}
+
+// acquireFetchSlot waits for a free gateway fetch slot like
+// acquireUploadSlot
+func (s *StorageService) acquireFetchSlot(ctx context.Context) (func(), error) {
+	select {
+	case s.fetchSlots <- struct{}{}:
+		return s.releaseFetchSlot, nil
+	default:
+	}
+
+	if atomic.AddInt64(&s.queuedFetches, 1) > int64(s.config.MaxQueuedFetches) {
+		atomic.AddInt64(&s.queuedFetches, -1)
+		return nil, ErrFetchQueueFull
+	}
+	defer atomic.AddInt64(&s.queuedFetches, -1)
+	select {
+	case s.fetchSlots <- struct{}{}:
+		return s.releaseFetchSlot, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *StorageService) releaseFetchSlot() {
+	<-s.fetchSlots
+}
+
+// FetchStats returns the number of in-flight and queued gateway fetches
+func (s *StorageService) FetchStats() ConcurrencyStats {
+	return ConcurrencyStats{
+		InFlight:      len(s.fetchSlots),
+		Queued:        int(atomic.LoadInt64(&s.queuedFetches)),
+		MaxConcurrent: cap(s.fetchSlots),
+		MaxQueued:     s.config.MaxQueuedFetches,
+	}
+}
+
+// Upload modes reported by UploadMode
+const (
+	UploadModeCLI    = "cli"    // Uploads go through the storacha CLI
+	UploadModeDirect = "direct" // No CLI: placeholder CIDs, clients upload directly
+	UploadModeLocal  = "local"  // Content is kept on this server's disk
+)
+
+// UploadMode reports how Upload stores content on this server
+func (s *StorageService) UploadMode() string {
+	if _, err := exec.LookPath("storacha"); err != nil {
+		return UploadModeDirect
+	}
+	return UploadModeCLI
 }
 
 // UploadResult contains the result of an upload operation
@@ -41,7 +226,57 @@ type UploadResult struct {
 // Upload uploads file content to Storacha
 // For production on Render: Uses CLI if available, otherwise stores metadata only
 // (frontend should upload directly to Storacha using JS client)
-func (s *StorageService) Upload(content []byte, filename string, contentType string) (*UploadResult, error) {
+func (s *StorageService) Upload(ctx context.Context, content []byte, filename string, contentType string) (_ *UploadResult, err error) {
+	ctx, span := startSpan(ctx, "StorageService.Upload", attrFileSize.Int(len(content)))
+	defer func() { endSpan(span, err) }()
+
+	release, err := s.acquireUploadSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	result, err := s.upload(ctx, content, filename)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attrCID.String(result.CID))
+
+	// Keep a copy of stored content for re-uploading; failing to is not
+	// worth failing the upload over
+	if s.local != nil && !isPlaceholderCID(result.CID) {
+		if err := s.local.Put(result.CID, content); err != nil {
+			slog.Warn("Failed to keep local copy", "cid", result.CID, "error", err)
+		}
+	}
+	return result, nil
+}
+
+// LocalCopy returns the retained copy of a CID's content, or
+// errNoLocalCopy when none is kept
+func (s *StorageService) LocalCopy(cidStr string) ([]byte, error) {
+	if s.local == nil {
+		return nil, errNoLocalCopy
+	}
+	return s.local.Get(cidStr)
+}
+
+// LocalStoreUsage reports the disk space used by retained copies, or nil
+// when copies aren't kept
+func (s *StorageService) LocalStoreUsage() *LocalStoreUsage {
+	if s.local == nil {
+		return nil
+	}
+	usage := s.local.Usage()
+	return &usage
+}
+
+// cliWaitDelay bounds how long a killed CLI process may keep its output
+// pipes open, e.g. through child processes it started
+const cliWaitDelay = 5 * time.Second
+
+// upload stores content with the storacha CLI, or in direct mode without it
+func (s *StorageService) upload(ctx context.Context, content []byte, filename string) (*UploadResult, error) {
 	// Check if storacha CLI is available
 	if _, err := exec.LookPath("storacha"); err != nil {
 		// CLI not available - generate a placeholder CID
@@ -50,66 +285,79 @@ func (s *StorageService) Upload(content []byte, filename string, contentType str
 		return s.uploadDirect(content, filename)
 	}
 
+	// Content whose CID the space already lists needn't be sent again
+	args := []string{"up"}
+	if s.config.SkipExistingUploads {
+		args = append(args, "--no-wrap")
+		cidStr := computeUnixFSCID(content)
+		exists, err := s.Exists(ctx, cidStr)
+		if err != nil {
+			slog.Warn("Could not check for existing content, uploading", "cid", cidStr, "error", err)
+		} else if exists {
+			slog.Info("Content already stored, skipping upload", "cid", cidStr)
+			return &UploadResult{CID: cidStr, GatewayURL: s.GetGatewayURL(cidStr, "")}, nil
+		}
+	}
+
+	// For large files, pass the shard size and request concurrency through
+	// to the CLI. It is still one storacha up call: the CLI splits the CAR
+	// and a failed shard fails the whole upload, which is retried from
+	// scratch. The root CID is the same either way.
+	var shards int64 = 1
+	if threshold := s.config.ShardedUploadThreshold; threshold > 0 && int64(len(content)) >= threshold {
+		shardSize := s.config.UploadShardSize
+		shards = (int64(len(content)) + shardSize - 1) / shardSize
+		args = append(args,
+			"--shard-size", strconv.FormatInt(shardSize, 10),
+			"--concurrent-requests", strconv.Itoa(s.config.UploadShardConcurrency))
+		slog.Info("Uploading in shards", "filename", filename, "size", len(content), "shards", shards)
+	}
+
 	// Create a temporary file to upload
 	tmpDir := os.TempDir()
 	tmpFile := filepath.Join(tmpDir, fmt.Sprintf("upload_%d_%s", time.Now().UnixNano(), sanitizeFilename(filename)))
 
 	// Write content to temp file
-	if err := os.WriteFile(tmpFile, content, 0644); err != nil {
+	_, span := startSpan(ctx, "write temp file", attrFileSize.Int(len(content)))
+	err := os.WriteFile(tmpFile, content, 0644)
+	endSpan(span, err)
+	if err != nil {
 		return nil, fmt.Errorf("failed to create temp file: %w", err)
 	}
 	defer os.Remove(tmpFile)
 
 	// Use storacha CLI to upload
-	// The CLI uses the logged-in credentials
-	cmd := exec.Command("storacha", "up", tmpFile, "--json")
+	// The CLI uses the logged-in credentials. Cancelling ctx, e.g. when the
+	// client disconnects, kills it and the temp file is removed as usual.
+	_, span = startSpan(ctx, "storacha up", attrFileSize.Int(len(content)), attrShards.Int64(shards))
+	cmd := exec.CommandContext(ctx, "storacha", append(args, tmpFile, "--json")...)
+	cmd.WaitDelay = cliWaitDelay
 	output, err := cmd.CombinedOutput()
+	endSpan(span, err)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, fmt.Errorf("upload cancelled: %w", ctxErr)
+	}
 
-	log.Printf("Storacha CLI output: %s", string(output))
+	// CLI output can mention the agent DID, keys or proofs; it is only
+	// logged at debug level and then redacted
+	slog.Debug("Storacha CLI output", "output", redactSecrets(string(output)))
 
 	if err != nil {
-		log.Printf("Storacha CLI error, falling back to direct mode: %s", string(output))
+		slog.Warn("Storacha CLI error, falling back to direct mode", "error", err)
 		return s.uploadDirect(content, filename)
 	}
 
-	// Parse the JSON output to get CID
-	// The format is: {"root":{"/":"bafyba..."}}
-	var result struct {
-		Root struct {
-			CID string `json:"/"`
-		} `json:"root"`
-	}
-
-	// The output might have multiple lines, find the JSON
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "{") {
-			if err := json.Unmarshal([]byte(line), &result); err == nil && result.Root.CID != "" {
-				break
-			}
-		}
-	}
-
-	cidStr := result.Root.CID
-
-	if cidStr == "" {
-		// Try to extract CID from plain output (bafyba...)
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
-			if strings.HasPrefix(line, "bafy") || strings.HasPrefix(line, "bafk") {
-				cidStr = strings.Fields(line)[0] // Get first word
-				break
-			}
-		}
-	}
+	// The CID is usually in {"root":{"/":"bafy..."}}, but the output
+	// format has varied between CLI versions
+	cidStr := parseUploadCID(string(output), s.config.UploadCIDPaths)
 
 	if cidStr == "" {
-		return nil, fmt.Errorf("could not parse CID from output: %s", string(output))
+		return nil, fmt.Errorf("could not parse CID from output: %s", redactSecrets(string(output)))
 	}
-	log.Printf("Uploaded file %s to Storacha with CID: %s", filename, cidStr)
+	slog.Info("Uploaded to Storacha", "cid", cidStr)
+	slog.Debug("Uploaded file", "cid", cidStr, "filename", filename)
 
-	gatewayURL := fmt.Sprintf("%s/%s", s.config.IPFSGateway, cidStr)
+	gatewayURL := s.GetGatewayURL(cidStr, "")
 
 	return &UploadResult{
 		CID:        cidStr,
@@ -117,6 +365,9 @@ func (s *StorageService) Upload(content []byte, filename string, contentType str
 	}, nil
 }
 
+// placeholderCIDPrefix marks identifiers created in direct mode
+const placeholderCIDPrefix = "pending_"
+
 // uploadDirect handles uploads when CLI is not available
 // This accepts a CID from the frontend (which uploaded directly to Storacha)
 func (s *StorageService) uploadDirect(content []byte, filename string) (*UploadResult, error) {
@@ -126,14 +377,14 @@ func (s *StorageService) uploadDirect(content []byte, filename string) (*UploadR
 	hashStr := base64.URLEncoding.EncodeToString(hash[:16])
 
 	// This is a placeholder - in production, frontend provides real CID
-	placeholderCID := fmt.Sprintf("pending_%s", hashStr)
+	placeholderCID := placeholderCIDPrefix + hashStr
 
 	log.Printf("Direct mode: File %s registered with placeholder: %s", filename, placeholderCID)
 	log.Printf("Note: Frontend should upload to Storacha and update with real CID")
 
 	return &UploadResult{
 		CID:        placeholderCID,
-		GatewayURL: fmt.Sprintf("%s/%s", s.config.IPFSGateway, placeholderCID),
+		GatewayURL: s.GetGatewayURL(placeholderCID, ""),
 	}, nil
 }
 
@@ -146,16 +397,43 @@ func sanitizeFilename(name string) string {
 	return name
 }
 
+// delegableAbilities are the capabilities our proof grants on the space
+// and that we can therefore delegate to clients
+var delegableAbilities = []string{
+	"space/blob/add",
+	"space/index/add",
+	"filecoin/offer",
+	"upload/add",
+}
+
+// maxDelegationExpiration bounds the lifetime of delegations we issue
+const maxDelegationExpiration = 24 * time.Hour
+
 // CreateDelegation creates a UCAN delegation for a client DID
-// This allows the client to upload directly to Storacha
-func (s *StorageService) CreateDelegation(clientDID string, expiration time.Duration) ([]byte, error) {
+// This allows the client to upload directly to Storacha. Abilities must be
+// a subset of delegableAbilities; nil delegates all of them.
+func (s *StorageService) CreateDelegation(clientDID string, abilities []string, expiration time.Duration) ([]byte, error) {
 	// In a full implementation with guppy and go-ucanto:
 	// 1. Parse the client DID
-	// 2. Create delegation with space/blob/add, space/index/add, upload/add capabilities
+	// 2. Create delegation with the requested capabilities
 	// 3. Set expiration
-	// 4. Archive and return the delegation bytes
+	// 4. Include our proof so the chain back to the space owner verifies
+	// 5. Archive and return the delegation bytes
+
+	if abilities == nil {
+		abilities = delegableAbilities
+	}
+	for _, ability := range abilities {
+		if !slices.Contains(delegableAbilities, ability) {
+			return nil, fmt.Errorf("ability %q is not held and can't be delegated", ability)
+		}
+	}
+	if expiration <= 0 || expiration > maxDelegationExpiration {
+		return nil, fmt.Errorf("expiration must be between 0 and %s", maxDelegationExpiration)
+	}
 
-	// For now, create a mock delegation structure
+	// For now, create a mock delegation structure. It carries no proof
+	// chain; that needs the real UCAN implementation.
 	delegation := struct {
 		Audience   string   `json:"aud"`
 		Issuer     string   `json:"iss"`
@@ -164,31 +442,55 @@ func (s *StorageService) CreateDelegation(clientDID string, expiration time.Dura
 	}{
 		Audience:   clientDID,
 		Issuer:     s.config.SpaceDID,
-		Expiration: time.Now().Add(expiration).Unix(),
-		Abilities: []string{
-			"space/blob/add",
-			"space/index/add",
-			"filecoin/offer",
-			"upload/add",
-		},
+		Expiration: s.clock.Now().Add(expiration).Unix(),
+		Abilities:  abilities,
 	}
 
 	// In production, this would be a proper UCAN token
 	// For demo purposes, we return a base64-encoded JSON
-	delegationJSON := fmt.Sprintf(
-		`{"aud":"%s","iss":"%s","exp":%d,"att":["%s"]}`,
-		delegation.Audience,
-		delegation.Issuer,
-		delegation.Expiration,
-		strings.Join(delegation.Abilities, `","`),
-	)
+	delegationJSON, err := json.Marshal(delegation)
+	if err != nil {
+		return nil, err
+	}
 
-	return []byte(base64.StdEncoding.EncodeToString([]byte(delegationJSON))), nil
+	return []byte(base64.StdEncoding.EncodeToString(delegationJSON)), nil
 }
 
-// RevokeAccess revokes access to a CID by invalidating delegations
-// In UCAN, revocation works by publishing a revocation to the revocation service
-func (s *StorageService) RevokeAccess(delegationID string) error {
+// Publishing a revocation is retried this many times, with the pause
+// between attempts doubling from revocationBackoff
+const (
+	revocationAttempts = 3
+	revocationBackoff  = 500 * time.Millisecond
+)
+
+// RevokeAccess revokes access to a CID by invalidating delegations,
+// retrying failed publishes with exponential backoff. It stops waiting
+// when ctx is cancelled, leaving the revocation to be retried later.
+func (s *StorageService) RevokeAccess(ctx context.Context, delegationID string) error {
+	backoff := revocationBackoff
+	var err error
+	for attempt := 1; attempt <= revocationAttempts; attempt++ {
+		if err = s.publishRevocation(delegationID); err == nil {
+			return nil
+		}
+		if attempt == revocationAttempts {
+			break
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("revocation not published after %d attempts: %w", attempt, ctx.Err())
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("revocation not published after %d attempts: %w", revocationAttempts, err)
+}
+
+// publishRevocation publishes one revocation. In UCAN, revocation works by
+// publishing a revocation to the revocation service.
+func (s *StorageService) publishRevocation(delegationID string) error {
 	// In a full implementation:
 	// 1. Create a revocation UCAN
 	// 2. Publish to Storacha's revocation service
@@ -198,51 +500,490 @@ func (s *StorageService) RevokeAccess(delegationID string) error {
 	return nil
 }
 
-// GetGatewayURL returns the gateway URL for a CID
-func (s *StorageService) GetGatewayURL(cidStr string) string {
-	return fmt.Sprintf("%s/%s", s.config.IPFSGateway, cidStr)
+// Remove deletes the content of a CID, including its shards, from the
+// Storacha space. Placeholder CIDs have nothing stored and are ignored.
+func (s *StorageService) Remove(cidStr string) error {
+	if isPlaceholderCID(cidStr) {
+		return nil
+	}
+	if _, err := exec.LookPath("storacha"); err != nil {
+		return fmt.Errorf("storacha CLI not available")
+	}
+
+	output, err := exec.Command("storacha", "rm", cidStr, "--shards").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("storacha rm failed: %v: %s", err, redactSecrets(strings.TrimSpace(string(output))))
+	}
+	log.Printf("Removed %s from storage", cidStr)
+	return nil
+}
+
+// Exists reports whether cidStr is the root of an upload in the Storacha
+// space. It lists every upload, so its cost grows with the space.
+func (s *StorageService) Exists(ctx context.Context, cidStr string) (bool, error) {
+	if _, err := exec.LookPath("storacha"); err != nil {
+		return false, fmt.Errorf("storacha CLI not available")
+	}
+	output, err := exec.CommandContext(ctx, "storacha", "ls").CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("storacha ls failed: %v: %s", err, redactSecrets(strings.TrimSpace(string(output))))
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		for _, field := range strings.Fields(line) {
+			if field == cidStr {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// GetGatewayURL returns the user-facing gateway URL for a CID, on the
+// given gateway (see GatewayForRegion) or, when it is empty, on the public
+// gateway if one is configured
+func (s *StorageService) GetGatewayURL(cidStr, gateway string) string {
+	if gateway == "" {
+		gateway = s.PublicGateway()
+	}
+	return fmt.Sprintf("%s/%s", gateway, cidStr)
+}
+
+// PublicGateway returns the gateway base URL shown to users: PublicGateway,
+// or IPFSGateway when that is unset
+func (s *StorageService) PublicGateway() string {
+	if s.config.PublicGateway != "" {
+		return s.config.PublicGateway
+	}
+	return s.config.IPFSGateway
+}
+
+// fetchURL returns the URL our server fetches a CID from: the given gateway
+// or IPFSGateway. It may point at a private gateway and must not be shown
+// to users.
+func (s *StorageService) fetchURL(cidStr, gateway string) string {
+	if gateway == "" {
+		gateway = s.config.IPFSGateway
+	}
+	return fmt.Sprintf("%s/%s", gateway, cidStr)
+}
+
+// newGatewayRequest creates a request to a gateway URL, with the configured
+// GatewayHeaders when it goes to the host of IPFSGateway. Credentials for
+// a private gateway must not leak to public fallback or regional gateways.
+func (s *StorageService) newGatewayRequest(ctx context.Context, method, target string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.config.GatewayHeaders) > 0 {
+		if primary, err := url.Parse(s.config.IPFSGateway); err == nil && strings.EqualFold(primary.Host, req.URL.Host) {
+			for name, value := range s.config.GatewayHeaders {
+				req.Header.Set(name, value)
+			}
+		}
+	}
+	return req, nil
+}
+
+// GatewayForRegion returns the gateway configured for a client region, or
+// "" to use the default gateways
+func (s *StorageService) GatewayForRegion(region string) string {
+	if region == "" {
+		return ""
+	}
+	return s.config.GatewaysByRegion[strings.ToUpper(region)]
+}
+
+// AccessStatus describes whether a share link may currently be used
+type AccessStatus int
+
+const (
+	// AccessGranted means the link is valid and may be used
+	AccessGranted AccessStatus = iota
+	// AccessRevoked means the link (and its delegation) has been revoked
+	AccessRevoked
+	// AccessExpired means the link is past its expiration time
+	AccessExpired
+	// AccessExhausted means the link has reached its maximum access count
+	AccessExhausted
+)
+
+// Code returns the stable machine-readable code for the status
+func (a AccessStatus) Code() string {
+	switch a {
+	case AccessGranted:
+		return "OK"
+	case AccessRevoked:
+		return "REVOKED"
+	case AccessExpired:
+		return "EXPIRED"
+	case AccessExhausted:
+		return "EXHAUSTED"
+	}
+	return "UNKNOWN"
+}
+
+// HTTPStatus returns the status code used when reporting the access status.
+// Revoked and expired links are gone for good, while an exhausted link is
+// a (permanent) refusal of an otherwise valid link.
+func (a AccessStatus) HTTPStatus() int {
+	switch a {
+	case AccessGranted:
+		return http.StatusOK
+	case AccessRevoked, AccessExpired:
+		return http.StatusGone
+	}
+	return http.StatusForbidden
+}
+
+// Message returns a human-readable description of the status
+func (a AccessStatus) Message() string {
+	switch a {
+	case AccessGranted:
+		return "Access granted"
+	case AccessRevoked:
+		return "This share link has been revoked"
+	case AccessExpired:
+		return "This share link has expired"
+	case AccessExhausted:
+		return "This share link has reached its maximum access or download count"
+	}
+	return "Access denied"
 }
 
 // VerifyAccess checks if a delegation is still valid (not revoked, not expired)
-func (s *StorageService) VerifyAccess(link *ShareLink) bool {
+func (s *StorageService) VerifyAccess(link *ShareLink) AccessStatus {
+	return linkAccessStatus(link, s.clock.Now())
+}
+
+// linkAccessStatus reports whether a share link may be used at now
+func linkAccessStatus(link *ShareLink, now time.Time) AccessStatus {
 	// Check if revoked
 	if link.IsRevoked {
-		return false
+		return AccessRevoked
 	}
 
 	// Check expiration
-	if time.Now().After(link.ExpiresAt) {
-		return false
+	if now.After(link.ExpiresAt) {
+		return AccessExpired
 	}
 
-	// Check max accesses
+	// Check max accesses and downloads; either limit ends the link
 	if link.MaxAccesses > 0 && link.AccessCount >= link.MaxAccesses {
-		return false
+		return AccessExhausted
+	}
+	if link.MaxDownloads > 0 && link.DownloadCount >= link.MaxDownloads {
+		return AccessExhausted
+	}
+
+	return AccessGranted
+}
+
+// FetchOptions adjusts a gateway fetch
+type FetchOptions struct {
+	Range   string // HTTP Range header to forward, e.g. "bytes=0-1023"
+	Gateway string // Gateway to fetch from instead of IPFSGateway
+
+	// The stored content type, if known. An HTML response for content that
+	// isn't HTML is taken for a gateway error page.
+	ContentType string
+}
+
+// GatewayContent is a response body streamed from the gateway. Callers must
+// close Body.
+type GatewayContent struct {
+	Body          io.ReadCloser
+	Status        int    // 200, or 206 for a satisfied range request
+	ContentType   string // As reported by the gateway
+	ContentLength int64  // -1 when unknown
+	ContentRange  string // Set for 206 responses
+}
+
+// errRangeNotSatisfiable is returned when the gateway rejects a range
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// errGatewayErrorPage is returned when a gateway answers with an HTML error
+// page instead of the content
+var errGatewayErrorPage = errors.New("gateway returned an error page instead of the content")
+
+// errNotShareable is returned inside a coalesced fetch when the content is
+// too large, or of unknown size, to buffer for every waiter
+var errNotShareable = errors.New("content too large to share")
+
+// sharedContent is a complete response buffered for coalesced fetches
+type sharedContent struct {
+	data        []byte
+	contentType string
+}
+
+// FetchFromGateway fetches content from IPFS gateway, trying the fallback
+// gateways in turn when a gateway fails or returns an error page.
+//
+// Concurrent requests for the whole of the same CID share one upstream
+// fetch when the content is at most SharedFetchMaxBytes; larger content,
+// content of unknown size and range requests are streamed to each caller
+// separately.
+func (s *StorageService) FetchFromGateway(ctx context.Context, cidStr string, opts FetchOptions) (*GatewayContent, error) {
+	if opts.Range != "" || s.config.SharedFetchMaxBytes <= 0 {
+		return s.fetchStream(ctx, cidStr, opts)
+	}
+
+	// The first caller fetches for everyone. If the content turns out not to
+	// be shareable it keeps the stream it opened (own) and the others fetch
+	// their own. The fetch outlives the first caller's request so the
+	// others aren't failed by it going away.
+	var own *GatewayContent
+	key := cidStr + "\x00" + opts.Gateway
+	v, err, _ := s.fetches.Do(key, func() (interface{}, error) {
+		content, err := s.fetchStream(context.WithoutCancel(ctx), cidStr, opts)
+		if err != nil {
+			return nil, err
+		}
+		limit := s.config.SharedFetchMaxBytes
+		if content.ContentLength < 0 || content.ContentLength > limit {
+			own = content
+			return nil, errNotShareable
+		}
+		defer content.Body.Close()
+		data, err := io.ReadAll(io.LimitReader(content.Body, limit+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from gateway: %w", err)
+		}
+		if int64(len(data)) != content.ContentLength {
+			return nil, fmt.Errorf("gateway sent %d bytes, expected %d", len(data), content.ContentLength)
+		}
+		return &sharedContent{data: data, contentType: content.ContentType}, nil
+	})
+	if own != nil {
+		return own, nil
+	}
+	if errors.Is(err, errNotShareable) {
+		return s.fetchStream(ctx, cidStr, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	shared := v.(*sharedContent)
+	return &GatewayContent{
+		Body:          io.NopCloser(bytes.NewReader(shared.data)),
+		Status:        http.StatusOK,
+		ContentType:   shared.contentType,
+		ContentLength: int64(len(shared.data)),
+	}, nil
+}
+
+// fetchStream opens a single upstream fetch. At most MaxConcurrentFetches
+// run at once; the slot is released when the returned body is closed.
+func (s *StorageService) fetchStream(ctx context.Context, cidStr string, opts FetchOptions) (*GatewayContent, error) {
+	release, err := s.acquireFetchSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	content, err := s.fetchWithFallback(ctx, cidStr, opts)
+	if err != nil {
+		release()
+		return nil, err
 	}
+	content.Body = &releasingBody{ReadCloser: content.Body, release: release}
+	return content, nil
+}
+
+// releasingBody runs release once when the body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
 
-	return true
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
 }
 
-// FetchFromGateway fetches content from IPFS gateway
-func (s *StorageService) FetchFromGateway(cidStr string) (io.ReadCloser, string, error) {
-	url := s.GetGatewayURL(cidStr)
+// fetchWithFallback tries the requested gateway, then each fallback gateway
+func (s *StorageService) fetchWithFallback(ctx context.Context, cidStr string, opts FetchOptions) (*GatewayContent, error) {
+	gateway := opts.Gateway
+	if gateway == "" {
+		gateway = s.config.IPFSGateway
+	}
+	gateways := append([]string{gateway}, s.config.FallbackGateways...)
+
+	var err error
+	for i, gateway := range gateways {
+		var content *GatewayContent
+		spanCtx, span := startSpan(ctx, "gateway fetch", attrCID.String(cidStr), attrGateway.String(gateway), attrRange.String(opts.Range))
+		content, err = s.fetchFrom(spanCtx, gateway, cidStr, opts)
+		if content != nil {
+			span.SetAttributes(attrFileSize.Int64(content.ContentLength))
+		}
+		endSpan(span, err)
+		if err == nil || errors.Is(err, errRangeNotSatisfiable) || ctx.Err() != nil {
+			return content, err
+		}
+		if i < len(gateways)-1 {
+			slog.Warn("Gateway fetch failed, trying next gateway", "cid", cidStr, "error", err)
+		}
+	}
+	return nil, err
+}
+
+// fetchFrom fetches content from a single gateway
+func (s *StorageService) fetchFrom(ctx context.Context, gateway, cidStr string, opts FetchOptions) (*GatewayContent, error) {
+	req, err := s.newGatewayRequest(ctx, http.MethodGet, s.fetchURL(cidStr, gateway))
+	if err != nil {
+		return nil, err
+	}
+	if opts.Range != "" {
+		req.Header.Set("Range", opts.Range)
+	}
 
-	resp, err := s.client.Get(url)
+	resp, err := s.client.Do(req)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to fetch from gateway: %w", err)
+		return nil, fmt.Errorf("failed to fetch from gateway: %w", err)
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
 		resp.Body.Close()
-		return nil, "", fmt.Errorf("gateway returned status %d", resp.StatusCode)
+		return nil, errRangeNotSatisfiable
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("gateway returned status %d", resp.StatusCode)
+	}
+
+	content := &GatewayContent{
+		Body:          resp.Body,
+		Status:        resp.StatusCode,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: resp.ContentLength,
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		content.ContentRange = resp.Header.Get("Content-Range")
+	}
+
+	if isHTMLType(content.ContentType) && !isHTMLType(opts.ContentType) {
+		// Peek at the start of the body without losing it
+		body := bufio.NewReaderSize(resp.Body, gatewayErrorPeekBytes)
+		head, _ := body.Peek(gatewayErrorPeekBytes)
+		if looksLikeGatewayErrorPage(head, opts.ContentType != "") {
+			resp.Body.Close()
+			return nil, errGatewayErrorPage
+		}
+		content.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, resp.Body}
+	}
+	return content, nil
+}
+
+// gatewayErrorPeekBytes is how much of an HTML response is inspected
+const gatewayErrorPeekBytes = 1024
+
+// gatewayErrorMarkers are phrases gateways use on their error pages
+var gatewayErrorMarkers = []string{
+	"not found", "timeout", "timed out", "gateway", "could not", "failed to resolve", "no link named",
+}
+
+// isHTMLType reports whether a content type is HTML
+func isHTMLType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// looksLikeGatewayErrorPage reports whether an HTML response is a gateway
+// error page rather than the content. When the stored type is known (and
+// not HTML) any HTML document is wrong; otherwise the page must also
+// mention a typical error.
+func looksLikeGatewayErrorPage(head []byte, typeKnown bool) bool {
+	text := strings.ToLower(strings.TrimSpace(string(head)))
+	if !strings.HasPrefix(text, "<!doctype html") && !strings.HasPrefix(text, "<html") {
+		return false
+	}
+	if typeKnown {
+		return true
+	}
+	for _, marker := range gatewayErrorMarkers {
+		if strings.Contains(text, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckAvailability asks the gateway whether it can serve a CID. A 404 or
+// 410 means the content is gone; other failures are returned as errors since
+// they say nothing definite about the content.
+func (s *StorageService) CheckAvailability(ctx context.Context, cidStr string) (bool, error) {
+	if isPlaceholderCID(cidStr) {
+		return false, nil
+	}
+
+	req, err := s.newGatewayRequest(ctx, http.MethodHead, s.fetchURL(cidStr, ""))
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to reach gateway: %w", err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return false, nil
+	}
+	return false, fmt.Errorf("gateway returned status %d", resp.StatusCode)
+}
+
+// CIDProbe is what a gateway reports about a CID
+type CIDProbe struct {
+	Available     bool   `json:"available"`
+	Status        int    `json:"status"` // Gateway HTTP status
+	ContentType   string `json:"contentType,omitempty"`
+	ContentLength int64  `json:"contentLength"` // -1 when the gateway doesn't say
+}
+
+// ProbeCID sends a HEAD request for a CID to the given gateway, or
+// IPFSGateway when it is empty, and reports the response. Only a failure to
+// reach the gateway is an error. Probes share the gateway fetch slots.
+func (s *StorageService) ProbeCID(ctx context.Context, cidStr, gateway string) (*CIDProbe, error) {
+	release, err := s.acquireFetchSlot(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer release()
+
+	req, err := s.newGatewayRequest(ctx, http.MethodHead, s.fetchURL(cidStr, gateway))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach gateway: %w", err)
+	}
+	resp.Body.Close()
+
+	return &CIDProbe{
+		Available:     resp.StatusCode >= 200 && resp.StatusCode < 300,
+		Status:        resp.StatusCode,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: resp.ContentLength,
+	}, nil
+}
 
-	contentType := resp.Header.Get("Content-Type")
-	return resp.Body, contentType, nil
+// isPlaceholderCID reports whether cid was generated in direct mode and never
+// actually reached Storacha
+func isPlaceholderCID(cidStr string) bool {
+	return strings.HasPrefix(cidStr, placeholderCIDPrefix)
 }
 
 // UploadFromReader uploads content from a reader
-func (s *StorageService) UploadFromReader(reader io.Reader, filename string, contentType string) (*UploadResult, error) {
+func (s *StorageService) UploadFromReader(ctx context.Context, reader io.Reader, filename string, contentType string) (*UploadResult, error) {
 	// Read all content
 	buf := new(bytes.Buffer)
 	_, err := io.Copy(buf, reader)
@@ -250,5 +991,5 @@ func (s *StorageService) UploadFromReader(reader io.Reader, filename string, con
 		return nil, fmt.Errorf("failed to read content: %w", err)
 	}
 
-	return s.Upload(buf.Bytes(), filename, contentType)
+	return s.Upload(ctx, buf.Bytes(), filename, contentType)
 }
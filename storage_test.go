@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestStorageService creates a storage service fetching from gateway,
+// which may be a local test server
+func newTestStorageService(t *testing.T, gateway string, configure func(*Config)) *StorageService {
+	t.Helper()
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	cfg.IPFSGateway = gateway
+	cfg.FetchAllowedNetworks = []string{"127.0.0.0/8"}
+	if configure != nil {
+		configure(cfg)
+	}
+	s, err := NewStorageService(cfg)
+	if err != nil {
+		t.Fatalf("NewStorageService: %v", err)
+	}
+	return s
+}
+
+func TestFetchFromGatewayCoalesced(t *testing.T) {
+	const callers = 10
+	content := []byte("popular content")
+	var hits atomic.Int32
+	release := make(chan struct{})
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(content)
+	}))
+	defer gateway.Close()
+	s := newTestStorageService(t, gateway.URL+"/ipfs", nil)
+
+	var started, done sync.WaitGroup
+	bodies := make([][]byte, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		started.Add(1)
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			started.Done()
+			fetched, err := s.FetchFromGateway(context.Background(), "bafytest", FetchOptions{})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer fetched.Body.Close()
+			bodies[i], errs[i] = io.ReadAll(fetched.Body)
+		}(i)
+	}
+	// Hold the upstream response until every caller is waiting on it
+	started.Wait()
+	for hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	done.Wait()
+
+	if n := hits.Load(); n != 1 {
+		t.Errorf("%d upstream requests for %d callers, want 1", n, callers)
+	}
+	for i := range bodies {
+		if errs[i] != nil || string(bodies[i]) != string(content) {
+			t.Errorf("caller %d got %q, %v", i, bodies[i], errs[i])
+		}
+	}
+}
+
+func TestUploadSlotWaitCancelled(t *testing.T) {
+	s := newTestStorageService(t, "https://gateway.test/ipfs", func(cfg *Config) {
+		cfg.MaxConcurrentUploads = 1
+		cfg.MaxQueuedUploads = 4
+	})
+	release, err := s.acquireUploadSlot(context.Background())
+	if err != nil {
+		t.Fatalf("acquiring the free slot: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.acquireUploadSlot(ctx)
+		result <- err
+	}()
+	for s.UploadStats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled wait returned %v", err)
+	}
+	if queued := s.UploadStats().Queued; queued != 0 {
+		t.Errorf("%d uploads still queued", queued)
+	}
+}
+
+func TestUploadCancelKillsCLI(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the fake storacha CLI is a shell script checked through /proc")
+	}
+	// A storacha CLI that records its PID, then hangs until killed
+	bin, tmp := t.TempDir(), t.TempDir()
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	script := "#!/bin/sh\necho $$ > " + pidFile + ".tmp && mv " + pidFile + ".tmp " + pidFile + "\nexec sleep 60\n"
+	if err := os.WriteFile(filepath.Join(bin, "storacha"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("TMPDIR", tmp) // Where the temp file being uploaded goes
+	s := newTestStorageService(t, "https://gateway.test/ipfs", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.Upload(ctx, []byte("content"), "notes.txt", "text/plain")
+		result <- err
+	}()
+
+	var pid string
+	for deadline := time.Now().Add(5 * time.Second); pid == ""; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the CLI was never started")
+		}
+		if data, err := os.ReadFile(pidFile); err == nil {
+			pid = strings.TrimSpace(string(data))
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmp, "upload_*")); len(files) != 1 {
+		t.Fatalf("temp files while uploading: %v", files)
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Upload = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload didn't return after cancellation")
+	}
+	if _, err := os.Stat("/proc/" + pid); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("CLI process %s is still running", pid)
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmp, "upload_*")); len(files) != 0 {
+		t.Errorf("temp files left behind: %v", files)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serviceName identifies this server in traces
+const serviceName = "dec-filesharer"
+
+// tracer creates the spans around uploads and gateway fetches. Until
+// setupTracing installs an exporter it is a no-op.
+var tracer = otel.Tracer("example/Dec_Filesharer")
+
+// Span attributes
+var (
+	attrCID      = attribute.Key("ipfs.cid")
+	attrFileSize = attribute.Key("file.size")
+	attrFileName = attribute.Key("file.name")
+	attrGateway  = attribute.Key("ipfs.gateway")
+	attrRange    = attribute.Key("http.request.range")
+	attrShards   = attribute.Key("storacha.shards")
+)
+
+// setupTracing exports spans over OTLP/HTTP, configured by the standard
+// OTEL_EXPORTER_OTLP_* variables. The returned function flushes pending
+// spans on shutdown.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// startSpan starts a span named name with attrs as a child of any span in
+// ctx
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// uploadCIDPaths are the JSON paths, as dot-separated object keys and array
+// indexes, where versions of the storacha and w3 CLIs report the root CID
+// of an upload
+var uploadCIDPaths = []string{
+	"root./",    // {"root":{"/":"bafy..."}}, storacha up --json
+	"root",      // {"root":"bafy..."}
+	"cid./",     // {"cid":{"/":"bafy..."}}
+	"cid",       // {"cid":"bafy..."}
+	"roots.0./", // {"roots":[{"/":"bafy..."}]}
+	"Hash",      // {"Hash":"Qm..."}, ipfs-style output
+}
+
+// cidTokenPattern matches anything that might be a CID in plain output:
+// CIDv0 and base32 CIDv1 tokens, also inside gateway URLs
+var cidTokenPattern = regexp.MustCompile(`\b(Qm[1-9A-HJ-NP-Za-km-z]{44}|b[a-z2-7]{50,})\b`)
+
+// parseUploadCID finds the root CID in the output of a CLI upload. JSON
+// output is searched at extraPaths and then uploadCIDPaths, whether it is
+// the whole output, pretty-printed or not, or one of its lines. Failing
+// that, the first valid CID in the text is taken, skipping CAR shard CIDs.
+// It returns "" when the output has no CID.
+func parseUploadCID(output string, extraPaths []string) string {
+	paths := append(append([]string(nil), extraPaths...), uploadCIDPaths...)
+
+	candidates := []string{strings.TrimSpace(output)}
+	if start, end := strings.Index(output, "{"), strings.LastIndex(output, "}"); start >= 0 && end > start {
+		candidates = append(candidates, output[start:end+1])
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "{") {
+			candidates = append(candidates, line)
+		}
+	}
+	for _, candidate := range candidates {
+		var doc any
+		if json.Unmarshal([]byte(candidate), &doc) != nil {
+			continue
+		}
+		for _, path := range paths {
+			if s, ok := jsonPath(doc, path).(string); ok && ValidateCID(s) == nil {
+				return s
+			}
+		}
+	}
+
+	for _, token := range cidTokenPattern.FindAllString(output, -1) {
+		if codec, err := decodeCID(token); err == nil && codec != codecCAR {
+			return token
+		}
+	}
+	return ""
+}
+
+// jsonPath returns the value at a dot-separated path in decoded JSON, or
+// nil if there is none
+func jsonPath(doc any, path string) any {
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]any:
+			doc = v[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			doc = v[i]
+		default:
+			return nil
+		}
+	}
+	return doc
+}
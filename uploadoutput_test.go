@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	testDirCID  = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+	testFileCID = "bafkreidgljegepcx6lvsu2mmwcl6a7z3hdtpvvgy5io4hbc542fjewy3z4"
+	testV0CID   = "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"
+)
+
+func TestValidateCID(t *testing.T) {
+	shard := "b" + strings.ToLower(cidBase32.EncodeToString(encodeCID(codecCAR, []byte("shard"))))
+	tests := []struct {
+		cid   string
+		valid bool
+	}{
+		{testDirCID, true},
+		{testFileCID, true},
+		{testV0CID, true},
+		{shard, true},
+		{computeUnixFSCID([]byte("hello")), true},
+		{"", false},
+		{"bafy", false},
+		{testDirCID[:len(testDirCID)-4], false}, // Truncated digest
+		{"QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbd0", false}, // '0' isn't base58
+		{"Qm" + strings.Repeat("1", 44), false},
+		{"fbafkreidgljegepcx6lvsu2mmwcl6a7z3", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateCID(tt.cid); (err == nil) != tt.valid {
+			t.Errorf("ValidateCID(%q) = %v, want valid %v", tt.cid, err, tt.valid)
+		}
+	}
+}
+
+func TestParseUploadCID(t *testing.T) {
+	shard := "b" + strings.ToLower(cidBase32.EncodeToString(encodeCID(codecCAR, []byte("shard"))))
+	tests := []struct {
+		name   string
+		output string
+		extra  []string
+		want   string
+	}{
+		{
+			name:   "storacha up --json",
+			output: `{"root":{"/":"` + testDirCID + `"}}` + "\n",
+			want:   testDirCID,
+		},
+		{
+			name:   "pretty-printed JSON",
+			output: "{\n  \"root\": {\n    \"/\": \"" + testDirCID + "\"\n  }\n}\n",
+			want:   testDirCID,
+		},
+		{
+			name: "progress lines before the result",
+			output: "  Reading files...\n" +
+				`{"shard":{"/":"` + shard + `"}}` + "\n" +
+				`{"root":{"/":"` + testFileCID + `"}}` + "\n",
+			want: testFileCID,
+		},
+		{
+			name:   "root as a string",
+			output: `{"root":"` + testFileCID + `","shards":["` + shard + `"]}`,
+			want:   testFileCID,
+		},
+		{
+			name:   "cid link",
+			output: `{"cid":{"/":"` + testFileCID + `"},"size":18}`,
+			want:   testFileCID,
+		},
+		{
+			name:   "roots array",
+			output: `{"roots":[{"/":"` + testDirCID + `"}]}`,
+			want:   testDirCID,
+		},
+		{
+			name:   "ipfs-style CIDv0",
+			output: `{"Name":"a.txt","Hash":"` + testV0CID + `","Size":"26"}`,
+			want:   testV0CID,
+		},
+		{
+			name:   "configured path",
+			output: `{"data":{"upload":{"root":"` + testDirCID + `"}}}`,
+			extra:  []string{"data.upload.root"},
+			want:   testDirCID,
+		},
+		{
+			name: "text output with a gateway URL",
+			output: "  1 file 18B\n" +
+				"⁂ Stored 1 file\n" +
+				"⁂ https://w3s.link/ipfs/" + testDirCID + "\n",
+			want: testDirCID,
+		},
+		{
+			name:   "shard CIDs are skipped in text",
+			output: "Stored shard " + shard + "\nRoot " + testFileCID + "\n",
+			want:   testFileCID,
+		},
+		{
+			name:   "invalid CID in JSON falls back to text",
+			output: `{"root":{"/":"bafynotacid"}}` + "\nroot: " + testV0CID,
+			want:   testV0CID,
+		},
+		{
+			name:   "no CID",
+			output: "Error: missing proof for space did:key:z6Mk...\n",
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseUploadCID(tt.output, tt.extra); got != tt.want {
+				t.Errorf("parseUploadCID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
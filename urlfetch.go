@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// RemoteFile is content downloaded from a user-supplied URL
+type RemoteFile struct {
+	Name        string
+	Content     []byte
+	ContentType string // As reported by the remote server
+}
+
+// RemoteFetcher downloads user-supplied URLs through the SSRF-safe client,
+// additionally applying the configured host allow and deny lists
+type RemoteFetcher struct {
+	client       *SafeHTTPClient
+	allowedHosts []string
+	deniedHosts  []string
+	maxResumes   int
+}
+
+// NewRemoteFetcher creates a fetcher configured from cfg
+func NewRemoteFetcher(cfg *Config) *RemoteFetcher {
+	f := &RemoteFetcher{
+		allowedHosts: cfg.URLFetchAllowedHosts,
+		deniedHosts:  cfg.URLFetchDeniedHosts,
+		maxResumes:   cfg.URLFetchMaxResumes,
+	}
+	f.client = NewSafeHTTPClient(cfg, cfg.URLFetchTimeout, f.checkURL)
+	return f
+}
+
+// Fetch downloads rawURL, refusing anything larger than maxBytes. The
+// download is written to a temporary file; if it is interrupted, it is
+// resumed with a Range request from the last byte received, up to
+// maxResumes times.
+func (f *RemoteFetcher) Fetch(ctx context.Context, rawURL string, maxBytes int64) (*RemoteFile, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, "Invalid URL")
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, "URL not allowed: %v", err)
+	}
+
+	resp, err := f.client.Get(ctx, u.String())
+	if err != nil {
+		return nil, fetchRequestError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, newAPIError(http.StatusBadGateway, CodeFetchFailed, "Remote server returned status %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxBytes {
+		resp.Body.Close()
+		return nil, newAPIError(http.StatusBadRequest, CodeFileTooLarge, "Remote file exceeds maximum size of %d bytes", maxBytes)
+	}
+
+	// Resumes go to wherever redirects led, and only when the server can
+	// tell us the content hasn't changed in between
+	finalURL := resp.Request.URL
+	contentType := resp.Header.Get("Content-Type")
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	resumable := validator != "" && resp.Header.Get("Accept-Ranges") == "bytes"
+
+	tmp, err := os.CreateTemp("", "urlfetch-*")
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var written int64
+	for resumes := 0; ; resumes++ {
+		// Read one byte past the limit to detect oversized bodies without a length
+		n, err := io.Copy(tmp, io.LimitReader(resp.Body, maxBytes+1-written))
+		resp.Body.Close()
+		written += n
+		if errors.Is(err, errResponseTooLarge) {
+			return nil, newAPIError(http.StatusBadRequest, CodeFileTooLarge, "Remote file exceeds the fetch size limit")
+		}
+		if written > maxBytes {
+			return nil, newAPIError(http.StatusBadRequest, CodeFileTooLarge, "Remote file exceeds maximum size of %d bytes", maxBytes)
+		}
+		if err == nil {
+			break
+		}
+		if !resumable || resumes >= f.maxResumes || ctx.Err() != nil {
+			return nil, newAPIError(http.StatusBadGateway, CodeFetchFailed, "Failed to read remote file: %v", err)
+		}
+
+		log.Printf("URL fetch interrupted after %d bytes, resuming: %v", written, err)
+		if resp, err = f.resume(ctx, finalURL, validator, written); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	name := sanitizeDisplayName(path.Base(finalURL.Path))
+	if name == "" || name == "." || name == "_" {
+		name = "download"
+	}
+
+	return &RemoteFile{
+		Name:        name,
+		Content:     content,
+		ContentType: contentType,
+	}, nil
+}
+
+// resume requests the rest of an interrupted download from offset. If-Range
+// makes the server send the whole file again (which is refused) rather than
+// a range of content that has changed.
+func (f *RemoteFetcher) resume(ctx context.Context, u *url.URL, validator string, offset int64) (*http.Response, error) {
+	if err := f.checkURL(u); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, "URL not allowed: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", validator)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fetchRequestError(err)
+	}
+	if resp.StatusCode != http.StatusPartialContent || !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+		resp.Body.Close()
+		return nil, newAPIError(http.StatusBadGateway, CodeFetchFailed, "Remote server could not resume the download (status %d)", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// fetchRequestError describes a failed request for a remote file
+func fetchRequestError(err error) error {
+	if errors.Is(err, errResponseTooLarge) {
+		return newAPIError(http.StatusBadRequest, CodeFileTooLarge, "Remote file exceeds the fetch size limit")
+	}
+	if errors.Is(err, errBlockedAddress) {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "URL not allowed: %v", err)
+	}
+	return newAPIError(http.StatusBadGateway, CodeFetchFailed, "Failed to fetch URL: %v", err)
+}
+
+// checkURL applies the scheme and host allow/deny lists to a URL
+func (f *RemoteFetcher) checkURL(u *url.URL) error {
+	if err := checkScheme(u); err != nil {
+		return err
+	}
+	host := strings.ToLower(u.Hostname())
+	if hostMatches(host, f.deniedHosts) {
+		return fmt.Errorf("host %s is denied", host)
+	}
+	if len(f.allowedHosts) > 0 && !hostMatches(host, f.allowedHosts) {
+		return fmt.Errorf("host %s is not in the allowlist", host)
+	}
+	return nil
+}
+
+// hostMatches reports whether host equals one of patterns or is a subdomain
+// of a pattern written as ".example.com" or "*.example.com"
+func hostMatches(host string, patterns []string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimPrefix(p, "*"))
+		if host == p || (strings.HasPrefix(p, ".") && strings.HasSuffix(host, p)) {
+			return true
+		}
+	}
+	return false
+}
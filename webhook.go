@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the request body
+// when a webhook secret is configured
+const webhookSignatureHeader = "X-Webhook-Signature"
+
+// webhookAttempts is how many times delivery of an event is tried
+const webhookAttempts = 3
+
+// WebhookEvent is the JSON body POSTed to the webhook URL
+type WebhookEvent struct {
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookNotifier delivers events to an operator-configured URL. Delivery
+// is asynchronous and best effort: failures are retried with backoff and
+// then logged, never surfaced to the request that triggered the event.
+type WebhookNotifier struct {
+	url    string
+	secret []byte
+	client *SafeHTTPClient
+}
+
+// NewWebhookNotifier creates a notifier from cfg, or returns nil when no
+// webhook URL is configured. A nil notifier silently drops events.
+func NewWebhookNotifier(cfg *Config) *WebhookNotifier {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+	return &WebhookNotifier{
+		url:    cfg.WebhookURL,
+		secret: []byte(cfg.WebhookSecret),
+		client: NewSafeHTTPClient(cfg, 10*time.Second, nil),
+	}
+}
+
+// Notify sends an event of the given type in the background
+func (w *WebhookNotifier) Notify(eventType string, data interface{}) {
+	if w == nil {
+		return
+	}
+	body, err := json.Marshal(WebhookEvent{Type: eventType, Timestamp: time.Now().UTC(), Data: data})
+	if err != nil {
+		log.Printf("Failed to encode %s webhook: %v", eventType, err)
+		return
+	}
+	go w.deliver(eventType, body)
+}
+
+// deliver posts body, retrying failed attempts with exponential backoff
+func (w *WebhookNotifier) deliver(eventType string, body []byte) {
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = w.post(body); err == nil {
+			return
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	log.Printf("Giving up on %s webhook after %d attempts: %v", eventType, webhookAttempts, err)
+}
+
+func (w *WebhookNotifier) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// maxBatchedClientIPs bounds the client IPs listed in one access event
+const maxBatchedClientIPs = 20
+
+// AccessNotifier sends a "share_link.accessed" webhook event for share
+// link use. Accesses of a link are batched: the first starts a window and
+// one event summarizing every access in it is sent when the window ends,
+// so a busy link can't flood the webhook.
+type AccessNotifier struct {
+	webhooks *WebhookNotifier
+	window   time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*accessBatch // By token
+}
+
+// accessBatch is the data of a pending access event
+type accessBatch struct {
+	Token              string    `json:"token"`
+	FileID             string    `json:"fileId"`
+	Views              int       `json:"views"`
+	Downloads          int       `json:"downloads"`
+	AccessesRemaining  *int      `json:"accessesRemaining"`
+	DownloadsRemaining *int      `json:"downloadsRemaining"`
+	ClientIPs          []string  `json:"clientIps"`
+	FirstAccessAt      time.Time `json:"firstAccessAt"`
+	LastAccessAt       time.Time `json:"lastAccessAt"`
+}
+
+// NewAccessNotifier creates a notifier from cfg, or returns nil when access
+// events are disabled. A nil notifier silently drops accesses.
+func NewAccessNotifier(cfg *Config, webhooks *WebhookNotifier) *AccessNotifier {
+	if webhooks == nil || !cfg.WebhookAccessEvents {
+		return nil
+	}
+	return &AccessNotifier{
+		webhooks: webhooks,
+		window:   cfg.WebhookAccessWindow,
+		pending:  make(map[string]*accessBatch),
+	}
+}
+
+// Record adds a use of a link, given its state after the use, to the
+// link's pending event
+func (a *AccessNotifier) Record(link ShareLink, kind, clientIP string, at time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	batch, exists := a.pending[link.Token]
+	if !exists {
+		batch = &accessBatch{Token: link.Token, FileID: link.FileID, FirstAccessAt: at, ClientIPs: []string{}}
+		a.pending[link.Token] = batch
+		time.AfterFunc(a.window, func() { a.flush(link.Token) })
+	}
+	switch kind {
+	case AccessKindView:
+		batch.Views++
+	case AccessKindDownload:
+		batch.Downloads++
+	}
+	batch.AccessesRemaining = link.AccessesRemaining()
+	batch.DownloadsRemaining = link.DownloadsRemaining()
+	batch.LastAccessAt = at
+	if len(batch.ClientIPs) < maxBatchedClientIPs && !slices.Contains(batch.ClientIPs, clientIP) {
+		batch.ClientIPs = append(batch.ClientIPs, clientIP)
+	}
+}
+
+// flush sends the pending event of a token
+func (a *AccessNotifier) flush(token string) {
+	a.mu.Lock()
+	batch := a.pending[token]
+	delete(a.pending, token)
+	a.mu.Unlock()
+	if batch != nil {
+		a.webhooks.Notify("share_link.accessed", batch)
+	}
+}